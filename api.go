@@ -1,18 +1,24 @@
 package stacker
 
 import (
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"net/url"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/anmitsu/go-shlex"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	MediaTypeImageBtrfsLayer = "application/vnd.cisco.image.layer.btrfs"
+	MediaTypeImageBtrfsLayer    = "application/vnd.cisco.image.layer.btrfs"
+	MediaTypeImageSquashfsLayer = "application/vnd.cisco.image.layer.squashfs"
 )
 
 // StackerConfig is a struct that contains global (or widely used) stacker
@@ -21,6 +27,66 @@ type StackerConfig struct {
 	StackerDir string
 	OCIDir     string
 	RootFSDir  string
+
+	// StorageType is the name of the storage driver to use; the default
+	// is btrfs.
+	StorageType string
+
+	// Lock, if non-nil, pins docker bases and downloaded imports to the
+	// digests recorded in it.
+	Lock *Lockfile
+
+	// CACert is the path to a PEM bundle of CAs to trust, in addition to
+	// the system ones, for downloads and registry access.
+	CACert string
+
+	// InsecureRegistries are hosts whose TLS certificates aren't verified.
+	InsecureRegistries []string
+
+	// RegistryUsername and RegistryPassword, if set, are used for all
+	// registries instead of the credentials in the docker config.
+	RegistryUsername string
+	RegistryPassword string
+
+	// Network, DNS and ExtraHosts are the defaults for layers that don't
+	// set their own network, dns and extra_hosts.
+	Network    string
+	DNS        []string
+	ExtraHosts []string
+
+	// Runtime is the runtime that run sections are executed with: "lxc"
+	// (the default) or an OCI runtime binary like runc or crun, which is
+	// passed RuntimeArgs before its "run" subcommand.
+	Runtime     string
+	RuntimeArgs []string
+
+	// Arch, if set, is the architecture (in GOARCH terms, e.g. arm64) to
+	// build images for, instead of the host's. Docker bases are pulled for
+	// it, and foreign arches' run sections are run under qemu.
+	Arch string
+
+	// SSHAuthSock, if set, is the ssh agent socket that run sections can
+	// use, at SSHAgentSocket.
+	SSHAuthSock string
+
+	// MaxCacheSize, if positive, is how many bytes the imports and
+	// downloaded bases in StackerDir may use before the least recently
+	// used ones are evicted.
+	MaxCacheSize int64
+
+	// DownloadRateLimit, if positive, is how many bytes per second all of
+	// the downloads of imports may use together. Each sftp import's scp is
+	// given the whole limit, on top of the others.
+	DownloadRateLimit int64
+
+	// ImportCAS, if set, is the directory of the content addressed store
+	// that downloaded imports are shared through by all projects; see
+	// DefaultImportCAS.
+	ImportCAS string
+
+	// ImportMirrors maps url prefixes of imports to the prefixes of
+	// mirrors to try, in order, if an import can't be fetched.
+	ImportMirrors map[string][]string
 }
 
 type Stackerfile map[string]*Layer
@@ -60,47 +126,534 @@ func (is *ImageSource) ParseTag() (string, error) {
 		// url path, let's use the host as the image tag
 		return strings.Replace(url.Host, ":", "-", -1), nil
 
+	case OCIType:
+		layout, tag, err := is.ParseOCI()
+		if err != nil {
+			return "", err
+		}
+
+		// The tag alone isn't enough: bases from different layouts
+		// (or a layer of this build) may well have the same one.
+		abs, err := filepath.Abs(layout)
+		if err != nil {
+			return "", err
+		}
+
+		sum := sha256.Sum256([]byte(abs))
+		return fmt.Sprintf("%s-%x-%s", path.Base(abs), sum[:4], tag), nil
 	default:
 		return "", fmt.Errorf("unsupported type: %s", is.Type)
 	}
 }
 
+// ParseOCI returns the layout path and tag of an oci base. The tag may either
+// be given explicitly via tag:, or as part of the url, e.g. ../other/oci:tag.
+func (is *ImageSource) ParseOCI() (string, string, error) {
+	if is.Tag != "" {
+		return is.Url, is.Tag, nil
+	}
+
+	idx := strings.LastIndex(is.Url, ":")
+	if idx < 0 || strings.Contains(is.Url[idx:], "/") {
+		return "", "", fmt.Errorf("no tag specified for oci base %s", is.Url)
+	}
+
+	return is.Url[:idx], is.Url[idx+1:], nil
+}
+
+// Healthcheck describes a docker-style healthcheck for the image. Durations
+// are in the format understood by time.ParseDuration, e.g. "30s".
+type Healthcheck struct {
+	Test        interface{} `yaml:"test"`
+	Interval    string      `yaml:"interval"`
+	Timeout     string      `yaml:"timeout"`
+	StartPeriod string      `yaml:"start_period"`
+	Retries     int         `yaml:"retries"`
+}
+
+// Hooks are commands run on the host before and after a layer is built. Each
+// may be a single command or a list of them.
+type Hooks struct {
+	Prebuild  interface{} `yaml:"prebuild"`
+	Postbuild interface{} `yaml:"postbuild"`
+}
+
+// Resources are the limits placed on the container a layer's run section
+// runs in. Memory is a size like "2G"; cpus may be fractional.
+type Resources struct {
+	Memory string  `yaml:"memory"`
+	CPUs   float64 `yaml:"cpus"`
+	Pids   int64   `yaml:"pids"`
+}
+
+// ShellOptions are the shell's set -e, -x, -u and -o pipefail options for a
+// layer's run section. Unset ones have their defaults: errexit and xtrace
+// are on, nounset and pipefail are off.
+type ShellOptions struct {
+	Errexit  *bool `yaml:"errexit"`
+	Xtrace   *bool `yaml:"xtrace"`
+	Nounset  *bool `yaml:"nounset"`
+	Pipefail *bool `yaml:"pipefail"`
+}
+
 type Layer struct {
-	From        *ImageSource      `yaml:"from"`
-	Import      interface{}       `yaml:"import"`
-	Run         interface{}       `yaml:"run"`
-	Cmd         interface{}       `yaml:"cmd"`
-	Entrypoint  interface{}       `yaml:"entrypoint"`
-	FullCommand interface{}       `yaml:"full_command"`
-	Environment map[string]string `yaml:"environment"`
-	Volumes     []string          `yaml:"volumes"`
-	Labels      map[string]string `yaml:"labels"`
-	WorkingDir  string            `yaml:"working_dir"`
-	BuildOnly   bool              `yaml:"build_only"`
+	From                *ImageSource        `yaml:"from"`
+	Import              interface{}         `yaml:"import"`
+	Run                 interface{}         `yaml:"run"`
+	Cmd                 interface{}         `yaml:"cmd"`
+	Entrypoint          interface{}         `yaml:"entrypoint"`
+	FullCommand         interface{}         `yaml:"full_command"`
+	Environment         map[string]string   `yaml:"environment"`
+	Volumes             []string            `yaml:"volumes"`
+	Labels              map[string]string   `yaml:"labels"`
+	Annotations         map[string]string   `yaml:"annotations"`
+	WorkingDir          string              `yaml:"working_dir"`
+	BuildOnly           bool                `yaml:"build_only"`
+	Healthcheck         *Healthcheck        `yaml:"healthcheck"`
+	StopSignal          string              `yaml:"stop_signal"`
+	Matrix              map[string][]string `yaml:"matrix"`
+	DependsOn           []string            `yaml:"depends_on"`
+	LayerType           interface{}         `yaml:"layer_type"`
+	Hooks               *Hooks              `yaml:"hooks"`
+	Resources           *Resources          `yaml:"resources"`
+	Network             string              `yaml:"network"`
+	DNS                 []string            `yaml:"dns"`
+	ExtraHosts          []string            `yaml:"extra_hosts"`
+	UIDMap              []string            `yaml:"uid_map"`
+	GIDMap              []string            `yaml:"gid_map"`
+	RunTimeout          string              `yaml:"run_timeout"`
+	RunRetries          int                 `yaml:"run_retries"`
+	ImportCmd           string              `yaml:"import_cmd"`
+	LayerPerRun         bool                `yaml:"layer_per_run"`
+	BuildCacheDirs      []string            `yaml:"build_cache_dirs"`
+	OS                  string              `yaml:"os"`
+	Arch                string              `yaml:"arch"`
+	BuildEnv            map[string]string   `yaml:"build_env"`
+	BuildEnvPassthrough []string            `yaml:"build_env_passthrough"`
+	MaxSize             string              `yaml:"max_size"`
+	Shell               string              `yaml:"shell"`
+	ShellOptions        *ShellOptions       `yaml:"shell_options"`
+	ShellForm           bool                `yaml:"shell_form"`
+	InheritLabels       *bool               `yaml:"inherit_labels"`
+	ClearEnv            bool                `yaml:"clear_env"`
+	ClearVolumes        bool                `yaml:"clear_volumes"`
+	ConfigTemplate      string              `yaml:"config_template"`
+	User                string              `yaml:"user"`
+	If                  *string             `yaml:"if"`
+
+	// source is the stackerfile this layer was defined in.
+	source string
+
+	// contextDir is where the layer's hooks and import_cmd run, and
+	// buildContext what its relative imports are relative to ("" meaning
+	// the current directory); see ParseOpts.BuildContext.
+	contextDir   string
+	buildContext string
+
+	// generatedImports are the imports that import_cmd produced.
+	generatedImports []string
+
+	// baseDigest is the digest the docker base resolved to, if it has
+	// been; see resolveBaseDigest.
+	baseDigest string
 }
 
-func (l *Layer) ParseCmd() ([]string, error) {
-	return l.getStringOrStringSlice(l.Cmd, func(s string) ([]string, error) {
-		return shlex.Split(s, true)
+// Source returns the path of the stackerfile this layer was defined in.
+func (l *Layer) Source() string {
+	return l.source
+}
+
+// CommandShell is the shell that shell form commands are run with, as in
+// docker. The layer's shell isn't used, since that's only what its run
+// section is built with and may not exist in the final image.
+const CommandShell = "/bin/sh"
+
+// parseCommand parses a cmd, entrypoint or full_command. Lists are used as
+// they are (exec form). Strings are split into words like a shell would, or
+// with shell_form, wrapped as [shell, "-c", string] (shell form), like
+// docker does.
+func (l *Layer) parseCommand(iface interface{}) ([]string, error) {
+	return l.getStringOrStringSlice(iface, func(s string) ([]string, error) {
+		if !l.ShellForm {
+			return shlex.Split(s, true)
+		}
+
+		return []string{CommandShell, "-c", s}, nil
 	})
 }
 
+// isShellForm returns true if the command iface is in shell form.
+func (l *Layer) isShellForm(iface interface{}) bool {
+	_, ok := iface.(string)
+	return ok && l.ShellForm
+}
+
+func (l *Layer) ParseCmd() ([]string, error) {
+	return l.parseCommand(l.Cmd)
+}
+
 func (l *Layer) ParseEntrypoint() ([]string, error) {
-	return l.getStringOrStringSlice(l.Entrypoint, func(s string) ([]string, error) {
-		return shlex.Split(s, true)
-	})
+	return l.parseCommand(l.Entrypoint)
 }
 
 func (l *Layer) ParseFullCommand() ([]string, error) {
-	return l.getStringOrStringSlice(l.FullCommand, func(s string) ([]string, error) {
-		return shlex.Split(s, true)
+	return l.parseCommand(l.FullCommand)
+}
+
+// ImportSpec is a single entry in a layer's import directive. In the
+// stackerfile, it may either be just the path (or url), or a map with the
+// path and other options.
+type ImportSpec struct {
+	Path string `yaml:"path"`
+
+	// Signature is the path or url of a detached gpg signature of the
+	// import, which is verified against the (binary, i.e. gpg --export)
+	// keyring Keyring before the import is used.
+	Signature string `yaml:"signature"`
+	Keyring   string `yaml:"keyring"`
+
+	// Symlinks is what to do with symlinks in local imports; see
+	// SymlinkPolicy.
+	Symlinks SymlinkPolicy `yaml:"symlinks"`
+
+	// Checksums is the path or url of a checksums file (in the format of
+	// sha256sum's output) that lists the import's sha256 under its base
+	// name. If ChecksumsSignature is set, the checksums file's detached gpg
+	// signature is verified against Keyring first.
+	Checksums          string `yaml:"checksums"`
+	ChecksumsSignature string `yaml:"checksums_signature"`
+
+	// Mirrors are other places to fetch the import from, tried in order
+	// if Path can't be; see importCandidates.
+	Mirrors []string `yaml:"mirrors"`
+}
+
+// importGroup is the map form of an import with a list of paths rather than
+// a single one, which all get the same options, e.g. a checksums file.
+type importGroup struct {
+	ImportSpec `yaml:",inline"`
+	Paths      []string `yaml:"paths"`
+}
+
+// SymlinkPolicy is how symlinks in local imports are imported.
+type SymlinkPolicy string
+
+const (
+	// DefaultSymlinks follows an import that is itself a symlink, but
+	// copies symlinks inside imported directories as symlinks.
+	DefaultSymlinks SymlinkPolicy = ""
+
+	// FollowSymlinks copies what every symlink points to instead.
+	FollowSymlinks SymlinkPolicy = "follow"
+
+	// PreserveSymlinks copies every symlink as a symlink, including the
+	// import itself.
+	PreserveSymlinks SymlinkPolicy = "preserve"
+)
+
+// ParseImports returns the layer's imports along with their options.
+func (l *Layer) ParseImports() ([]ImportSpec, error) {
+	imports, err := l.parseImportSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.buildContext != "" {
+		for i := range imports {
+			imports[i].Path = l.resolveImportPath(imports[i].Path)
+			imports[i].Signature = l.resolveImportPath(imports[i].Signature)
+			imports[i].Keyring = l.resolveImportPath(imports[i].Keyring)
+			imports[i].Checksums = l.resolveImportPath(imports[i].Checksums)
+			imports[i].ChecksumsSignature = l.resolveImportPath(imports[i].ChecksumsSignature)
+			for j := range imports[i].Mirrors {
+				imports[i].Mirrors[j] = l.resolveImportPath(imports[i].Mirrors[j])
+			}
+		}
+	}
+
+	// These were already resolved by RunImportCmd.
+	for _, p := range l.generatedImports {
+		imports = append(imports, ImportSpec{Path: p})
+	}
+
+	return imports, nil
+}
+
+// resolveImportPath makes a relative local path relative to the layer's
+// build context.
+func (l *Layer) resolveImportPath(p string) string {
+	if p == "" || path.IsAbs(p) {
+		return p
+	}
+
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme != "" {
+		return p
+	}
+
+	return path.Join(l.buildContext, p)
+}
+
+func (l *Layer) parseImportSpecs() ([]ImportSpec, error) {
+	if ifs, ok := l.Import.([]interface{}); ok {
+		imports := []ImportSpec{}
+		for _, i := range ifs {
+			switch v := i.(type) {
+			case string:
+				imports = append(imports, ImportSpec{Path: v})
+			case map[interface{}]interface{}:
+				content, err := yaml.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+
+				group := importGroup{}
+				if err := yaml.UnmarshalStrict(content, &group); err != nil {
+					return nil, err
+				}
+
+				imp := group.ImportSpec
+				if imp.Path == "" && len(group.Paths) == 0 {
+					return nil, fmt.Errorf("import without a path: %v", v)
+				}
+
+				if imp.Path != "" && len(group.Paths) > 0 {
+					return nil, fmt.Errorf("import with both a path and paths: %v", v)
+				}
+
+				switch imp.Symlinks {
+				case DefaultSymlinks, FollowSymlinks, PreserveSymlinks:
+				default:
+					return nil, fmt.Errorf("import %s has unknown symlinks policy %s", imp.Path, imp.Symlinks)
+				}
+
+				if imp.Path != "" {
+					imports = append(imports, imp)
+				}
+
+				for _, p := range group.Paths {
+					imp.Path = p
+					imports = append(imports, imp)
+				}
+			default:
+				return nil, fmt.Errorf("unknown import type: %T", i)
+			}
+		}
+
+		return imports, nil
+	}
+
+	paths, err := l.getStringOrStringSlice(l.Import, func(s string) ([]string, error) {
+		return strings.Split(s, "\n"), nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	imports := []ImportSpec{}
+	for _, p := range paths {
+		imports = append(imports, ImportSpec{Path: p})
+	}
+
+	return imports, nil
 }
 
+// ParseImport returns the paths (or urls) of the layer's imports.
 func (l *Layer) ParseImport() ([]string, error) {
-	return l.getStringOrStringSlice(l.Import, func(s string) ([]string, error) {
-		return strings.Split(s, "\n"), nil
+	imports, err := l.ParseImports()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, imp := range imports {
+		paths = append(paths, imp.Path)
+	}
+
+	return paths, nil
+}
+
+// ParseHealthcheck converts the layer's healthcheck into the representation
+// used in docker image configs. A string test is run with the container's
+// shell (CMD-SHELL); a list test is exec'd directly (CMD), unless it already
+// starts with one of the docker test types.
+func (l *Layer) ParseHealthcheck() (*DockerHealthcheck, error) {
+	if l.Healthcheck == nil {
+		return nil, nil
+	}
+
+	hc := &DockerHealthcheck{Retries: l.Healthcheck.Retries}
+
+	switch test := l.Healthcheck.Test.(type) {
+	case string:
+		hc.Test = []string{"CMD-SHELL", test}
+	default:
+		strs, err := l.getStringOrStringSlice(test, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(strs) == 0 {
+			return nil, fmt.Errorf("healthcheck requires a test")
+		}
+
+		switch strs[0] {
+		case "NONE", "CMD", "CMD-SHELL":
+			hc.Test = strs
+		default:
+			hc.Test = append([]string{"CMD"}, strs...)
+		}
+	}
+
+	durations := []struct {
+		name string
+		in   string
+		out  *time.Duration
+	}{
+		{"interval", l.Healthcheck.Interval, &hc.Interval},
+		{"timeout", l.Healthcheck.Timeout, &hc.Timeout},
+		{"start_period", l.Healthcheck.StartPeriod, &hc.StartPeriod},
+	}
+
+	for _, d := range durations {
+		if d.in == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(d.in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthcheck %s: %s", d.name, err)
+		}
+
+		*d.out = parsed
+	}
+
+	return hc, nil
+}
+
+const (
+	TarLayer      = "tar"
+	SquashfsLayer = "squashfs"
+)
+
+// ParseLayerType returns the list of layer types to generate for this layer;
+// if none are specified, it is just a tar layer.
+func (l *Layer) ParseLayerType() ([]string, error) {
+	types, err := l.getStringOrStringSlice(l.LayerType, func(s string) ([]string, error) {
+		return []string{s}, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(types) == 0 {
+		return []string{TarLayer}, nil
+	}
+
+	for _, t := range types {
+		if t != TarLayer && t != SquashfsLayer {
+			return nil, fmt.Errorf("unknown layer type %s", t)
+		}
+	}
+
+	return types, nil
+}
+
+// ParseHooks returns the layer's prebuild and postbuild hooks.
+func (l *Layer) ParseHooks() ([]string, []string, error) {
+	if l.Hooks == nil {
+		return []string{}, []string{}, nil
+	}
+
+	single := func(s string) ([]string, error) {
+		return []string{s}, nil
+	}
+
+	prebuild, err := l.getStringOrStringSlice(l.Hooks.Prebuild, single)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	postbuild, err := l.getStringOrStringSlice(l.Hooks.Postbuild, single)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return prebuild, postbuild, nil
+}
+
+// ParseRunTimeout returns how long the layer's run section may take, or 0 if
+// it isn't limited.
+func (l *Layer) ParseRunTimeout() (time.Duration, error) {
+	if l.RunTimeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(l.RunTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid run_timeout: %s", err)
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid run_timeout %s", l.RunTimeout)
+	}
+
+	return timeout, nil
+}
+
+// Platform is what an image runs on, as recorded in its config.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform returns the platform of the layer's image: its os and arch
+// (which may have a variant, as in arm64/v8) if it sets them, or the host's
+// os and sc.Arch (or the host's arch) if not.
+func (l *Layer) ParsePlatform(sc StackerConfig) (Platform, error) {
+	p := Platform{OS: l.OS, Architecture: l.Arch}
+	if p.OS == "" {
+		p.OS = runtime.GOOS
+	}
+
+	if p.Architecture == "" {
+		p.Architecture = sc.Arch
+		if p.Architecture == "" {
+			p.Architecture = runtime.GOARCH
+		}
+	}
+
+	parts := strings.Split(p.Architecture, "/")
+	switch len(parts) {
+	case 1:
+	case 2:
+		p.Architecture, p.Variant = parts[0], parts[1]
+	default:
+		return Platform{}, fmt.Errorf("invalid arch %s", l.Arch)
+	}
+
+	if p.Architecture == "" || (len(parts) == 2 && p.Variant == "") {
+		return Platform{}, fmt.Errorf("invalid arch %s", l.Arch)
+	}
+
+	return p, nil
+}
+
+// config returns the StackerConfig to build the layer with, and its
+// platform. A layer that sets its own arch is built for that, rather than
+// sc.Arch.
+func (l *Layer) config(sc StackerConfig) (StackerConfig, Platform, error) {
+	platform, err := l.ParsePlatform(sc)
+	if err != nil {
+		return StackerConfig{}, Platform{}, err
+	}
+
+	if l.Arch != "" {
+		sc.Arch = platform.Architecture
+	}
+
+	return sc, platform, nil
 }
 
 func (l *Layer) getRun() ([]string, error) {
@@ -153,79 +706,399 @@ func (l *Layer) getStringOrStringSlice(iface interface{}, xform func(string) ([]
 	return nil, fmt.Errorf("unknown directive type: %T", l.Run)
 }
 
+// stackerfileDoc is the on-disk representation of a stackerfile: a map of
+// layer names to layers, plus a few reserved top level keys.
+type stackerfileDoc struct {
+	Includes []string          `yaml:"includes"`
+	Layers   map[string]*Layer `yaml:",inline"`
+}
+
+// ParseOpts controls how stackerfiles are parsed.
+type ParseOpts struct {
+	// Substitutions is a list of KEY=VALUE pairs of things to substitute.
+	// Note that this is explicitly not a map, because the substitutions
+	// are performed one at a time in the order that they are given.
+	Substitutions []string
+
+	// Template enables go text/template processing of the stackerfile
+	// before it is parsed; the substitutions are available as template
+	// variables, e.g. {{.FOO}}.
+	Template bool
+
+	// BuildContext, if set, is the directory that relative imports are
+	// resolved against and that hooks and import_cmd run in, instead of
+	// the current directory (for imports) and the stackerfile's directory
+	// (for the others). Stackerfiles read from stdin or a url have no
+	// directory of their own, so it is the current directory for them if
+	// this isn't set.
+	BuildContext string
+
+	// ImportsRelativeToStackerfile resolves the relative imports of each
+	// local stackerfile against its own directory, as if stacker had been
+	// run there; it is used by recursive builds. BuildContext, if set,
+	// takes precedence.
+	ImportsRelativeToStackerfile bool
+
+	// Config is used to fetch stackerfiles from https urls.
+	Config StackerConfig
+}
+
 // NewStackerfile creates a new stackerfile from the given path. substitutions
-// is a list of KEY=VALUE pairs of things to substitute. Note that this is
-// explicitly not a map, because the substitutions are performed one at a time
-// in the order that they are given.
+// is a list of KEY=VALUE pairs of things to substitute.
+//
+// Any stackerfiles listed in the top level includes: directive are parsed
+// with the same substitutions and merged in. Include paths are relative to
+// the directory of the stackerfile that includes them.
 func NewStackerfile(stackerfile string, substitutions []string) (Stackerfile, error) {
+	return NewStackerfiles([]string{stackerfile}, ParseOpts{Substitutions: substitutions})
+}
+
+// NewStackerfiles parses and merges several stackerfiles (and anything they
+// include). It is an error for two of them to define the same layer.
+func NewStackerfiles(stackerfiles []string, opts ParseOpts) (Stackerfile, error) {
 	sf := Stackerfile{}
+	seen := map[string]bool{}
+
+	for _, f := range stackerfiles {
+		other, err := newStackerfile(f, opts, seen)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := sf.merge(other, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sf.applyConfigTemplates(opts); err != nil {
+		return nil, err
+	}
+
+	sf.pruneConditional()
 
-	raw, err := ioutil.ReadFile(stackerfile)
+	return sf, nil
+}
+
+func newStackerfile(stackerfile string, opts ParseOpts, seen map[string]bool) (Stackerfile, error) {
+	var err error
+	abs := stackerfile
+	if IsLocalStackerfile(stackerfile) {
+		abs, err = filepath.Abs(stackerfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if seen[abs] {
+		return Stackerfile{}, nil
+	}
+	seen[abs] = true
+
+	raw, err := readStackerfile(stackerfile, opts.Config)
 	if err != nil {
 		return nil, err
 	}
 
 	content := string(raw)
 
-	for _, subst := range substitutions {
-		membs := strings.SplitN(subst, "=", 2)
-		if len(membs) != 2 {
-			return nil, fmt.Errorf("invalid substition %s", subst)
+	if opts.Template {
+		content, err = renderTemplate(stackerfile, content, opts.Substitutions)
+		if err != nil {
+			return nil, WithKind(UserError, err)
 		}
+	}
 
-		from := fmt.Sprintf("$%s", membs[0])
-		to := membs[1]
+	content, err = substitute(stackerfile, content, opts.Substitutions, matrixVariables(content))
+	if err != nil {
+		return nil, WithKind(UserError, err)
+	}
 
-		fmt.Printf("substituting %s to %s\n", from, to)
+	// Unmarshal strictly so that typos like "enviroment:" are reported
+	// (with their line number) instead of silently ignored.
+	doc := stackerfileDoc{}
+	if err := yaml.UnmarshalStrict([]byte(content), &doc); err != nil {
+		return nil, WithKind(UserError, errors.Wrapf(err, "couldn't parse %s", stackerfile))
+	}
 
-		content = strings.Replace(content, from, to, -1)
+	sf := Stackerfile(doc.Layers)
+	if sf == nil {
+		sf = Stackerfile{}
 	}
 
-	if err := yaml.Unmarshal([]byte(content), &sf); err != nil {
-		return nil, err
+	if err := sf.expandMatrices(); err != nil {
+		return nil, WithKind(UserError, err)
+	}
+
+	if err := sf.expandRunLayers(); err != nil {
+		return nil, WithKind(UserError, err)
+	}
+
+	contextDir := opts.BuildContext
+	if contextDir == "" {
+		contextDir = "."
+		if IsLocalStackerfile(stackerfile) {
+			contextDir = filepath.Dir(stackerfile)
+		}
+	}
+
+	buildContext := opts.BuildContext
+	if buildContext == "" && opts.ImportsRelativeToStackerfile && IsLocalStackerfile(stackerfile) {
+		buildContext = filepath.Dir(abs)
+	}
+
+	for _, layer := range sf {
+		layer.source = stackerfile
+		layer.contextDir = contextDir
+		layer.buildContext = buildContext
+	}
+
+	for _, include := range doc.Includes {
+		include, err = resolveInclude(stackerfile, include, opts.BuildContext)
+		if err != nil {
+			return nil, err
+		}
+
+		included, err := newStackerfile(include, opts, seen)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't include %s", include)
+		}
+
+		if err := sf.merge(included, include); err != nil {
+			return nil, err
+		}
 	}
 
-	return sf, err
+	return sf, nil
 }
 
-func (s *Stackerfile) DependencyOrder() ([]string, error) {
-	ret := []string{}
+// merge adds the layers from other (which was parsed from source) into s.
+func (s Stackerfile) merge(other Stackerfile, source string) error {
+	for name, layer := range other {
+		if _, ok := s[name]; ok {
+			return WithKind(UserError, fmt.Errorf("duplicate layer %s in %s", name, source))
+		}
 
-	for i := 0; i < len(*s); i++ {
-		for name, layer := range *s {
-			have := false
-			haveTag := false
-			for _, l := range ret {
-				if l == name {
-					have = true
+		s[name] = layer
+	}
+
+	return nil
+}
+
+// expandRunLayers replaces each layer that has layer_per_run: with a chain of
+// layers, one per entry in its run section, each built on the previous one.
+// The last one keeps the layer's name; the others are named <name>-run-<n>.
+// This way each run entry produces its own OCI layer and cache entry, so
+// changing one only rebuilds it and the ones after it.
+func (s Stackerfile) expandRunLayers() error {
+	for name, layer := range s {
+		if !layer.LayerPerRun {
+			continue
+		}
+
+		run, err := layer.getRun()
+		if err != nil {
+			return errors.Wrapf(err, "layer %s", name)
+		}
+
+		layer.LayerPerRun = false
+		if len(run) < 2 {
+			continue
+		}
+
+		content, err := yaml.Marshal(layer)
+		if err != nil {
+			return err
+		}
+
+		delete(s, name)
+
+		prev := ""
+		for i, cmd := range run {
+			l := &Layer{}
+			if err := yaml.UnmarshalStrict(content, l); err != nil {
+				return errors.Wrapf(err, "couldn't expand runs of layer %s", name)
+			}
+
+			l.Run = cmd
+
+			// Only the first step has the original base and
+			// dependencies, and runs the prebuild hooks; only the
+			// last runs the postbuild hooks.
+			if i > 0 {
+				l.From = &ImageSource{Type: BuiltType, Tag: prev}
+				l.DependsOn = nil
+				if l.Hooks != nil {
+					l.Hooks.Prebuild = nil
 				}
+			}
 
-				if l == layer.From.Tag {
-					haveTag = true
+			newName := name
+			if i < len(run)-1 {
+				newName = fmt.Sprintf("%s-run-%d", name, i+1)
+				l.LayerType = nil
+				if l.Hooks != nil {
+					l.Hooks.Postbuild = nil
 				}
 			}
 
+			if _, ok := s[newName]; ok && newName != name {
+				return fmt.Errorf("run layer %s conflicts with an existing layer", newName)
+			}
+
+			s[newName] = l
+			prev = newName
+		}
+	}
+
+	return nil
+}
+
+// Dependencies returns the names of the layers that must be built before this
+// one: its base if it is a built layer, and anything in depends_on.
+func (l *Layer) Dependencies() []string {
+	deps := []string{}
+	if l.From != nil && l.From.Type == BuiltType {
+		deps = append(deps, l.From.Tag)
+	}
+
+	return append(deps, l.DependsOn...)
+}
+
+// dependency is an edge of the dependency graph: the layer depends on layer,
+// because of its field (e.g. from, or an import of stacker://...).
+type dependency struct {
+	layer string
+	field string
+}
+
+// dependencies returns the layers in s that the layer depends on, and why.
+// Besides Dependencies(), that includes the layers it has stacker:// imports
+// from, when they are in s.
+func (s Stackerfile) dependencies(l *Layer) []dependency {
+	deps := []dependency{}
+	if l.From != nil && l.From.Type == BuiltType {
+		deps = append(deps, dependency{l.From.Tag, "from"})
+	}
+
+	for _, d := range l.DependsOn {
+		deps = append(deps, dependency{d, "depends_on"})
+	}
+
+	imports, _ := l.ParseImport()
+	for _, i := range imports {
+		u, err := url.Parse(i)
+		if err != nil || u.Scheme != "stacker" {
+			continue
+		}
+
+		if _, ok := s[u.Host]; ok {
+			deps = append(deps, dependency{u.Host, fmt.Sprintf("import %s", i)})
+		}
+	}
+
+	return deps
+}
+
+func (s *Stackerfile) DependencyOrder() ([]string, error) {
+	ret := []string{}
+	processed := map[string]bool{}
+
+	names := []string{}
+	for name := range *s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i := 0; i < len(*s); i++ {
+		for _, name := range names {
+			layer := (*s)[name]
+
 			// do we have this layer yet?
-			if !have {
-				if layer.From == nil {
-					return nil, fmt.Errorf("invalid layer: no base (from directive)")
-				}
-				// all imported layers have no deps
-				if layer.From.Type != BuiltType {
-					ret = append(ret, name)
-				}
+			if processed[name] {
+				continue
+			}
+
+			if layer.From == nil {
+				return nil, WithKind(UserError, fmt.Errorf("invalid layer %s: no base (from directive)", name))
+			}
 
-				// otherwise, we need to have the tag
-				if haveTag {
-					ret = append(ret, name)
+			// we need to have all of its dependencies first
+			ready := true
+			for _, dep := range s.dependencies(layer) {
+				if !processed[dep.layer] {
+					ready = false
+					break
 				}
 			}
+
+			if ready {
+				ret = append(ret, name)
+				processed[name] = true
+			}
 		}
 	}
 
 	if len(ret) != len(*s) {
-		return nil, fmt.Errorf("couldn't resolve some dependencies")
+		return nil, WithKind(UserError, s.unresolvable(names, processed))
 	}
 
 	return ret, nil
 }
+
+// unresolvable explains why the layers that aren't processed couldn't be
+// ordered: either one of them depends on a layer that doesn't exist, or
+// there is a cycle, which is reported as the path around it, with the field
+// that makes each edge.
+func (s Stackerfile) unresolvable(names []string, processed map[string]bool) error {
+	for _, name := range names {
+		if processed[name] {
+			continue
+		}
+
+		for _, dep := range s.dependencies(s[name]) {
+			if _, ok := s[dep.layer]; !ok {
+				return fmt.Errorf("layer %s depends on unknown layer %s (%s)", name, dep.layer, dep.field)
+			}
+		}
+	}
+
+	// Everything left depends on something else that's left, so walking
+	// from any of them has to come back around to a layer on the path.
+	name := ""
+	for _, n := range names {
+		if !processed[n] {
+			name = n
+			break
+		}
+	}
+
+	path := []string{}
+	onPath := map[string]int{}
+	edges := []dependency{}
+	for {
+		if start, ok := onPath[name]; ok {
+			cycle := []string{path[start]}
+			for _, e := range edges[start:] {
+				cycle = append(cycle, fmt.Sprintf("%s (%s)", e.layer, e.field))
+			}
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		onPath[name] = len(path)
+		path = append(path, name)
+
+		next := ""
+		for _, dep := range s.dependencies(s[name]) {
+			if !processed[dep.layer] {
+				edges = append(edges, dep)
+				next = dep.layer
+				break
+			}
+		}
+
+		if next == "" {
+			return fmt.Errorf("couldn't resolve some dependencies")
+		}
+		name = next
+	}
+}
@@ -0,0 +1,179 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerConfig is the subset of ~/.docker/config.json that stacker
+// understands.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return path.Join(dir, "config.json")
+	}
+
+	return path.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// normalizeRegistry turns the keys docker uses in its config (e.g.
+// https://index.docker.io/v1/) into bare hosts, as returned by registryHost.
+func normalizeRegistry(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server = strings.SplitN(server, "/", 2)[0]
+	if server == "index.docker.io" || server == "registry-1.docker.io" {
+		return "docker.io"
+	}
+
+	return server
+}
+
+// credentialHelper runs docker-credential-<helper> to get the credentials
+// for server. Helpers report missing credentials as an error, which we treat
+// as no credentials.
+func credentialHelper(helper string, server string) (string, string, error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", helper), "get")
+	cmd.Stdin = strings.NewReader(server)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(string(output)+stderr.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%s get %s: %s: %s", helper, server, err, stderr.String())
+	}
+
+	result := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", "", errors.Wrapf(err, "bad output from docker-credential-%s", helper)
+	}
+
+	return result.Username, result.Secret, nil
+}
+
+// registryCredentials returns the username and password to use for the
+// registry host: the ones given on the command line if any, otherwise the
+// ones from the docker config, either directly or via its credential
+// helpers. If there are none, empty strings are returned.
+func registryCredentials(c StackerConfig, host string) (string, string, error) {
+	if c.RegistryUsername != "" {
+		return c.RegistryUsername, c.RegistryPassword, nil
+	}
+
+	content, err := ioutil.ReadFile(dockerConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	config := dockerConfig{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return "", "", errors.Wrapf(err, "couldn't parse %s", dockerConfigPath())
+	}
+
+	server := host
+	if host == "docker.io" {
+		server = dockerHubServer
+	}
+
+	for registry, helper := range config.CredHelpers {
+		if normalizeRegistry(registry) == host {
+			return credentialHelper(helper, server)
+		}
+	}
+
+	for registry, auth := range config.Auths {
+		if normalizeRegistry(registry) != host || auth.Auth == "" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "bad auth for %s in %s", registry, dockerConfigPath())
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("bad auth for %s in %s", registry, dockerConfigPath())
+		}
+
+		return parts[0], parts[1], nil
+	}
+
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, server)
+	}
+
+	return "", "", nil
+}
+
+// writeAuthFile writes the credentials for host to a temporary auth file
+// that skopeo can use, so that they don't show up on its command line. Only
+// the user can read it, and the caller should remove it as soon as skopeo is
+// done. If there are no credentials, "" is returned.
+func writeAuthFile(c StackerConfig, host string) (string, error) {
+	// Older versions kept the credentials in the stacker dir for good.
+	os.Remove(path.Join(c.StackerDir, "auth.json"))
+
+	username, password, err := registryCredentials(c, host)
+	if err != nil {
+		return "", err
+	}
+
+	if username == "" {
+		return "", nil
+	}
+
+	auths := map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))),
+			},
+		},
+	}
+
+	content, err := json.Marshal(auths)
+	if err != nil {
+		return "", err
+	}
+
+	// TempFile creates the file 0600.
+	f, err := ioutil.TempFile("", "stacker-auth-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(content); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -26,7 +26,7 @@ func GetBaseLayer(o BaseLayerOpts) error {
 	case TarType:
 		return getTar(o)
 	case OCIType:
-		return fmt.Errorf("not implemented")
+		return getOCI(o)
 	case DockerType:
 		return getDocker(o)
 	case ScratchType:
@@ -37,19 +37,47 @@ func GetBaseLayer(o BaseLayerOpts) error {
 }
 
 func getDocker(o BaseLayerOpts) error {
-	tag, err := o.Layer.From.ParseTag()
+	tag, err := fetchDockerBase(o.Config, o.Layer.From)
 	if err != nil {
 		return err
 	}
 
+	cacheDir := path.Join(o.Config.StackerDir, "layer-bases", tag)
+
+	// We just copied it to the cache, now let's copy that over to our image.
+	cmd := exec.Command(
+		"skopeo",
+		"--insecure-policy",
+		"copy",
+		fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+		fmt.Sprintf("oci:%s:%s", o.Config.OCIDir, tag),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("skopeo copy from cache to ocidir: %s: %s", err, string(output))
+	}
+
+	return unpackBase(o, tag)
+}
+
+// fetchDockerBase copies the docker base image src into the layer-bases
+// cache, returning its tag there.
+func fetchDockerBase(c StackerConfig, src *ImageSource) (string, error) {
+	tag, err := src.ParseTag()
+	if err != nil {
+		return "", err
+	}
+
 	// Note that we can do tihs over the top of the cache every time, since
 	// skopeo should be smart enough to only copy layers that have changed.
 	// Perhaps we want to do an `umoci gc` at some point, but for now we
 	// don't bother.
-	cacheDir := path.Join(o.Config.StackerDir, "layer-bases", tag)
+	cacheDir := path.Join(c.StackerDir, "layer-bases", tag)
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return err
+		return "", err
 	}
+	touchCacheEntry(cacheDir)
 
 	skopeoArgs := []string{
 		// So we don't have to make everyone install an
@@ -59,45 +87,77 @@ func getDocker(o BaseLayerOpts) error {
 		"copy",
 	}
 
-	if o.Layer.From.Insecure {
-		skopeoArgs = append(skopeoArgs, "--src-tls-verify=false")
+	if c.Arch != "" {
+		skopeoArgs = append([]string{"--override-arch", c.Arch}, skopeoArgs...)
+	}
+
+	registryArgs, cleanup, err := skopeoRegistryArgs(c, src, "src-")
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	skopeoArgs = append(skopeoArgs, registryArgs...)
+
+	url := src.Url
+	if c.Lock != nil {
+		url, err = c.Lock.ResolveBase(c, src)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	skopeoArgs = append(skopeoArgs, o.Layer.From.Url, fmt.Sprintf("oci:%s:%s", cacheDir, tag))
+	skopeoArgs = append(skopeoArgs, url, fmt.Sprintf("oci:%s:%s", cacheDir, tag))
 
 	cmd := exec.Command("skopeo", skopeoArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("skopeo copy: %s", err)
+		return "", fmt.Errorf("skopeo copy: %s", err)
 	}
 
-	// We just copied it to the cache, now let's copy that over to our image.
-	cmd = exec.Command(
-		"skopeo",
-		"--insecure-policy",
-		"copy",
-		fmt.Sprintf("oci:%s:%s", cacheDir, tag),
-		fmt.Sprintf("oci:%s:%s", o.Config.OCIDir, tag),
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("skopeo copy from cache to ocidir: %s: %s", err, string(output))
-	}
+	return tag, nil
+}
 
+// unpackBase unpacks the base image that was copied into the OCI layout as
+// tag into the target.
+func unpackBase(o BaseLayerOpts, tag string) error {
 	target := path.Join(o.Config.RootFSDir, o.Target)
-	fmt.Println("unpacking to", target)
 
 	image := fmt.Sprintf("%s:%s", o.Config.OCIDir, tag)
 	args := []string{"umoci", "unpack", "--image", image, target}
-	err = MaybeRunInUserns(args, "image unpack failed")
+	return RunWithProgress(fmt.Sprintf("unpacking to %s", target), func() error {
+		return MaybeRunInUserns(args, "image unpack failed")
+	})
+}
+
+func getOCI(o BaseLayerOpts) error {
+	layout, tag, err := o.Layer.From.ParseOCI()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	localTag, err := o.Layer.From.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	// skopeo only copies the blobs that aren't already present, so this
+	// is cheap for layouts that share most of their layers.
+	cmd := exec.Command(
+		"skopeo",
+		"--insecure-policy",
+		"copy",
+		fmt.Sprintf("oci:%s:%s", layout, tag),
+		fmt.Sprintf("oci:%s:%s", o.Config.OCIDir, localTag),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("skopeo copy from %s: %s: %s", layout, err, string(output))
+	}
+
+	return unpackBase(o, localTag)
 }
 
 func umociInit(o BaseLayerOpts) error {
@@ -119,7 +179,7 @@ func umociInit(o BaseLayerOpts) error {
 		"unpack",
 		"--image",
 		fmt.Sprintf("%s:%s", o.Config.OCIDir, o.Name),
-		path.Join(o.Config.RootFSDir, ".working"))
+		path.Join(o.Config.RootFSDir, o.Target))
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("umoci empty unpack failed: %s: %s", err, string(output))
@@ -134,12 +194,7 @@ func umociInit(o BaseLayerOpts) error {
 }
 
 func getTar(o BaseLayerOpts) error {
-	cacheDir := path.Join(o.Config.StackerDir, "layer-bases")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return err
-	}
-
-	tar, err := acquireUrl(o.Config, o.Layer.From.Url, cacheDir)
+	tar, err := fetchTarBase(o.Config, o.Layer.From)
 	if err != nil {
 		return err
 	}
@@ -159,6 +214,23 @@ func getTar(o BaseLayerOpts) error {
 	return nil
 }
 
+// fetchTarBase acquires the tar base image src into the layer-bases cache,
+// returning its path there.
+func fetchTarBase(c StackerConfig, src *ImageSource) (string, error) {
+	cacheDir := path.Join(c.StackerDir, "layer-bases")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	tar, err := acquireUrl(c, src.Url, cacheDir, DefaultSymlinks)
+	if err != nil {
+		return "", err
+	}
+	touchCacheEntry(tar)
+
+	return tar, nil
+}
+
 func getScratch(o BaseLayerOpts) error {
 	return umociInit(o)
 }
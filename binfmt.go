@@ -0,0 +1,179 @@
+package stacker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+const binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// binfmtArch is how to recognize binaries of an architecture, in the form
+// binfmt_misc wants; these are the same as qemu's qemu-binfmt-conf.sh.
+type binfmtArch struct {
+	// qemu is qemu's name for the architecture.
+	qemu  string
+	magic string
+	mask  string
+}
+
+// binfmtArches are the architectures (by their GOARCH names) that can be
+// emulated.
+var binfmtArches = map[string]binfmtArch{
+	"amd64": {
+		qemu:  "x86_64",
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"arm64": {
+		qemu:  "aarch64",
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"arm": {
+		qemu:  "arm",
+		magic: `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"ppc64le": {
+		qemu:  "ppc64le",
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\xfc\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00`,
+	},
+	"riscv64": {
+		qemu:  "riscv64",
+		magic: `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"s390x": {
+		qemu:  "s390x",
+		magic: `\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`,
+		mask:  `\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`,
+	},
+}
+
+// BinfmtArches returns the architectures that InstallBinfmt knows about.
+func BinfmtArches() []string {
+	arches := []string{}
+	for arch := range binfmtArches {
+		arches = append(arches, arch)
+	}
+	sort.Strings(arches)
+	return arches
+}
+
+// IsForeignArch returns true if arch (a GOARCH name; "" meaning the host's)
+// needs emulating to run on this host.
+func IsForeignArch(arch string) bool {
+	return arch != "" && arch != runtime.GOARCH
+}
+
+// InstallBinfmt registers the qemu-<arch>-static binaries in interpreterDir
+// with binfmt_misc for each of arches that isn't the host's, so that their
+// binaries run under qemu. The handlers are registered with the F flag, so the
+// kernel holds the interpreter open and it needn't exist in containers.
+// Already registered arches are left as they are.
+func InstallBinfmt(arches []string, interpreterDir string) error {
+	if _, err := os.Stat(path.Join(binfmtMiscDir, "register")); err != nil {
+		output, err := exec.Command("mount", "-t", "binfmt_misc", "binfmt_misc", binfmtMiscDir).CombinedOutput()
+		if err != nil {
+			return WithKind(EnvironmentError, fmt.Errorf("couldn't mount binfmt_misc: %s: %s", err, string(output)))
+		}
+	}
+
+	for _, arch := range arches {
+		if !IsForeignArch(arch) {
+			continue
+		}
+
+		b, ok := binfmtArches[arch]
+		if !ok {
+			return WithKind(UserError, fmt.Errorf("can't emulate arch %s; known arches are %s", arch, strings.Join(BinfmtArches(), ", ")))
+		}
+
+		name := fmt.Sprintf("qemu-%s", b.qemu)
+		if _, err := os.Stat(path.Join(binfmtMiscDir, name)); err == nil {
+			log.Infof("%s is already registered", name)
+			continue
+		}
+
+		interpreter := path.Join(interpreterDir, fmt.Sprintf("qemu-%s-static", b.qemu))
+		if _, err := os.Stat(interpreter); err != nil {
+			return WithKind(EnvironmentError, errors.Wrapf(err, "no interpreter for %s (is qemu-user-static installed?)", arch))
+		}
+
+		registration := fmt.Sprintf(":%s:M::%s:%s:%s:F", name, b.magic, b.mask, interpreter)
+		err := ioutil.WriteFile(path.Join(binfmtMiscDir, "register"), []byte(registration), 0200)
+		if err != nil {
+			return WithKind(EnvironmentError, errors.Wrapf(err, "couldn't register %s", name))
+		}
+
+		log.Infof("registered %s for %s", interpreter, arch)
+	}
+
+	return nil
+}
+
+// binfmtInterpreter returns the path of the interpreter registered for arch.
+func binfmtInterpreter(arch string) (string, error) {
+	b, ok := binfmtArches[arch]
+	if !ok {
+		return "", WithKind(UserError, fmt.Errorf("can't emulate arch %s; known arches are %s", arch, strings.Join(BinfmtArches(), ", ")))
+	}
+
+	f, err := os.Open(path.Join(binfmtMiscDir, fmt.Sprintf("qemu-%s", b.qemu)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", WithKind(EnvironmentError, fmt.Errorf("no binfmt handler for %s is registered; try stacker binfmt install", arch))
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "interpreter" {
+			return fields[1], nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no interpreter in the binfmt handler for %s", arch)
+}
+
+// mountEmulator makes the interpreter for arch available in the container at
+// the path binfmt_misc expects it at, for handlers that weren't registered
+// with the F flag. The returned function removes the mount point, if it had
+// to be created.
+func mountEmulator(c runContainer, rootfs string, arch string) (func(), error) {
+	interpreter, err := binfmtInterpreter(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanup := func() {}
+	if _, err := os.Lstat(path.Join(rootfs, interpreter)); os.IsNotExist(err) {
+		cleanup = func() {
+			os.Remove(path.Join(rootfs, interpreter))
+		}
+	}
+
+	if err := c.bindMount(interpreter, interpreter); err != nil {
+		return nil, err
+	}
+
+	return cleanup, nil
+}
@@ -0,0 +1,62 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// validateBuildCacheDirs checks that a layer's build_cache_dirs are absolute
+// paths.
+func validateBuildCacheDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if !path.IsAbs(dir) || path.Clean(dir) == "/" {
+			return fmt.Errorf("invalid build_cache_dir %q, it must be an absolute path below /", dir)
+		}
+	}
+
+	return nil
+}
+
+// mountBuildCacheDirs bind mounts the stacker dir's persistent copy of each of
+// dirs over it in the container for the rootfs, so that what the run section
+// caches there (downloaded packages and the like) survives to the next build,
+// but isn't part of the layer. The returned function removes any mount points
+// that had to be created, and should be called once the run section is done.
+func mountBuildCacheDirs(sc StackerConfig, c runContainer, rootfs string, dirs []string) (func(), error) {
+	created := []string{}
+	cleanup := func() {
+		// Innermost first, and only if nothing else was put in them.
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+	}
+
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+
+		source := path.Join(sc.StackerDir, "build-cache", dir)
+		if err := os.MkdirAll(source, 0755); err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		// Remember which of the mount point and its parents the
+		// runtime will create, so they don't end up in the layer.
+		missing := []string{}
+		for p := dir; p != "/"; p = path.Dir(p) {
+			if _, err := os.Lstat(path.Join(rootfs, p)); err == nil {
+				break
+			}
+			missing = append([]string{path.Join(rootfs, p)}, missing...)
+		}
+		created = append(created, missing...)
+
+		if err := c.bindMount(source, dir); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	return cleanup, nil
+}
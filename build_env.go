@@ -0,0 +1,59 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+var envNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateBuildEnv checks that a layer's build_env and build_env_passthrough
+// names are valid environment variable names.
+func validateBuildEnv(env map[string]string, passthrough []string) error {
+	for name := range env {
+		if !envNameRE.MatchString(name) {
+			return fmt.Errorf("invalid build_env variable %q", name)
+		}
+	}
+
+	for _, name := range passthrough {
+		if !envNameRE.MatchString(name) {
+			return fmt.Errorf("invalid build_env_passthrough variable %q", name)
+		}
+	}
+
+	return nil
+}
+
+// buildEnv returns the KEY=value pairs that the layer's run section gets in
+// its environment, on top of the ones every container gets (see
+// passthroughEnv): the host's values of the build_env_passthrough variables
+// that are set, and build_env, which takes precedence. These are never part
+// of the image config.
+func (l *Layer) buildEnv() []string {
+	values := map[string]string{}
+	for _, name := range l.BuildEnvPassthrough {
+		if v, ok := os.LookupEnv(name); ok {
+			values[name] = v
+		}
+	}
+
+	for k, v := range l.BuildEnv {
+		values[k] = v
+	}
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := []string{}
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("%s=%s", name, values[name]))
+	}
+
+	return env
+}
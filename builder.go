@@ -0,0 +1,1057 @@
+package stacker
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// BuildOpts are the options for a single Builder.Build.
+type BuildOpts struct {
+	// StackerFiles are the stackerfiles to build; the default is
+	// stacker.yaml.
+	StackerFiles  []string
+	Substitutions []string
+	Template      bool
+
+	// BuildContext is the directory relative imports are resolved
+	// against; see ParseOpts.BuildContext.
+	BuildContext string
+
+	// ImportsRelativeToStackerfile is passed to the parser; see
+	// ParseOpts.
+	ImportsRelativeToStackerfile bool
+
+	// NoCache removes the stacker dir, and so the build cache, before
+	// building.
+	NoCache bool
+
+	// LeaveUnladen leaves the storage attached after the build.
+	LeaveUnladen bool
+
+	// SSHAuthSock, if set, is the host's ssh agent socket, which is made
+	// available to run sections.
+	SSHAuthSock string
+
+	// CheckBaseUpdates re-resolves the digests of docker bases, even if
+	// they are locked, so that layers on bases that have changed are
+	// rebuilt.
+	CheckBaseUpdates bool
+
+	// NoAtomic builds directly in the OCI layout, rather than in a staging
+	// copy of it that only replaces it if the whole build succeeds.
+	NoAtomic bool
+
+	// Resume carries on from the staging layout of the last build, if it
+	// didn't finish, so that the layers it built are cache hits.
+	Resume bool
+
+	// Lockfile is the path of the lockfile; the default is stacker.lock
+	// next to the first stackerfile (or in the build context, if that came
+	// from stdin or a url). If Update is true, the locked digests are
+	// re-resolved.
+	Lockfile string
+	Update   bool
+
+	// Timestamp, if not zero, is used as the creation time of the images,
+	// and the mtimes of newer files are clamped to it.
+	Timestamp time.Time
+
+	// Compression is the compression of the generated layers; the default
+	// is gzip. A CompressionLevel of 0 is the compression's default.
+	Compression      Compression
+	CompressionLevel int
+
+	// Signer, if not nil, signs every built image.
+	Signer crypto.Signer
+
+	// SBOMFormat, if not empty, attaches an SBOM in this format to every
+	// built image, also writing it to SBOMDir if that is set.
+	SBOMFormat SBOMFormat
+	SBOMDir    string
+
+	// PackageManifest attaches the list of packages installed (by dpkg,
+	// rpm or apk) to every built image, also writing it to
+	// PackageManifestDir if that is set.
+	PackageManifest    bool
+	PackageManifestDir string
+
+	// Scan, if its Scanner is set, scans every built image for
+	// vulnerabilities, attaching the report to it.
+	Scan ScanOpts
+
+	// SizeWarn makes layers that are over their max_size a warning rather
+	// than an error.
+	SizeWarn bool
+
+	// LargeFileSize, if positive, warns about files at least this big in
+	// the generated layers, and about package manager caches and core
+	// dumps in them.
+	LargeFileSize int64
+
+	// Provenance attaches a provenance attestation to every built image,
+	// recording Version as the version of stacker.
+	Provenance bool
+	Version    string
+
+	PrebuildHooks  []string
+	PostbuildHooks []string
+
+	// OnRunFailure is a command to run in the container if a run section
+	// fails.
+	OnRunFailure string
+
+	// Interactive attaches the terminal on stdin to the OnRunFailure
+	// command (or a shell, if there is none), so that the failed container
+	// can be inspected before the build exits.
+	Interactive bool
+
+	// Progress, if not nil, is called for each phase transition of the
+	// build.
+	Progress func(BuildEvent)
+
+	// Tracer, if not nil, records the build's layers and their phases as
+	// spans.
+	Tracer *Tracer
+}
+
+func (opts BuildOpts) emit(ev BuildEvent) {
+	if opts.Progress == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	opts.Progress(ev)
+}
+
+// Builder builds the layers of stackerfiles into OCI images, the way
+// `stacker build` does.
+type Builder struct {
+	config StackerConfig
+}
+
+func NewBuilder(config StackerConfig) *Builder {
+	return &Builder{config: config}
+}
+
+// interrupted returns an InterruptedError if ctx has been cancelled, so that
+// the build stops (and cleans up after itself) between phases.
+func interrupted(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return WithKind(InterruptedError, fmt.Errorf("build interrupted"))
+	}
+
+	return nil
+}
+
+// imageSize is the total size of the (compressed) layers of the image tagged
+// name, or 0 if it can't be found.
+func imageSize(oci *umoci.Layout, name string) int64 {
+	manifest, err := oci.LookupManifest(name)
+	if err != nil {
+		return 0
+	}
+
+	size := int64(0)
+	for _, l := range manifest.Layers {
+		size += l.Size
+	}
+
+	return size
+}
+
+// clearInheritedConfig clears the parts of the config inherited from the
+// layer's base that it asks to start over with: its labels, environment
+// and volumes.
+func (l *Layer) clearInheritedConfig(config *ispec.ImageConfig) {
+	if l.InheritLabels != nil && !*l.InheritLabels {
+		config.Labels = map[string]string{}
+	}
+
+	if l.ClearEnv {
+		config.Env = nil
+	}
+
+	if l.ClearVolumes {
+		config.Volumes = map[string]struct{}{}
+	}
+}
+
+func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
+	newName := strings.Replace(newPath.Digest.String(), ":", "_", 1) + ".mtree"
+
+	infos, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), ".mtree") {
+			continue
+		}
+
+		return os.Rename(path.Join(rootPath, fi.Name()), path.Join(rootPath, newName))
+	}
+
+	return nil
+}
+
+func runPostbuildHooks(sc StackerConfig, opts BuildOpts, l *Layer, hooks []string, info HookInfo) error {
+	SetLogContext(info.Layer, "hooks")
+	info.Hook = "postbuild"
+	if err := RunHooks(sc, opts.PostbuildHooks, "", info); err != nil {
+		return err
+	}
+
+	return RunHooks(sc, hooks, l.contextDir, info)
+}
+
+// Build builds all the layers in the stackerfiles of opts. It stops before
+// the next layer if ctx is cancelled.
+func (b *Builder) Build(ctx context.Context, opts BuildOpts) (err error) {
+	sc := b.config
+
+	// The layer currently being built, for the failure event.
+	current := ""
+	trace := newBuildTrace(opts.Tracer)
+	defer func() {
+		trace.end(err)
+		if err != nil {
+			opts.emit(BuildEvent{Event: EventBuildFailed, Layer: current, Error: err.Error()})
+		} else {
+			opts.emit(BuildEvent{Event: EventBuildDone})
+		}
+		SetLogContext("", "")
+	}()
+
+	buildStart := time.Now()
+
+	if opts.Interactive && !isTerminal(os.Stdin) {
+		return WithKind(UserError, fmt.Errorf("interactive run failure handling requires a terminal on stdin"))
+	}
+
+	if opts.NoCache {
+		if opts.Resume {
+			return WithKind(UserError, fmt.Errorf("can't resume a build without its cache"))
+		}
+
+		if err := DiscardUnfinishedBuild(sc); err != nil {
+			return err
+		}
+		os.RemoveAll(sc.StackerDir)
+	}
+
+	if opts.SSHAuthSock != "" {
+		if _, err := os.Stat(opts.SSHAuthSock); err != nil {
+			return WithKind(UserError, errors.Wrapf(err, "bad ssh agent socket"))
+		}
+		sc.SSHAuthSock = opts.SSHAuthSock
+	}
+
+	files := opts.StackerFiles
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	if opts.Compression == "" {
+		opts.Compression = GzipCompression
+	}
+
+	parseOpts := ParseOpts{
+		Substitutions: opts.Substitutions,
+		Template:      opts.Template,
+		BuildContext:  opts.BuildContext,
+		Config:        sc,
+
+		ImportsRelativeToStackerfile: opts.ImportsRelativeToStackerfile,
+	}
+
+	sf, err := NewStackerfiles(files, parseOpts)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewStorage(sc)
+	if err != nil {
+		return err
+	}
+	if !opts.LeaveUnladen {
+		defer s.Detach()
+	}
+
+	if err := sf.Validate(); err != nil {
+		return err
+	}
+
+	sc.Lock, err = OpenLockfile(opts.lockfile(files), opts.Update)
+	if err != nil {
+		return err
+	}
+
+	order, err := sf.DependencyOrder()
+	if err != nil {
+		return err
+	}
+
+	// Build in a staging copy of the layout, so that a failure part of the
+	// way through doesn't leave it with a mix of old and new tags. If the
+	// build doesn't finish, the staging layout is kept for Resume.
+	ociDir := sc.OCIDir
+	var progress *buildProgress
+	if !opts.NoAtomic {
+		progress, err = stageBuild(sc, opts.Resume)
+		if err != nil {
+			return err
+		}
+		sc.OCIDir = progress.Staging
+
+		defer func() {
+			if err != nil {
+				log.Infof("the layers built so far are kept; use --resume to carry on from them")
+			}
+		}()
+	}
+
+	var oci *umoci.Layout
+	if _, statErr := os.Stat(sc.OCIDir); statErr != nil {
+		oci, err = umoci.CreateLayout(sc.OCIDir)
+	} else {
+		oci, err = umoci.OpenLayout(sc.OCIDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	buildCache, err := OpenCache(sc.StackerDir, oci)
+	if err != nil {
+		return err
+	}
+	buildCache.arch = sc.Arch
+
+	// The layers that were (re-)built during this build, i.e. weren't
+	// cache hits; anything that depends on them must be rebuilt too.
+	rebuilt := map[string]bool{}
+
+	// The bases that --check-base-updates has re-resolved already.
+	refreshed := map[string]bool{}
+
+	// The files that have been imported so far, so that layers importing
+	// the same thing share one copy of it.
+	imported := map[string]sharedImport{}
+
+	// Layers may override the user namespace mapping; put back the
+	// process wide one when we're done.
+	defaultIdmap := IdmapSet
+	defer func() {
+		IdmapSet = defaultIdmap
+	}()
+
+	defer s.Delete(".working")
+	for _, name := range order {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+
+		l := sf[name]
+		current = name
+
+		layerConfig, platform, err := l.config(sc)
+		if err != nil {
+			return err
+		}
+
+		SetLogContext(name, "import")
+		log.Infof("building image %s...", name)
+		trace.startLayer(name)
+		trace.startPhase("import")
+
+		// We need to run the imports first since we now compare
+		// against imports for caching layers. Since we don't do
+		// network copies if the files are present and local trees are
+		// reflinked where possible, hopefully this isn't too expensive.
+		log.Infof("importing files...")
+		opts.emit(BuildEvent{Event: EventImportStart, Layer: name})
+		if err := l.RunImportCmd(name); err != nil {
+			return err
+		}
+
+		imports, err := l.ParseImports()
+		if err != nil {
+			return err
+		}
+
+		if err := importShared(sc, name, imports, imported, nil); err != nil {
+			return err
+		}
+		opts.emit(BuildEvent{Event: EventImportDone, Layer: name})
+
+		SetLogContext(name, "cache")
+		refresh := opts.CheckBaseUpdates && !refreshed[baseLockKey(layerConfig, l.From)]
+		if err := resolveBaseDigest(layerConfig, l, true, refresh); err != nil {
+			return err
+		}
+		refreshed[baseLockKey(layerConfig, l.From)] = true
+
+		importDir := path.Join(sc.StackerDir, "imports", name)
+		touchCacheEntry(importDir)
+		cachedDesc, ok := buildCache.Lookup(l, importDir)
+		for _, dep := range l.Dependencies() {
+			if rebuilt[dep] {
+				ok = false
+			}
+		}
+
+		// Build only layers have no image, just their snapshot, which
+		// had better still be there, and be the one for this entry.
+		if ok && l.BuildOnly {
+			if buildCache.HasSnapshot(sc.RootFSDir, name, l) {
+				log.Infof("found cached build only layer %s", name)
+				opts.emit(BuildEvent{Event: EventCacheHit, Layer: name})
+				trace.endLayer(true)
+				if err := progress.finished(sc, name); err != nil {
+					return err
+				}
+				continue
+			}
+			ok = false
+		}
+
+		if ok {
+			log.Infof("found cached layer %s", name)
+			err = oci.UpdateReference(name, cachedDesc)
+			if err != nil {
+				return err
+			}
+
+			opts.emit(BuildEvent{Event: EventCacheHit, Layer: name, Digest: cachedDesc.Digest.String(), Size: imageSize(oci, name)})
+			trace.endLayer(true)
+			if err := progress.finished(sc, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rebuilt[name] = true
+
+		SetLogContext(name, "hooks")
+		prebuild, postbuild, err := l.ParseHooks()
+		if err != nil {
+			return err
+		}
+
+		// Global hooks run from where stacker was invoked, the layer's
+		// own hooks from its stackerfile's directory.
+		hookInfo := HookInfo{Hook: "prebuild", Layer: name, Tag: name}
+		if err := RunHooks(sc, opts.PrebuildHooks, "", hookInfo); err != nil {
+			return err
+		}
+
+		if err := RunHooks(sc, prebuild, l.contextDir, hookInfo); err != nil {
+			return err
+		}
+
+		IdmapSet = defaultIdmap
+		if len(l.UIDMap) > 0 {
+			IdmapSet, err = NewIdmapSet(l.UIDMap, l.GIDMap)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+
+		SetLogContext(name, "base")
+		trace.startPhase("base")
+		s.Delete(".working")
+		if l.From.Type == BuiltType {
+			if err := s.Restore(l.From.Tag, ".working"); err != nil {
+				return err
+			}
+		} else {
+			if err := s.Create(".working"); err != nil {
+				return err
+			}
+
+			baseOpts := BaseLayerOpts{
+				Config: layerConfig,
+				Name:   name,
+				Target: ".working",
+				Layer:  l,
+				Cache:  buildCache,
+				OCI:    oci,
+			}
+
+			err := GetBaseLayer(baseOpts)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Anything in the rootfs that changes from here on will have a
+		// newer ctime, so that's all the repack needs to re-hash (it
+		// still walks the whole rootfs to find them).
+		touchedSince := time.Now()
+
+		SetLogContext(name, "run")
+		trace.startPhase("run")
+		log.Infof("running commands...")
+		opts.emit(BuildEvent{Event: EventRunStart, Layer: name})
+		if err := Run(ctx, layerConfig, name, l, opts.OnRunFailure, opts.Interactive); err != nil {
+			return err
+		}
+		opts.emit(BuildEvent{Event: EventRunDone, Layer: name})
+
+		// This is a build only layer, meaning we don't need to include
+		// it in the final image, as outputs from it are going to be
+		// imported into future images. Let's just snapshot it and add
+		// a bogus entry to our cache.
+		if l.BuildOnly {
+			if err := buildCache.ForgetSnapshot(name); err != nil {
+				return err
+			}
+			s.Delete(name)
+			if err := s.Snapshot(".working", name); err != nil {
+				return err
+			}
+
+			if err := buildCache.PutSnapshot(name, l); err != nil {
+				return err
+			}
+
+			log.Infof("build only layer, skipping OCI diff generation")
+			if err := buildCache.Put(name, l, importDir, ispec.Descriptor{}); err != nil {
+				return err
+			}
+
+			opts.emit(BuildEvent{Event: EventLayerDone, Layer: name})
+			trace.endLayer(false)
+
+			if err := runPostbuildHooks(sc, opts, l, postbuild, HookInfo{Layer: name, Tag: name}); err != nil {
+				return err
+			}
+
+			if err := progress.finished(sc, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+
+		SetLogContext(name, "generate")
+		trace.startPhase("repack")
+		if !opts.Timestamp.IsZero() {
+			err = ClampMtimes(path.Join(sc.RootFSDir, ".working", "rootfs"), opts.Timestamp)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = RunWithProgress("generating layer", func() error {
+			return RepackLayer(sc, name, opts.Timestamp, touchedSince)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "layer generation failed")
+		}
+		opts.emit(BuildEvent{Event: EventRepackDone, Layer: name})
+
+		if opts.LargeFileSize > 0 {
+			warnings, err := layerWarnings(sc.OCIDir, oci, name, opts.LargeFileSize)
+			if err != nil {
+				return err
+			}
+
+			for _, w := range warnings {
+				log.Warnf("%s's layer: %s", name, w)
+			}
+		}
+
+		trace.startPhase("commit")
+
+		mutator, err := oci.Mutator(name)
+		if err != nil {
+			return errors.Wrapf(err, "mutator failed")
+		}
+
+		imageConfig, err := mutator.Config(ctx)
+		if err != nil {
+			return err
+		}
+
+		l.clearInheritedConfig(&imageConfig)
+
+		pathSet := false
+		for k, v := range l.Environment {
+			if k == "PATH" {
+				pathSet = true
+			}
+			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+
+		if !pathSet {
+			for _, s := range imageConfig.Env {
+				if strings.HasPrefix(s, "PATH=") {
+					pathSet = true
+					break
+				}
+			}
+		}
+
+		// if the user didn't specify a path, let's set a sane one
+		if !pathSet {
+			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("PATH=%s", ReasonableDefaultPath))
+		}
+
+		if l.Cmd != nil {
+			imageConfig.Cmd, err = l.ParseCmd()
+			if err != nil {
+				return err
+			}
+		}
+
+		if l.Entrypoint != nil {
+			imageConfig.Entrypoint, err = l.ParseEntrypoint()
+			if err != nil {
+				return err
+			}
+
+			// As in docker, a shell form entrypoint ignores cmd,
+			// so don't inherit one that would look like it's used.
+			if l.isShellForm(l.Entrypoint) {
+				imageConfig.Cmd = nil
+			}
+		}
+
+		if l.FullCommand != nil {
+			imageConfig.Cmd = nil
+			imageConfig.Entrypoint, err = l.ParseFullCommand()
+			if err != nil {
+				return err
+			}
+		}
+
+		if imageConfig.Volumes == nil {
+			imageConfig.Volumes = map[string]struct{}{}
+		}
+
+		for _, v := range l.Volumes {
+			imageConfig.Volumes[v] = struct{}{}
+		}
+
+		if imageConfig.Labels == nil {
+			imageConfig.Labels = map[string]string{}
+		}
+
+		for k, v := range l.Labels {
+			imageConfig.Labels[k] = v
+		}
+
+		runLabels, runAnnotations, err := RunArtifacts(sc, name)
+		if err != nil {
+			return err
+		}
+
+		for k, v := range runLabels {
+			imageConfig.Labels[k] = v
+		}
+
+		if l.WorkingDir != "" {
+			imageConfig.WorkingDir = l.WorkingDir
+		}
+
+		if l.User != "" {
+			imageConfig.User = l.User
+		}
+
+		if l.StopSignal != "" {
+			imageConfig.StopSignal = l.StopSignal
+		}
+
+		meta, err := mutator.Meta(ctx)
+		if err != nil {
+			return err
+		}
+
+		meta.Created = time.Now()
+		if !opts.Timestamp.IsZero() {
+			meta.Created = opts.Timestamp
+		}
+		meta.Architecture = platform.Architecture
+		meta.OS = platform.OS
+
+		annotations, err := mutator.Annotations(ctx)
+		if err != nil {
+			return err
+		}
+
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		for k, v := range l.Annotations {
+			annotations[k] = v
+		}
+
+		for k, v := range runAnnotations {
+			annotations[k] = v
+		}
+
+		history := ispec.History{
+			EmptyLayer: true, // this is only the history for imageConfig edit
+			Created:    &meta.Created,
+			CreatedBy:  "stacker build",
+		}
+
+		err = mutator.Set(ctx, imageConfig, meta, annotations, history)
+		if err != nil {
+			return err
+		}
+
+		newPath, err := mutator.Commit(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = oci.UpdateReference(name, newPath.Root())
+		if err != nil {
+			return err
+		}
+
+		if platform.Variant != "" {
+			desc, err := SetVariant(sc.OCIDir, oci, name, platform.Variant)
+			if err != nil {
+				return err
+			}
+
+			newPath = casext.DescriptorPath{Walk: []ispec.Descriptor{desc}}
+		}
+
+		hc, err := l.ParseHealthcheck()
+		if err != nil {
+			return err
+		}
+
+		if hc != nil {
+			desc, err := SetHealthcheck(sc.OCIDir, oci, name, hc)
+			if err != nil {
+				return err
+			}
+
+			newPath = casext.DescriptorPath{Walk: []ispec.Descriptor{desc}}
+		}
+
+		layerTypes, err := l.ParseLayerType()
+		if err != nil {
+			return err
+		}
+
+		// umoci always generates gzip layers, so if the user wants
+		// something else, we need to rewrite the one we just made.
+		if opts.Compression != GzipCompression || opts.CompressionLevel != 0 {
+			desc, err := RecompressLayers(sc.OCIDir, oci, name, opts.Compression, opts.CompressionLevel, false)
+			if err != nil {
+				return err
+			}
+
+			newPath = casext.DescriptorPath{Walk: []ispec.Descriptor{desc}}
+		}
+
+		maxSize, err := l.ParseMaxSize()
+		if err != nil {
+			return err
+		}
+
+		if maxSize > 0 {
+			if err := checkLayerSize(sc.OCIDir, oci, name, maxSize); err != nil {
+				if !opts.SizeWarn {
+					return err
+				}
+				log.Warnf("%v", err)
+			}
+		}
+
+		if len(layerTypes) == 1 && layerTypes[0] == SquashfsLayer {
+			desc, err := ConvertToSquashfs(sc.OCIDir, oci, name, name, opts.Compression, opts.CompressionLevel)
+			if err != nil {
+				return err
+			}
+
+			newPath = casext.DescriptorPath{Walk: []ispec.Descriptor{desc}}
+		} else if len(layerTypes) > 1 {
+			_, err := ConvertToSquashfs(sc.OCIDir, oci, name, fmt.Sprintf("%s-squashfs", name), opts.Compression, opts.CompressionLevel)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Now, we need to set the umoci data on the fs to tell it that
+		// it has a layer that corresponds to this fs.
+		bundlePath := path.Join(sc.RootFSDir, ".working")
+		err = updateBundleMtree(bundlePath, newPath.Descriptor())
+		if err != nil {
+			return err
+		}
+
+		umociMeta := umoci.UmociMeta{Version: umoci.UmociMetaVersion, From: newPath}
+		err = umoci.WriteBundleMeta(bundlePath, umociMeta)
+		if err != nil {
+			return err
+		}
+
+		// Delete the old snapshot if it existed; we just did a new build.
+		if err := buildCache.ForgetSnapshot(name); err != nil {
+			return err
+		}
+		s.Delete(name)
+		if err := s.Snapshot(".working", name); err != nil {
+			return err
+		}
+
+		if err := buildCache.PutSnapshot(name, l); err != nil {
+			return err
+		}
+
+		log.Infof("filesystem %s built successfully", name)
+
+		// Scan before caching the layer, so that one that fails
+		// --scan-fail-on isn't a cache hit next time.
+		if opts.Scan.Scanner != "" {
+			SetLogContext(name, "scan")
+			log.Infof("scanning for vulnerabilities...")
+			rootfs := path.Join(sc.RootFSDir, name, "rootfs")
+			if err := ScanImage(sc, oci, name, rootfs, opts.Scan); err != nil {
+				return err
+			}
+		}
+
+		desc, err := oci.LookupManifestDescriptor(name)
+		if err != nil {
+			return err
+		}
+
+		if err := buildCache.Put(name, l, importDir, desc); err != nil {
+			return err
+		}
+
+		opts.emit(BuildEvent{Event: EventLayerDone, Layer: name, Digest: desc.Digest.String(), Size: imageSize(oci, name)})
+		trace.endLayer(false)
+
+		if opts.Provenance {
+			SetLogContext(name, "provenance")
+			log.Infof("generating provenance...")
+			provenanceOpts := ProvenanceOpts{
+				BuilderVersion: opts.Version,
+				Substitutions:  opts.Substitutions,
+				Signer:         opts.Signer,
+			}
+
+			err = GenerateProvenance(sc, oci, name, l, provenanceOpts)
+			if err != nil {
+				return err
+			}
+		}
+
+		if opts.SBOMFormat != "" {
+			SetLogContext(name, "sbom")
+			log.Infof("generating sbom...")
+			rootfs := path.Join(sc.RootFSDir, name, "rootfs")
+			err = GenerateSBOM(sc, oci, name, rootfs, opts.SBOMFormat, opts.SBOMDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if opts.PackageManifest {
+			SetLogContext(name, "packages")
+			log.Infof("listing installed packages...")
+			rootfs := path.Join(sc.RootFSDir, name, "rootfs")
+			err = GeneratePackageManifest(sc, oci, name, rootfs, opts.PackageManifestDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		hookInfo = HookInfo{Layer: name, Tag: name, Digest: desc.Digest.String()}
+		if err := runPostbuildHooks(sc, opts, l, postbuild, hookInfo); err != nil {
+			return err
+		}
+
+		if err := progress.finished(sc, name); err != nil {
+			return err
+		}
+	}
+
+	if opts.Signer != nil {
+		for _, name := range order {
+			if sf[name].BuildOnly {
+				continue
+			}
+
+			SetLogContext(name, "sign")
+			log.Infof("signing %s", name)
+			if err := SignImage(sc.OCIDir, oci, name, opts.Signer); err != nil {
+				return err
+			}
+		}
+	}
+
+	SetLogContext("", "")
+	if !opts.NoAtomic {
+		trace.startPhase("commit")
+		if err := commitLayout(sc.OCIDir, ociDir); err != nil {
+			return err
+		}
+		sc.OCIDir = ociDir
+
+		if err := progress.done(sc); err != nil {
+			return err
+		}
+	}
+
+	return EnforceCacheQuota(sc, buildStart)
+}
+
+// lockfile is the path of the lockfile for a build of files.
+func (opts BuildOpts) lockfile(files []string) string {
+	if opts.Lockfile != "" {
+		return opts.Lockfile
+	}
+
+	dir := opts.BuildContext
+	if IsLocalStackerfile(files[0]) {
+		dir = path.Dir(files[0])
+	}
+	return path.Join(dir, "stacker.lock")
+}
+
+// PlanEntry describes what a build would do with a layer.
+type PlanEntry struct {
+	Layer   string
+	Rebuild bool
+
+	// Reason is why the layer would be rebuilt.
+	Reason string
+}
+
+// Plan works out which layers a Build with opts would rebuild, and why,
+// without importing anything or touching the storage or OCI layout. Since
+// remote imports aren't re-fetched, changes to them aren't noticed.
+func (b *Builder) Plan(opts BuildOpts) ([]PlanEntry, error) {
+	sc := b.config
+
+	files := opts.StackerFiles
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	parseOpts := ParseOpts{
+		Substitutions: opts.Substitutions,
+		Template:      opts.Template,
+		BuildContext:  opts.BuildContext,
+		Config:        sc,
+
+		ImportsRelativeToStackerfile: opts.ImportsRelativeToStackerfile,
+	}
+
+	sf, err := NewStackerfiles(files, parseOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sf.Validate(); err != nil {
+		return nil, err
+	}
+
+	order, err := sf.DependencyOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	sc.Lock, err = OpenLockfile(opts.lockfile(files), false)
+	if err != nil {
+		return nil, err
+	}
+
+	var buildCache *BuildCache
+	if _, err := os.Stat(sc.OCIDir); err == nil && !opts.NoCache {
+		oci, err := umoci.OpenLayout(sc.OCIDir)
+		if err != nil {
+			return nil, err
+		}
+		defer oci.Close()
+
+		buildCache, err = OpenCache(sc.StackerDir, oci)
+		if err != nil {
+			return nil, err
+		}
+		buildCache.arch = sc.Arch
+	}
+
+	rebuilt := map[string]bool{}
+	plan := []PlanEntry{}
+	for _, name := range order {
+		l := sf[name]
+		entry := PlanEntry{Layer: name}
+
+		switch {
+		case opts.NoCache:
+			entry.Reason = "the cache is disabled"
+		case buildCache == nil:
+			entry.Reason = "there is no OCI layout yet"
+		default:
+			for _, dep := range l.Dependencies() {
+				if rebuilt[dep] {
+					entry.Reason = fmt.Sprintf("it depends on %s, which is rebuilt", dep)
+					break
+				}
+			}
+
+			if entry.Reason == "" {
+				if err := l.RunImportCmd(name); err != nil {
+					return nil, err
+				}
+
+				layerConfig, _, err := l.config(sc)
+				if err != nil {
+					return nil, err
+				}
+
+				// Only bases that are locked already are
+				// compared; resolving others needs the network.
+				if err := resolveBaseDigest(layerConfig, l, false, false); err != nil {
+					return nil, err
+				}
+
+				entry.Reason = buildCache.Explain(l, path.Join(sc.StackerDir, "imports", name))
+				if entry.Reason == "" && l.BuildOnly && !buildCache.HasSnapshot(sc.RootFSDir, name, l) {
+					entry.Reason = "its snapshot is missing, or was built from something else"
+				}
+			}
+		}
+
+		entry.Rebuild = entry.Reason != ""
+		rebuilt[name] = entry.Rebuild
+		plan = append(plan, entry)
+	}
+
+	return plan, nil
+}
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 
+	"github.com/apex/log"
 	"github.com/mitchellh/hashstructure"
 	"github.com/openSUSE/umoci"
 	"github.com/opencontainers/go-digest"
@@ -40,21 +42,66 @@ type ImportHash struct {
 }
 
 type CacheEntry struct {
-	// The manifest that this corresponds to.
+	// Name is the name of the layer.
+	Name string
+
+	// The manifest that this corresponds to; empty for build only layers,
+	// which have no image.
 	Blob ispec.Descriptor
 
 	// A map of the import url to the base64 encoded result of mtree walk
 	// or sha256 sum of a file, depending on what Type is.
 	Imports map[string]ImportHash
+
+	// BaseDigest is the digest the layer's docker base resolved to.
+	BaseDigest string
 }
 
 type BuildCache struct {
-	path    string
+	path string
+
+	// arch is the StackerConfig.Arch being built for; layers built for
+	// different arches are cached separately.
+	arch string
+
 	Cache   map[string]CacheEntry `json:"cache"`
 	Version int                   `json:"version"`
 }
 
 func OpenCache(dir string, oci *umoci.Layout) (*BuildCache, error) {
+	cache, err := readCache(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := false
+	for hash, ent := range cache.Cache {
+		// Build only layers are checked against the storage when
+		// they are looked up.
+		if ent.Blob.Digest == "" {
+			continue
+		}
+
+		_, err := oci.LookupManifestByDescriptor(ent.Blob)
+		if err != nil {
+			delete(cache.Cache, hash)
+			pruned = true
+		}
+	}
+
+	if pruned {
+		err := cache.persist()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cache, nil
+}
+
+// readCache reads the build cache in dir, without checking that its entries'
+// images are still there.
+func readCache(dir string) (*BuildCache, error) {
 	p := path.Join(dir, "build.cache")
 	f, err := os.Open(p)
 	if err != nil {
@@ -79,7 +126,7 @@ func OpenCache(dir string, oci *umoci.Layout) (*BuildCache, error) {
 	}
 
 	if cache.Version != currentCacheVersion {
-		fmt.Println("old cache version found, clearing cache and rebuilding from scratch...")
+		log.Infof("old cache version found, clearing cache and rebuilding from scratch...")
 		os.Remove(p)
 		return &BuildCache{
 			path:    p,
@@ -88,23 +135,35 @@ func OpenCache(dir string, oci *umoci.Layout) (*BuildCache, error) {
 		}, nil
 	}
 
-	pruned := false
+	return cache, nil
+}
+
+// ReplaceCachedManifest points the build cache entries in dir that refer to
+// the manifest old at new instead, e.g. after the image was rewritten by
+// recompressing it. Otherwise, the next build would find the layer in the
+// cache and tag the old manifest again.
+func ReplaceCachedManifest(dir string, old ispec.Descriptor, new ispec.Descriptor) error {
+	cache, err := readCache(dir)
+	if err != nil {
+		return err
+	}
+
+	changed := false
 	for hash, ent := range cache.Cache {
-		_, err := oci.LookupManifestByDescriptor(ent.Blob)
-		if err != nil {
-			delete(cache.Cache, hash)
-			pruned = true
+		if ent.Blob.Digest != old.Digest {
+			continue
 		}
+
+		ent.Blob = new
+		cache.Cache[hash] = ent
+		changed = true
 	}
 
-	if pruned {
-		err := cache.persist()
-		if err != nil {
-			return nil, err
-		}
+	if !changed {
+		return nil
 	}
 
-	return cache, nil
+	return cache.persist()
 }
 
 /* Explicitly don't use mtime */
@@ -132,75 +191,109 @@ func hashFile(path string) (string, error) {
 }
 
 func (c *BuildCache) Lookup(l *Layer, importsDir string) (ispec.Descriptor, bool) {
-	h, err := hashstructure.Hash(l, nil)
-	if err != nil {
+	result, reason := c.check(l, func(imp string) string {
+		return path.Join(importsDir, importName(imp))
+	})
+	if reason != "" {
 		return ispec.Descriptor{}, false
 	}
 
-	result, ok := c.Cache[fmt.Sprintf("%d", h)]
+	return result.Blob, true
+}
+
+// Explain is like Lookup, but returns why the layer would be rebuilt, or ""
+// if it would be found in the cache. Since the imports haven't been done,
+// local imports are compared against their sources rather than their copies
+// in importsDir.
+func (c *BuildCache) Explain(l *Layer, importsDir string) string {
+	_, reason := c.check(l, func(imp string) string {
+		if u, err := url.Parse(imp); err == nil && u.Scheme == "" {
+			return imp
+		}
+
+		return path.Join(importsDir, importName(imp))
+	})
+	return reason
+}
+
+// check looks up the cache entry for l, and checks that its imports (which
+// importPath maps to the path they are on disk) haven't changed. If there is
+// no valid entry, the reason is returned.
+func (c *BuildCache) check(l *Layer, importPath func(string) string) (CacheEntry, string) {
+	key, err := c.key(l)
+	if err != nil {
+		return CacheEntry{}, err.Error()
+	}
+
+	result, ok := c.Cache[key]
 	if !ok {
-		return ispec.Descriptor{}, false
+		return CacheEntry{}, "its definition changed, or it hasn't been built"
+	}
+
+	if l.baseDigest != "" && l.baseDigest != result.BaseDigest {
+		return CacheEntry{}, fmt.Sprintf("its base image changed to %s", l.baseDigest)
 	}
 
 	imports, err := l.ParseImport()
 	if err != nil {
-		return ispec.Descriptor{}, false
+		return CacheEntry{}, err.Error()
 	}
 
 	for _, imp := range imports {
-		name := path.Base(imp)
+		name := importName(imp)
 		cachedImport, ok := result.Imports[name]
 		if !ok {
-			return ispec.Descriptor{}, false
+			return CacheEntry{}, fmt.Sprintf("import %s is new", imp)
 		}
 
-		diskPath := path.Join(importsDir, name)
+		diskPath := importPath(imp)
 		st, err := os.Stat(diskPath)
 		if err != nil {
-			return ispec.Descriptor{}, false
+			return CacheEntry{}, fmt.Sprintf("import %s hasn't been fetched", imp)
 		}
 
+		changed := fmt.Sprintf("import %s changed", imp)
 		if cachedImport.Type.IsDir() != st.IsDir() {
-			return ispec.Descriptor{}, false
+			return CacheEntry{}, changed
 		}
 
 		if st.IsDir() {
 			rawCachedImport, err := base64.StdEncoding.DecodeString(cachedImport.Hash)
 			if err != nil {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, err.Error()
 			}
 
 			cachedDH, err := mtree.ParseSpec(bytes.NewBuffer(rawCachedImport))
 			if err != nil {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, err.Error()
 			}
 
 			dh, err := walkImport(diskPath)
 			if err != nil {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, err.Error()
 			}
 
 			diff, err := mtree.Compare(cachedDH, dh, mtreeKeywords)
 			if err != nil {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, err.Error()
 			}
 
 			if len(diff) > 0 {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, changed
 			}
 		} else {
 			h, err := hashFile(diskPath)
 			if err != nil {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, err.Error()
 			}
 
 			if h != cachedImport.Hash {
-				return ispec.Descriptor{}, false
+				return CacheEntry{}, changed
 			}
 		}
 	}
 
-	return result.Blob, true
+	return result, ""
 }
 
 func getEncodedMtree(path string) (string, error) {
@@ -218,15 +311,31 @@ func getEncodedMtree(path string) (string, error) {
 	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
-func (c *BuildCache) Put(l *Layer, importsDir string, blob ispec.Descriptor) error {
+// key is the key of l's entry in the cache.
+func (c *BuildCache) key(l *Layer) (string, error) {
 	h, err := hashstructure.Hash(l, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if c.arch != "" {
+		return fmt.Sprintf("%d-%s", h, c.arch), nil
+	}
+
+	return fmt.Sprintf("%d", h), nil
+}
+
+func (c *BuildCache) Put(name string, l *Layer, importsDir string, blob ispec.Descriptor) error {
+	key, err := c.key(l)
 	if err != nil {
 		return err
 	}
 
 	ent := CacheEntry{
-		Blob:    blob,
-		Imports: map[string]ImportHash{},
+		Name:       name,
+		Blob:       blob,
+		Imports:    map[string]ImportHash{},
+		BaseDigest: l.baseDigest,
 	}
 
 	imports, err := l.ParseImport()
@@ -235,7 +344,7 @@ func (c *BuildCache) Put(l *Layer, importsDir string, blob ispec.Descriptor) err
 	}
 
 	for _, imp := range imports {
-		name := path.Base(imp)
+		name := importName(imp)
 		diskPath := path.Join(importsDir, name)
 		st, err := os.Stat(diskPath)
 		if err != nil {
@@ -260,10 +369,78 @@ func (c *BuildCache) Put(l *Layer, importsDir string, blob ispec.Descriptor) err
 		ent.Imports[name] = ih
 	}
 
-	c.Cache[fmt.Sprintf("%d", h)] = ent
+	c.Cache[key] = ent
 	return c.persist()
 }
 
+// snapshotKeyPath is where the cache key of the layer that the snapshot name
+// was built from is recorded.
+func (c *BuildCache) snapshotKeyPath(name string) string {
+	return path.Join(path.Dir(c.path), "snapshots", name)
+}
+
+// snapshotKey returns the cache key recorded for the snapshot name, or "" if
+// there is none.
+func (c *BuildCache) snapshotKey(name string) string {
+	content, err := ioutil.ReadFile(c.snapshotKeyPath(name))
+	if err != nil {
+		return ""
+	}
+
+	return string(content)
+}
+
+// setSnapshotKey records that the snapshot name was built with the cache key
+// key; an empty key forgets it, e.g. before the snapshot is replaced.
+func (c *BuildCache) setSnapshotKey(name string, key string) error {
+	p := c.snapshotKeyPath(name)
+	if key == "" {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, []byte(key), 0644)
+}
+
+// ForgetSnapshot forgets what the snapshot name was built from, before it is
+// replaced.
+func (c *BuildCache) ForgetSnapshot(name string) error {
+	return c.setSnapshotKey(name, "")
+}
+
+// PutSnapshot records that the snapshot name was built from l.
+func (c *BuildCache) PutSnapshot(name string, l *Layer) error {
+	key, err := c.key(l)
+	if err != nil {
+		return err
+	}
+
+	return c.setSnapshotKey(name, key)
+}
+
+// HasSnapshot returns true if the snapshot name in rootfsDir is there and
+// was built from l, as opposed to e.g. another arch or a later revision of
+// the layer that was reverted since.
+func (c *BuildCache) HasSnapshot(rootfsDir string, name string, l *Layer) bool {
+	if _, err := os.Stat(path.Join(rootfsDir, name, "rootfs")); err != nil {
+		return false
+	}
+
+	key, err := c.key(l)
+	if err != nil {
+		return false
+	}
+
+	return c.snapshotKey(name) == key
+}
+
 func (c *BuildCache) persist() error {
 	content, err := json.Marshal(c)
 	if err != nil {
@@ -0,0 +1,170 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// DefaultImportCAS is where the import store is by default:
+// $XDG_CACHE_HOME/stacker/cas, or ~/.cache/stacker/cas.
+func DefaultImportCAS() string {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		cacheHome = path.Join(home, ".cache")
+	}
+
+	return path.Join(cacheHome, "stacker", "cas")
+}
+
+// importCAS is a content addressed store of downloaded imports, shared by
+// all of a user's projects. Files are stored by digest as sha256/<hex>, and
+// reflinked (or copied) into the projects' imports dirs, never hardlinked,
+// since those are mounted read-write into containers; urls/ maps the sha256
+// of each url that was downloaded to the digest it had.
+type importCAS string
+
+func (cas importCAS) blobPath(digest string) string {
+	return path.Join(string(cas), "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (cas importCAS) urlPath(u string) string {
+	return path.Join(string(cas), "urls", fmt.Sprintf("%x", sha256.Sum256([]byte(u))))
+}
+
+// lookup returns the digest and path in the store of what u was when it was
+// downloaded, if it's there. The blob is hashed again, and if it doesn't
+// match its digest any more, it's thrown away rather than used.
+func (cas importCAS) lookup(u string) (string, string, bool) {
+	content, err := ioutil.ReadFile(cas.urlPath(u))
+	if err != nil {
+		return "", "", false
+	}
+
+	digest := strings.TrimSpace(string(content))
+	blob := cas.blobPath(digest)
+	actual, err := hashFile(blob)
+	if err != nil {
+		return "", "", false
+	}
+
+	if actual != digest {
+		log.Warnf("%s in the import store is corrupt (its digest is %s), removing it", blob, actual)
+		os.Remove(blob)
+		os.Remove(cas.urlPath(u))
+		return "", "", false
+	}
+
+	return digest, blob, true
+}
+
+// store adds the file p, downloaded from u, to the store.
+func (cas importCAS) store(u string, p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	digest, err := hashFile(p)
+	if err != nil {
+		return err
+	}
+
+	blob := cas.blobPath(digest)
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := cloneOrCopy(p, blob); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(cas.urlPath(u)), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cas.urlPath(u), []byte(digest), 0644)
+}
+
+// cloneOrCopy replaces dest with a reflink of src where the filesystem
+// supports it, or a copy of it otherwise, so that changing one never changes
+// the other.
+func cloneOrCopy(src string, dest string) error {
+	tmp := dest + ".cas"
+	os.Remove(tmp)
+
+	if err := fileCopy(tmp, src); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// acquireWithCAS acquires the remote import u with h, unless it isn't in
+// cacheDir yet and the import store has it, in which case it's copied from
+// there without downloading it again. What h downloads is added to the store.
+func acquireWithCAS(c StackerConfig, h ImportHandler, u *url.URL, cacheDir string) (string, error) {
+	cas := importCAS(c.ImportCAS)
+	dest := path.Join(cacheDir, importName(u.String()))
+
+	_, err := os.Lstat(dest)
+	cached := err == nil
+	if os.IsNotExist(err) {
+		if digest, blob, ok := cas.lookup(u.String()); ok {
+			if c.Lock != nil {
+				if err := c.Lock.VerifyImport(u.String(), digest); err != nil {
+					return "", err
+				}
+			}
+
+			log.Infof("using %s from the import store", u)
+			if err := cloneOrCopy(blob, dest); err != nil {
+				return "", err
+			}
+
+			return dest, nil
+		}
+	}
+
+	p, err := h.Acquire(c, u, cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	// What was already in cacheDir came from the store, or was added to
+	// it when it was downloaded (and may since have been changed by a run
+	// section, so it mustn't be added again).
+	if cached {
+		return p, nil
+	}
+
+	// The store is only a cache, so not being able to use it doesn't
+	// fail the import.
+	if err := cas.store(u.String(), p); err != nil {
+		log.Warnf("couldn't add %s to the import store %s: %v", u, c.ImportCAS, err)
+	}
+
+	return p, nil
+}
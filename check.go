@@ -0,0 +1,230 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CheckResult is the outcome of one of stacker's preflight checks.
+type CheckResult struct {
+	// Name is a short description of what was checked.
+	Name string
+
+	// Err is why the check failed, or nil if it passed.
+	Err error
+
+	// Remedy tells the user how to fix a failure.
+	Remedy string
+
+	// Optional checks are for things only some builds need; failing them
+	// doesn't stop stacker from working.
+	Optional bool
+}
+
+func checkBinary(name string, remedy string, optional bool) CheckResult {
+	_, err := exec.LookPath(name)
+	return CheckResult{
+		Name:     fmt.Sprintf("%s is installed", name),
+		Err:      err,
+		Remedy:   remedy,
+		Optional: optional,
+	}
+}
+
+func checkStorage(sc StackerConfig) []CheckResult {
+	storageType := sc.StorageType
+	if storageType == "" {
+		storageType = "btrfs"
+	}
+
+	known := CheckResult{Name: fmt.Sprintf("storage driver %s exists", storageType)}
+	storageDriversLock.RLock()
+	_, ok := storageDrivers[storageType]
+	storageDriversLock.RUnlock()
+	if !ok {
+		known.Err = fmt.Errorf("unknown storage type %s", storageType)
+		known.Remedy = fmt.Sprintf("use one of: %s", strings.Join(StorageTypes(), ", "))
+		return []CheckResult{known}
+	}
+
+	results := []CheckResult{known}
+	if storageType != "btrfs" {
+		return results
+	}
+
+	// The roots dir may not have been created yet; check what it would
+	// be created on.
+	dir := sc.RootFSDir
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &fs); err == nil && fs.Type == 0x9123683E {
+		return append(results, CheckResult{Name: fmt.Sprintf("%s is on btrfs", sc.RootFSDir)})
+	}
+
+	loop := CheckResult{
+		Name:   fmt.Sprintf("a loopback btrfs can be set up at %s", sc.RootFSDir),
+		Remedy: "run stacker as root, mount a btrfs filesystem at the roots dir, or use --rootless",
+	}
+	if os.Geteuid() != 0 {
+		loop.Err = fmt.Errorf("%s is not on btrfs, and only root can set up a loopback", sc.RootFSDir)
+	}
+	results = append(results, loop)
+
+	filesystems, err := ioutil.ReadFile("/proc/filesystems")
+	kernel := CheckResult{
+		Name:   "the kernel supports btrfs",
+		Remedy: "load the btrfs module (modprobe btrfs), or use --storage-type dir",
+	}
+	if err == nil && !strings.Contains(string(filesystems), "btrfs") {
+		// It might just not be loaded yet; mount will autoload it.
+		if _, err := os.Stat("/sys/module/btrfs"); err != nil {
+			kernel.Err = fmt.Errorf("btrfs isn't in /proc/filesystems")
+		}
+	}
+	results = append(results, kernel)
+
+	return append(results, checkBinary("mkfs.btrfs", "install btrfs-progs", false))
+}
+
+func checkCgroups() CheckResult {
+	result := CheckResult{
+		Name:     "cgroups are writable",
+		Remedy:   "run stacker as root, or in a systemd scope with delegation (systemd-run --user --scope -p Delegate=yes)",
+		Optional: true,
+	}
+
+	if _, err := os.Stat("/sys/fs/cgroup"); err != nil {
+		result.Err = fmt.Errorf("/sys/fs/cgroup isn't mounted")
+		result.Remedy = "mount the cgroup filesystem at /sys/fs/cgroup"
+		return result
+	}
+
+	if os.Geteuid() == 0 {
+		return result
+	}
+
+	// Unprivileged users can only set limits (run sections' resources)
+	// in cgroup2 subtrees that have been delegated to them.
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		result.Err = fmt.Errorf("cgroup v1 can't be delegated to unprivileged users")
+		return result
+	}
+
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+
+		p := path.Join("/sys/fs/cgroup", strings.TrimPrefix(line, "0::"))
+		if err := unix.Access(p, unix.W_OK); err != nil {
+			result.Err = fmt.Errorf("%s isn't writable", p)
+		}
+		return result
+	}
+
+	result.Err = fmt.Errorf("not in a cgroup2 hierarchy")
+	return result
+}
+
+// rootlessChecks checks the things unprivileged users need to build images;
+// see CheckRootless.
+func rootlessChecks() []CheckResult {
+	name := "the current user"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	subids := CheckResult{
+		Name:   fmt.Sprintf("%s has subuids and subgids", name),
+		Remedy: "add ranges for it to /etc/subuid and /etc/subgid, e.g. with usermod --add-subuids and --add-subgids",
+	}
+	if IdmapSet == nil {
+		subids.Err = fmt.Errorf("%s has no subuid and subgid delegation", name)
+	}
+	results := []CheckResult{subids}
+
+	sysctls := []struct {
+		path string
+		name string
+	}{
+		{"/proc/sys/kernel/unprivileged_userns_clone", "kernel.unprivileged_userns_clone"},
+		{"/proc/sys/user/max_user_namespaces", "user.max_user_namespaces"},
+	}
+
+	userns := CheckResult{Name: "unprivileged user namespaces are enabled"}
+	for _, s := range sysctls {
+		content, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			// Not every kernel has every knob.
+			continue
+		}
+
+		if strings.TrimSpace(string(content)) == "0" {
+			userns.Err = fmt.Errorf("unprivileged user namespaces are disabled")
+			userns.Remedy = fmt.Sprintf("set %s to a non-zero value", s.name)
+			break
+		}
+	}
+	results = append(results, userns)
+
+	for _, helper := range []string{"lxc-usernsexec", "newuidmap", "newgidmap"} {
+		results = append(results, checkBinary(helper, "install lxc and uidmap (shadow-utils)", false))
+	}
+
+	return results
+}
+
+// Preflight checks that the kernel and environment have what stacker needs
+// to build with the given config, so that users find out about everything
+// that's missing up front rather than one failure at a time mid-build.
+func Preflight(sc StackerConfig) []CheckResult {
+	results := []CheckResult{
+		checkBinary("skopeo", "install skopeo; see doc/running.md", false),
+		checkBinary("umoci", "go install github.com/openSUSE/umoci", false),
+		checkBinary("tar", "install tar", false),
+	}
+
+	if sc.Runtime != "" && sc.Runtime != LXCRuntime {
+		results = append(results, checkBinary(sc.Runtime, fmt.Sprintf("install %s, or use --runtime lxc", sc.Runtime), false))
+	}
+
+	if IsForeignArch(sc.Arch) {
+		_, err := binfmtInterpreter(sc.Arch)
+		results = append(results, CheckResult{
+			Name:   fmt.Sprintf("binfmt handler for %s", sc.Arch),
+			Err:    err,
+			Remedy: fmt.Sprintf("install qemu-user-static and run stacker binfmt install %s", sc.Arch),
+		})
+	}
+
+	results = append(results, checkStorage(sc)...)
+
+	if os.Geteuid() != 0 {
+		results = append(results, rootlessChecks()...)
+	}
+
+	results = append(results, checkCgroups())
+	results = append(results, checkBinary("tar2sqfs", "install squashfs-tools-ng to build squashfs layers", true))
+
+	return results
+}
@@ -0,0 +1,157 @@
+package stacker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// parseChecksums parses a checksums file in the format of sha256sum's output
+// ("<hex>  <name>", or "<hex> *<name>" for binary mode) or its --tag format
+// ("SHA256 (<name>) = <hex>"), returning the hex digests by name.
+func parseChecksums(content string) (map[string]string, error) {
+	sums := map[string]string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var name, sum string
+		if strings.HasPrefix(line, "SHA256 (") {
+			i := strings.LastIndex(line, ") = ")
+			if i < 0 {
+				return nil, fmt.Errorf("bad checksum line %q", line)
+			}
+			name, sum = line[len("SHA256 ("):i], line[i+len(") = "):]
+		} else {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("bad checksum line %q", line)
+			}
+			sum = fields[0]
+			name = strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		}
+
+		if len(sum) != 64 {
+			return nil, fmt.Errorf("bad sha256 for %s: %s", name, sum)
+		}
+
+		sums[strings.TrimPrefix(name, "./")] = strings.ToLower(sum)
+	}
+
+	return sums, scanner.Err()
+}
+
+// lookupChecksum finds the digest for the file called base in sums, which may
+// list it with a directory in front.
+func lookupChecksum(sums map[string]string, base string) (string, bool) {
+	if sum, ok := sums[base]; ok {
+		return sum, true
+	}
+
+	found := ""
+	for name, sum := range sums {
+		if path.Base(name) == base {
+			if found != "" {
+				return "", false
+			}
+			found = sum
+		}
+	}
+
+	return found, found != ""
+}
+
+// fetchFresh acquires the path or url u into dir, replacing any copy from an
+// earlier build: checksums files (and their signatures) are usually updated
+// in place when a new release is published, so a cached copy would go stale.
+func fetchFresh(c StackerConfig, u string, dir string) (string, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// The import CAS would keep the first copy forever too.
+	c.ImportCAS = ""
+	return acquireUrl(c, u, dir, DefaultSymlinks)
+}
+
+// verifyChecksums checks the import i, which was acquired to p, against its
+// checksums file, after checking the checksums file's own signature, if it
+// has one.
+func verifyChecksums(c StackerConfig, i ImportSpec, p string) error {
+	// Checksums files from different places are usually all called
+	// SHA256SUMS, so each gets its own directory.
+	dir := path.Join(c.StackerDir, "checksums", fmt.Sprintf("%x", sha256.Sum256([]byte(i.Checksums)))[:16])
+
+	sumsPath, err := fetchFresh(c, i.Checksums, path.Join(dir, "sums"))
+	if err != nil {
+		return err
+	}
+
+	if i.ChecksumsSignature != "" {
+		sigPath, err := fetchFresh(c, i.ChecksumsSignature, path.Join(dir, "signature"))
+		if err != nil {
+			return err
+		}
+
+		if err := gpgv(i.Keyring, sigPath, sumsPath); err != nil {
+			return errors.Wrapf(err, "couldn't verify checksums %s", i.Checksums)
+		}
+	}
+
+	content, err := ioutil.ReadFile(sumsPath)
+	if err != nil {
+		return err
+	}
+
+	sums, err := parseChecksums(string(content))
+	if err != nil {
+		return errors.Wrapf(err, "bad checksums %s", i.Checksums)
+	}
+
+	base := path.Base(i.Path)
+	if u, err := url.Parse(i.Path); err == nil && u.Scheme != "" {
+		base = path.Base(u.Path)
+	}
+
+	expected, ok := lookupChecksum(sums, base)
+	if !ok {
+		return fmt.Errorf("%s isn't listed in %s", base, i.Checksums)
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return fmt.Errorf("can't check the checksum of directory %s", i.Path)
+	}
+
+	actual, err := hashFile(p)
+	if err != nil {
+		return err
+	}
+
+	if actual != "sha256:"+expected {
+		return fmt.Errorf("%s has checksum %s, but %s says sha256:%s", i.Path, actual, i.Checksums, expected)
+	}
+
+	log.Infof("verified checksum of %s", i.Path)
+	return nil
+}
@@ -0,0 +1,299 @@
+package stacker
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	MediaTypeImageLayerZstd  = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Compression is the compression used for generated layer blobs.
+type Compression string
+
+const (
+	GzipCompression    Compression = "gzip"
+	ZstdCompression    Compression = "zstd"
+	NoCompression      Compression = "none"
+	EstargzCompression Compression = "estargz"
+)
+
+// ParseCompression parses the name of a layer compression.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case GzipCompression, ZstdCompression, NoCompression, EstargzCompression:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown layer compression %s", name)
+	}
+}
+
+// MediaType is the OCI media type of a tar layer with this compression.
+// eStargz layers are gzip layers as far as OCI is concerned.
+func (c Compression) MediaType() string {
+	switch c {
+	case ZstdCompression:
+		return MediaTypeImageLayerZstd
+	case NoCompression:
+		return ispec.MediaTypeImageLayer
+	default:
+		return ispec.MediaTypeImageLayerGzip
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressor wraps w in a writer that compresses with c at the given level;
+// a level of 0 means the compression's default.
+func compressor(c Compression, level int, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case GzipCompression:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case ZstdCompression:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case EstargzCompression:
+		return nil, fmt.Errorf("estargz layers can only be made from a whole tar stream")
+	default:
+		return nil, fmt.Errorf("unknown layer compression %s", c)
+	}
+}
+
+// decompressor wraps r, which is a layer with the given media type, in a
+// reader that yields the uncompressed tar stream.
+func decompressor(mediaType string, r io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip, MediaTypeDockerLayerGzip:
+		return gzip.NewReader(r)
+	case MediaTypeImageLayerZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+}
+
+// recompressBlob writes a copy of the layer blob desc compressed with c to
+// the layout, and returns its descriptor and its diff_id. The diff_id only
+// changes when converting to or from eStargz, whose landmark and table of
+// contents are part of the uncompressed content.
+func recompressBlob(ociDir string, desc ispec.Descriptor, c Compression, level int) (ispec.Descriptor, digest.Digest, error) {
+	in, err := os.Open(layoutBlobPath(ociDir, desc.Digest))
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer in.Close()
+
+	var uncompressed io.ReadCloser
+	uncompressed, err = decompressor(desc.MediaType, in)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer uncompressed.Close()
+
+	if isEstargz(desc) {
+		uncompressed = withoutEstargzEntries(uncompressed)
+		defer uncompressed.Close()
+	}
+
+	out, err := ioutil.TempFile(path.Join(ociDir, "blobs"), ".recompress")
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		if k != EstargzTOCDigestAnnotation && k != EstargzUncompressedSizeAnnotation {
+			annotations[k] = v
+		}
+	}
+
+	var diffID digest.Digest
+	if c == EstargzCompression {
+		var size int64
+		var tocDigest digest.Digest
+		diffID, size, tocDigest, err = writeEstargz(uncompressed, io.MultiWriter(out, digester.Hash(), counter), level)
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't convert %s to estargz", desc.Digest)
+		}
+
+		annotations[EstargzTOCDigestAnnotation] = tocDigest.String()
+		annotations[EstargzUncompressedSizeAnnotation] = fmt.Sprintf("%d", size)
+	} else {
+		compressed, err := compressor(c, level, io.MultiWriter(out, digester.Hash(), counter))
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+
+		diffIDDigester := digest.Canonical.Digester()
+		if _, err := io.Copy(compressed, io.TeeReader(uncompressed, diffIDDigester.Hash())); err != nil {
+			return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't recompress %s", desc.Digest)
+		}
+
+		if err := compressed.Close(); err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+		diffID = diffIDDigester.Digest()
+	}
+
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	newDesc := ispec.Descriptor{
+		MediaType:   c.MediaType(),
+		Digest:      digester.Digest(),
+		Size:        counter.n,
+		Annotations: annotations,
+	}
+
+	p := layoutBlobPath(ociDir, newDesc.Digest)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	if err := os.Rename(out.Name(), p); err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	return newDesc, diffID, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// RecompressLayers rewrites the layers of the image tagged name with
+// compression c. If all is false, only the topmost layer (i.e. the one that
+// was just generated) is rewritten. Squashfs layers, and layers that are
+// already compressed with c when no level is given, are left alone. Unless
+// converting to or from eStargz, the uncompressed content doesn't change, so
+// neither do the config's diff_ids. The replaced layer blobs are removed,
+// unless another image still uses them. The new manifest descriptor is
+// returned.
+func RecompressLayers(ociDir string, oci *umoci.Layout, name string, c Compression, level int, all bool) (ispec.Descriptor, error) {
+	replaced := []digest.Digest{}
+	desc, err := UpdateManifest(ociDir, oci, name, func(manifest *ispec.Manifest) error {
+		diffIDs := map[int]digest.Digest{}
+		for i, layer := range manifest.Layers {
+			if !all && i != len(manifest.Layers)-1 {
+				continue
+			}
+
+			if layer.MediaType == MediaTypeImageSquashfsLayer {
+				log.Infof("%s's layer %d is squashfs, not recompressing it", name, i)
+				continue
+			}
+
+			if layer.MediaType == c.MediaType() && isEstargz(layer) == (c == EstargzCompression) && level == 0 {
+				continue
+			}
+
+			newDesc, diffID, err := recompressBlob(ociDir, manifest.Layers[i], c, level)
+			if err != nil {
+				return err
+			}
+
+			if newDesc.Digest != layer.Digest {
+				replaced = append(replaced, layer.Digest)
+			}
+			manifest.Layers[i] = newDesc
+			diffIDs[i] = diffID
+		}
+
+		return updateDiffIDs(ociDir, name, manifest, diffIDs)
+	})
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, removeUnusedBlobs(ociDir, oci, replaced)
+}
+
+// updateDiffIDs rewrites the config of manifest with the layers' diff_ids
+// changed as in diffIDs (layer index to diff_id), if any of them differ.
+func updateDiffIDs(ociDir string, name string, manifest *ispec.Manifest, diffIDs map[int]digest.Digest) error {
+	if len(diffIDs) == 0 {
+		return nil
+	}
+
+	rawConfig, err := readLayoutBlob(ociDir, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	config := ispec.Image{}
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return err
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("%s has %d layers but %d diff_ids", name, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	changed := false
+	for i, diffID := range diffIDs {
+		if config.RootFS.DiffIDs[i] != diffID {
+			config.RootFS.DiffIDs[i] = diffID
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	rawConfig, err = marshalBlob(config)
+	if err != nil {
+		return err
+	}
+
+	manifest.Config, err = writeLayoutBlob(ociDir, manifest.Config.MediaType, rawConfig)
+	return err
+}
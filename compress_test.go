@@ -0,0 +1,358 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRecompressBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("meshuggah rocks "), 1024)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+
+	desc, err := writeLayoutBlob(dir, ispec.MediaTypeImageLayerGzip, buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, c := range []Compression{ZstdCompression, NoCompression, GzipCompression} {
+		newDesc, _, err := recompressBlob(dir, desc, c, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		if newDesc.MediaType != c.MediaType() {
+			t.Fatalf("%s: bad media type %s", c, newDesc.MediaType)
+		}
+
+		f, err := os.Open(layoutBlobPath(dir, newDesc.Digest))
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+		defer f.Close()
+
+		r, err := decompressor(newDesc.MediaType, f)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		result, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+
+		if !bytes.Equal(result, content) {
+			t.Fatalf("%s: recompressed content differs", c)
+		}
+	}
+}
+
+func TestLayerFileWarnings(t *testing.T) {
+	files := []LayerFile{
+		{Path: "var/cache/apt/archives/gcc.deb", Size: 10},
+		{Path: "var/cache/apt/archives/make.deb", Size: 10},
+		{Path: "root/.cache/pip/wheel", Size: 10},
+		{Path: "core.1234", Size: 10},
+		{Path: "usr/lib/python3/dist-packages/numpy/core", Size: 10},
+		{Path: "corefile", Size: 10},
+		{Path: "opt/sdk.tar", Size: 1000},
+		{Path: "opt/big", Size: 1000, Mode: os.ModeDir},
+	}
+
+	warnings := layerFileWarnings(files, 1000)
+	expected := []string{
+		"/opt/sdk.tar is 1kB",
+		"apt cache: 2 file(s), 20B",
+		"pip cache: 1 file(s), 10B",
+		"core dump: 1 file(s), 10B",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad warnings %v", warnings)
+	}
+}
+
+func TestEstargz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := bytes.Repeat([]byte("meshuggah rocks "), (estargzChunkSize*2+100)/16)
+
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big))})
+	tw.Write(big)
+	tw.WriteHeader(&tar.Header{Name: "etc/issue", Typeflag: tar.TypeSymlink, Linkname: "motd"})
+	tw.Close()
+	originalDiffID := digest.FromBytes(tarBuf.Bytes())
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(tarBuf.Bytes())
+	gz.Close()
+
+	desc, err := writeLayoutBlob(dir, ispec.MediaTypeImageLayerGzip, buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	stargzDesc, diffID, err := recompressBlob(dir, desc, EstargzCompression, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !isEstargz(stargzDesc) || stargzDesc.MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Fatalf("bad estargz descriptor %v", stargzDesc)
+	}
+
+	blob, err := ioutil.ReadFile(layoutBlobPath(dir, stargzDesc.Digest))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// As a whole, it is still a gzipped tar, with the diff_id we were
+	// given.
+	r, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	uncompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if digest.FromBytes(uncompressed) != diffID {
+		t.Fatalf("bad diff_id %s", diffID)
+	}
+
+	if stargzDesc.Annotations[EstargzUncompressedSizeAnnotation] != fmt.Sprintf("%d", len(uncompressed)) {
+		t.Fatalf("bad uncompressed size %v", stargzDesc.Annotations)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	if strings.Join(names, " ") != ".no.prefetch.landmark etc/ etc/motd big etc/issue stargz.index.json" {
+		t.Fatalf("bad entries %v", names)
+	}
+
+	// The footer points to the table of contents, which points to the
+	// chunks of the files.
+	footer := blob[len(blob)-51:]
+	fr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatalf("bad footer: %s", err)
+	}
+
+	extra := string(fr.Header.Extra)
+	if len(extra) != 26 || !strings.HasPrefix(extra, "SG") || !strings.HasSuffix(extra, "STARGZ") {
+		t.Fatalf("bad footer extra %q", extra)
+	}
+
+	tocOffset, err := strconv.ParseInt(extra[4:20], 16, 64)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	member := func(offset int64) *tar.Reader {
+		r, err := gzip.NewReader(bytes.NewReader(blob[offset:]))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		r.Multistream(false)
+		return tar.NewReader(r)
+	}
+
+	tocReader := member(tocOffset)
+	if hdr, err := tocReader.Next(); err != nil || hdr.Name != "stargz.index.json" {
+		t.Fatalf("bad toc entry %v: %v", hdr, err)
+	}
+
+	rawTOC, err := ioutil.ReadAll(tocReader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if digest.FromBytes(rawTOC).String() != stargzDesc.Annotations[EstargzTOCDigestAnnotation] {
+		t.Fatalf("bad toc digest annotation %v", stargzDesc.Annotations)
+	}
+
+	toc := estargzTOC{}
+	if err := json.Unmarshal(rawTOC, &toc); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	chunks := []*estargzEntry{}
+	for _, e := range toc.Entries {
+		if e.Name == "big" {
+			chunks = append(chunks, e)
+		}
+	}
+
+	if len(chunks) != 3 || chunks[0].Type != "reg" || chunks[0].Digest != digest.FromBytes(big).String() ||
+		chunks[1].Type != "chunk" || chunks[2].ChunkOffset != estargzChunkSize*2 {
+		t.Fatalf("bad chunks %v", chunks)
+	}
+
+	for _, c := range chunks {
+		size := c.ChunkSize
+		if size == 0 {
+			size = int64(len(big)) - c.ChunkOffset
+		}
+
+		r, err := gzip.NewReader(bytes.NewReader(blob[c.Offset:]))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		r.Multistream(false)
+
+		content := make([]byte, size)
+		if _, err := io.ReadFull(r, content); err != nil {
+			t.Fatalf("chunk at %d: %s", c.ChunkOffset, err)
+		}
+
+		if digest.FromBytes(content).String() != c.ChunkDigest {
+			t.Fatalf("bad chunk at %d", c.ChunkOffset)
+		}
+	}
+
+	// Going back to plain gzip drops the eStargz entries and annotations.
+	gzipDesc, diffID, err := recompressBlob(dir, stargzDesc, GzipCompression, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if diffID != originalDiffID || isEstargz(gzipDesc) {
+		t.Fatalf("bad round trip %v %s", gzipDesc, diffID)
+	}
+}
+
+func TestSquashfsCompressor(t *testing.T) {
+	for _, tc := range []struct {
+		c        Compression
+		level    int
+		expected string
+	}{
+		{GzipCompression, 0, "--compressor gzip"},
+		{EstargzCompression, 0, "--compressor gzip"},
+		{ZstdCompression, 19, "--compressor zstd --comp-extra level=19"},
+	} {
+		args, err := squashfsCompressor(tc.c, tc.level)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.c, err)
+		}
+
+		if strings.Join(args, " ") != tc.expected {
+			t.Fatalf("%s: bad args %v", tc.c, args)
+		}
+	}
+
+	if _, err := squashfsCompressor(NoCompression, 0); err == nil {
+		t.Fatalf("uncompressed squashfs accepted")
+	}
+}
+
+func TestMoveLayoutBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "layer")
+	if err := ioutil.WriteFile(p, []byte("squashfs"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	desc, err := moveLayoutBlob(dir, MediaTypeImageSquashfsLayer, p)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if desc.Digest != digest.FromBytes([]byte("squashfs")) || desc.Size != 8 {
+		t.Fatalf("bad descriptor %v", desc)
+	}
+
+	if _, err := readLayoutBlob(dir, desc); err != nil {
+		t.Fatalf("blob wasn't moved into the layout: %s", err)
+	}
+}
+
+func TestMarkUsedBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{Digest: digest.FromString("config")},
+		Layers: []ispec.Descriptor{{Digest: digest.FromString("layer")}},
+	}
+	manifest.SchemaVersion = 2
+	raw, _ := json.Marshal(manifest)
+	manifestDesc, err := writeLayoutBlob(dir, ispec.MediaTypeImageManifest, raw)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	index := ispec.Index{Manifests: []ispec.Descriptor{manifestDesc}}
+	index.SchemaVersion = 2
+	raw, _ = json.Marshal(index)
+	indexDesc, err := writeLayoutBlob(dir, ispec.MediaTypeImageIndex, raw)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	used := map[digest.Digest]bool{}
+	if err := markUsedBlobs(dir, indexDesc, used); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, d := range []digest.Digest{indexDesc.Digest, manifestDesc.Digest, manifest.Config.Digest, manifest.Layers[0].Digest} {
+		if !used[d] {
+			t.Fatalf("%s not marked as used", d)
+		}
+	}
+
+	if used[digest.FromString("other")] {
+		t.Fatalf("unrelated blob marked as used")
+	}
+}
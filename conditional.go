@@ -0,0 +1,60 @@
+package stacker
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// conditionTrue returns true if the value of an if: directive (after
+// substitution) is truthy: anything but empty, 0, false, no or off.
+func conditionTrue(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "0", "false", "no", "off":
+		return false
+	default:
+		return true
+	}
+}
+
+// pruneConditional removes the layers whose if: is false, and the layers
+// that depend on them, since they couldn't be built without them. What a
+// layer depends on is what dependencies() says, as for DependencyOrder, so
+// the two can't disagree about it.
+func (s Stackerfile) pruneConditional() {
+	skipped := map[string]bool{}
+	for name, l := range s {
+		if l.If != nil && !conditionTrue(*l.If) {
+			skipped[name] = true
+		}
+	}
+
+	for changed := len(skipped) > 0; changed; {
+		changed = false
+		for name, l := range s {
+			if skipped[name] {
+				continue
+			}
+
+			for _, dep := range s.dependencies(l) {
+				if skipped[dep.layer] {
+					skipped[name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range skipped {
+		names = append(names, name)
+		delete(s, name)
+	}
+
+	if len(names) > 0 {
+		sort.Strings(names)
+		log.Infof("skipping %s, since their if: conditions are false", strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,157 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ProjectConfigFile is the name of the per-project config file, which is
+// read from the directory stacker is run in.
+const ProjectConfigFile = ".stackerconfig"
+
+// ConfigFile is the contents of a stacker config file. The user's config
+// file and the project's are both read (the project's taking precedence),
+// and provide defaults for the flags that aren't given on the command line.
+type ConfigFile struct {
+	// StackerDir, OCIDir and RootFSDir are relative to the directory of
+	// the config file they're in.
+	StackerDir string `yaml:"stacker_dir"`
+	OCIDir     string `yaml:"oci_dir"`
+	RootFSDir  string `yaml:"roots_dir"`
+
+	StorageType string `yaml:"storage_type"`
+
+	// Username and Password are the registry credentials to use instead
+	// of the ones in the docker config.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Substitutions are applied to every stackerfile; --substitute
+	// overrides them.
+	Substitutions map[string]string `yaml:"substitutions"`
+
+	// ImportMirrors are mirrors to fall back to for imports; see
+	// StackerConfig.ImportMirrors.
+	ImportMirrors map[string][]string `yaml:"import_mirrors"`
+}
+
+// ConfigFilePaths returns the paths of the config files stacker reads, in
+// increasing order of precedence: $XDG_CONFIG_HOME/stacker/config.yaml
+// (~/.config by default), then ./.stackerconfig.
+func ConfigFilePaths() []string {
+	paths := []string{}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = path.Join(home, ".config")
+		}
+	}
+
+	if configHome != "" {
+		paths = append(paths, path.Join(configHome, "stacker", "config.yaml"))
+	}
+
+	return append(paths, ProjectConfigFile)
+}
+
+// LoadConfigFiles reads and merges the config files at paths; settings in
+// later files override those in earlier ones. Files that don't exist are
+// skipped.
+func LoadConfigFiles(paths []string) (ConfigFile, error) {
+	merged := ConfigFile{Substitutions: map[string]string{}, ImportMirrors: map[string][]string{}}
+
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return ConfigFile{}, err
+		}
+
+		c := ConfigFile{}
+		if err := yaml.UnmarshalStrict(content, &c); err != nil {
+			return ConfigFile{}, errors.Wrapf(err, "couldn't parse %s", p)
+		}
+
+		dir, err := filepath.Abs(path.Dir(p))
+		if err != nil {
+			return ConfigFile{}, err
+		}
+
+		dirs := []struct {
+			from string
+			to   *string
+		}{
+			{c.StackerDir, &merged.StackerDir},
+			{c.OCIDir, &merged.OCIDir},
+			{c.RootFSDir, &merged.RootFSDir},
+		}
+		for _, d := range dirs {
+			if d.from == "" {
+				continue
+			}
+
+			if path.IsAbs(d.from) {
+				*d.to = d.from
+			} else {
+				*d.to = path.Join(dir, d.from)
+			}
+		}
+
+		if c.StorageType != "" {
+			merged.StorageType = c.StorageType
+		}
+
+		if c.Username != "" {
+			merged.Username = c.Username
+			merged.Password = c.Password
+		}
+
+		for k, v := range c.Substitutions {
+			if strings.Contains(k, "=") {
+				return ConfigFile{}, fmt.Errorf("%s: invalid substitution name %s", p, k)
+			}
+			merged.Substitutions[k] = v
+		}
+
+		for prefix, mirrors := range c.ImportMirrors {
+			merged.ImportMirrors[prefix] = mirrors
+		}
+	}
+
+	return merged, nil
+}
+
+// MergeSubstitutions returns the config file's substitutions, as KEY=VALUE
+// strings, with the ones in overrides replacing those with the same key.
+func (c ConfigFile) MergeSubstitutions(overrides []string) []string {
+	overridden := map[string]bool{}
+	for _, o := range overrides {
+		overridden[strings.SplitN(o, "=", 2)[0]] = true
+	}
+
+	keys := []string{}
+	for k := range c.Substitutions {
+		if !overridden[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := []string{}
+	for _, k := range keys {
+		result = append(result, fmt.Sprintf("%s=%s", k, c.Substitutions[k]))
+	}
+
+	return append(result, overrides...)
+}
@@ -0,0 +1,120 @@
+package stacker
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigTemplate is the image config that a layer's config_template gives
+// it: either a YAML file with these keys, or the same keys of another layer.
+type ConfigTemplate struct {
+	Environment map[string]string `yaml:"environment"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	User        string            `yaml:"user"`
+}
+
+func mergeDefaults(dest map[string]string, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return dest
+	}
+
+	merged := map[string]string{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range dest {
+		merged[k] = v
+	}
+	return merged
+}
+
+// apply merges the template into the layer; the layer's own settings take
+// precedence.
+func (t ConfigTemplate) apply(l *Layer) {
+	l.Environment = mergeDefaults(l.Environment, t.Environment)
+	l.Labels = mergeDefaults(l.Labels, t.Labels)
+	l.Annotations = mergeDefaults(l.Annotations, t.Annotations)
+	if l.User == "" {
+		l.User = t.User
+	}
+}
+
+// readConfigTemplate reads the config template file p, which is relative to
+// the stackerfile that refers to it.
+func readConfigTemplate(stackerfile string, p string, opts ParseOpts) (ConfigTemplate, error) {
+	p, err := resolveInclude(stackerfile, p, opts.BuildContext)
+	if err != nil {
+		return ConfigTemplate{}, err
+	}
+
+	raw, err := readStackerfile(p, opts.Config)
+	if err != nil {
+		return ConfigTemplate{}, err
+	}
+
+	content, err := substitute(p, string(raw), opts.Substitutions, nil)
+	if err != nil {
+		return ConfigTemplate{}, WithKind(UserError, err)
+	}
+
+	t := ConfigTemplate{}
+	if err := yaml.UnmarshalStrict([]byte(content), &t); err != nil {
+		return ConfigTemplate{}, WithKind(UserError, errors.Wrapf(err, "couldn't parse %s", p))
+	}
+
+	return t, nil
+}
+
+// applyConfigTemplates merges each layer's config_template into it. A
+// config_template that is the name of a layer uses that layer's config
+// (after its own config_template, if it has one); otherwise it is a file.
+func (s Stackerfile) applyConfigTemplates(opts ParseOpts) error {
+	done := map[string]bool{}
+	applying := map[string]bool{}
+
+	var apply func(name string) error
+	apply = func(name string) error {
+		l := s[name]
+		if done[name] || l.ConfigTemplate == "" {
+			return nil
+		}
+
+		if applying[name] {
+			return WithKind(UserError, fmt.Errorf("config_template of %s refers back to itself", name))
+		}
+		applying[name] = true
+
+		if other, ok := s[l.ConfigTemplate]; ok {
+			if err := apply(l.ConfigTemplate); err != nil {
+				return err
+			}
+
+			ConfigTemplate{
+				Environment: other.Environment,
+				Labels:      other.Labels,
+				Annotations: other.Annotations,
+				User:        other.User,
+			}.apply(l)
+		} else {
+			t, err := readConfigTemplate(l.source, l.ConfigTemplate, opts)
+			if err != nil {
+				return errors.Wrapf(err, "config_template of %s", name)
+			}
+			t.apply(l)
+		}
+
+		done[name] = true
+		return nil
+	}
+
+	for name := range s {
+		if err := apply(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
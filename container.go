@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
+	"strconv"
 	"strings"
 
+	"github.com/docker/go-units"
 	"github.com/lxc/lxd/shared/idmap"
 	"github.com/openSUSE/umoci/oci/layer"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -68,6 +71,100 @@ func init() {
 	}
 }
 
+// parseIDMapping parses a mapping in the nsid:hostid:range format used by
+// --uid-map and --gid-map, e.g. 0:100000:65536.
+func parseIDMapping(mapping string, isuid bool) (idmap.IdmapEntry, error) {
+	parts := strings.Split(mapping, ":")
+	if len(parts) != 3 {
+		return idmap.IdmapEntry{}, fmt.Errorf("invalid id mapping %s, should be nsid:hostid:range", mapping)
+	}
+
+	ids := []int64{}
+	for _, p := range parts {
+		id, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || id < 0 {
+			return idmap.IdmapEntry{}, fmt.Errorf("invalid id mapping %s, should be nsid:hostid:range", mapping)
+		}
+		ids = append(ids, id)
+	}
+
+	if ids[2] == 0 {
+		return idmap.IdmapEntry{}, fmt.Errorf("invalid id mapping %s, range is empty", mapping)
+	}
+
+	return idmap.IdmapEntry{
+		Isuid:    isuid,
+		Isgid:    !isuid,
+		Nsid:     ids[0],
+		Hostid:   ids[1],
+		Maprange: ids[2],
+	}, nil
+}
+
+// NewIdmapSet builds the user namespace mapping made of the given uid and gid
+// mappings, in nsid:hostid:range format. If no gid mappings are given, the
+// uid mappings are used for gids too.
+func NewIdmapSet(uidMaps []string, gidMaps []string) (*idmap.IdmapSet, error) {
+	if len(uidMaps) == 0 {
+		return nil, fmt.Errorf("no uid mappings")
+	}
+
+	if len(gidMaps) == 0 {
+		gidMaps = uidMaps
+	}
+
+	set := &idmap.IdmapSet{}
+	for _, m := range uidMaps {
+		e, err := parseIDMapping(m, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := set.AddSafe(e); err != nil {
+			return nil, errors.Wrapf(err, "couldn't add uid mapping %s", m)
+		}
+	}
+
+	for _, m := range gidMaps {
+		e, err := parseIDMapping(m, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := set.AddSafe(e); err != nil {
+			return nil, errors.Wrapf(err, "couldn't add gid mapping %s", m)
+		}
+	}
+
+	return set, nil
+}
+
+// passthroughEnv returns the KEY=value pairs from stacker's environment that
+// are passed through to containers.
+func passthroughEnv() []string {
+	env := []string{}
+	for _, k := range []string{"http_proxy", "https_proxy", "no_proxy", "TERM"} {
+		v := os.Getenv(k)
+		if v != "" {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+
+		// The proxy vars are special, because some things e.g. curl
+		// and python like lower case, while golang likes upper case.
+		upper := strings.ToUpper(k)
+		if upper == k {
+			continue
+		}
+
+		v = os.Getenv(upper)
+		if v != "" {
+			env = append(env, fmt.Sprintf("%s=%s", upper, v))
+		}
+	}
+
+	return env
+}
+
 // our representation of a container
 type container struct {
 	sc StackerConfig
@@ -99,6 +196,10 @@ func newContainer(sc StackerConfig, name string) (*container, error) {
 		return nil, err
 	}
 
+	if IdmapSet == nil && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("running containers as an unprivileged user requires a subuid and subgid delegation")
+	}
+
 	if IdmapSet != nil {
 		for _, idm := range IdmapSet.Idmap {
 			if err := idm.Usable(); err != nil {
@@ -138,24 +239,10 @@ func newContainer(sc StackerConfig, name string) (*container, error) {
 		return nil, err
 	}
 
-	for _, k := range []string{"http_proxy", "https_proxy", "no_proxy", "TERM"} {
-		v := os.Getenv(k)
-		if v != "" {
-			err = c.setConfig("lxc.environment", fmt.Sprintf("%s=%s", k, v))
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		// The proxy vars are special, because some things e.g. curl
-		// and python like lower case, while golang likes upper case.
-		k = strings.ToUpper(k)
-		v = os.Getenv(k)
-		if v != "" {
-			err = c.setConfig("lxc.environment", fmt.Sprintf("%s=%s", k, v))
-			if err != nil {
-				return nil, err
-			}
+	for _, kv := range passthroughEnv() {
+		err = c.setConfig("lxc.environment", kv)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -173,6 +260,178 @@ func newContainer(sc StackerConfig, name string) (*container, error) {
 	return c, nil
 }
 
+// cpuPeriod is the cfs period (in microseconds) that cpu limits are expressed
+// against.
+const cpuPeriod = 100000
+
+// resourceConfigs returns the lxc cgroup config items that implement r, for
+// either the v1 or the unified (v2) cgroup hierarchy.
+func resourceConfigs(r *Resources, cgroup2 bool) (map[string]string, error) {
+	configs := map[string]string{}
+	if r == nil {
+		return configs, nil
+	}
+
+	prefix := "lxc.cgroup."
+	if cgroup2 {
+		prefix = "lxc.cgroup2."
+	}
+
+	if r.Memory != "" {
+		mem, err := units.RAMInBytes(r.Memory)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid memory limit %s", r.Memory)
+		}
+
+		if mem <= 0 {
+			return nil, fmt.Errorf("invalid memory limit %s", r.Memory)
+		}
+
+		if cgroup2 {
+			configs[prefix+"memory.max"] = fmt.Sprintf("%d", mem)
+		} else {
+			configs[prefix+"memory.limit_in_bytes"] = fmt.Sprintf("%d", mem)
+		}
+	}
+
+	if r.CPUs < 0 {
+		return nil, fmt.Errorf("invalid cpu limit %v", r.CPUs)
+	} else if r.CPUs > 0 {
+		quota := int64(r.CPUs * cpuPeriod)
+		if cgroup2 {
+			configs[prefix+"cpu.max"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+		} else {
+			configs[prefix+"cpu.cfs_period_us"] = fmt.Sprintf("%d", cpuPeriod)
+			configs[prefix+"cpu.cfs_quota_us"] = fmt.Sprintf("%d", quota)
+		}
+	}
+
+	if r.Pids < 0 {
+		return nil, fmt.Errorf("invalid pids limit %d", r.Pids)
+	} else if r.Pids > 0 {
+		configs[prefix+"pids.max"] = fmt.Sprintf("%d", r.Pids)
+	}
+
+	return configs, nil
+}
+
+// setResources limits the container's memory, cpus and pids via its cgroup.
+func (c *container) setResources(r *Resources) error {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	configs, err := resourceConfigs(r, err == nil)
+	if err != nil {
+		return err
+	}
+
+	return c.setConfigs(configs)
+}
+
+const (
+	NetworkHost   = "host"
+	NetworkNone   = "none"
+	NetworkBridge = "bridge"
+
+	// DefaultBridge is the host bridge that containers with bridge
+	// networking are attached to.
+	DefaultBridge = "lxcbr0"
+)
+
+// ValidateNetwork checks a network mode, a list of DNS servers, and a list of
+// host:ip extra hosts entries.
+func ValidateNetwork(mode string, dns []string, hosts []string) error {
+	switch mode {
+	case "", NetworkHost, NetworkNone, NetworkBridge:
+	default:
+		return fmt.Errorf("unknown network mode %s", mode)
+	}
+
+	for _, server := range dns {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid dns server %s", server)
+		}
+	}
+
+	for _, h := range hosts {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return fmt.Errorf("invalid extra host %s, should be host:ip", h)
+		}
+	}
+
+	return nil
+}
+
+// setNetwork configures the container's network: host shares the host's
+// network namespace (the default), none gives it only a loopback device, and
+// bridge attaches a veth to DefaultBridge.
+func (c *container) setNetwork(mode string) error {
+	switch mode {
+	case "", NetworkHost:
+		return c.setConfig("lxc.net.0.type", "none")
+	case NetworkNone:
+		return c.setConfig("lxc.net.0.type", "empty")
+	case NetworkBridge:
+		return c.setConfigs(map[string]string{
+			"lxc.net.0.type":  "veth",
+			"lxc.net.0.link":  DefaultBridge,
+			"lxc.net.0.flags": "up",
+		})
+	default:
+		return fmt.Errorf("unknown network mode %s", mode)
+	}
+}
+
+// writeNetworkFiles writes the resolv.conf and hosts files that should be
+// bind mounted into the container, and returns their paths. An empty path
+// means the file should be left as it is: the host's resolv.conf if there
+// are no dns servers, and the rootfs' hosts if there are no extra hosts.
+func writeNetworkFiles(sc StackerConfig, name string, dns []string, hosts []string) (string, string, error) {
+	dir := path.Join(sc.StackerDir, "network", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	resolvConf := ""
+	if len(dns) > 0 {
+		content := ""
+		for _, server := range dns {
+			content += fmt.Sprintf("nameserver %s\n", server)
+		}
+
+		resolvConf = path.Join(dir, "resolv.conf")
+		if err := ioutil.WriteFile(resolvConf, []byte(content), 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	hostsFile := ""
+	if len(hosts) > 0 {
+		content, err := ioutil.ReadFile(path.Join(sc.RootFSDir, ".working", "rootfs", "etc", "hosts"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", "", err
+			}
+			content = []byte("127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+		}
+
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+
+		for _, h := range hosts {
+			parts := strings.SplitN(h, ":", 2)
+			content = append(content, []byte(fmt.Sprintf("%s\t%s\n", parts[1], parts[0]))...)
+		}
+
+		hostsFile = path.Join(dir, "hosts")
+		if err := ioutil.WriteFile(hostsFile, content, 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	return resolvConf, hostsFile, nil
+}
+
 func (c *container) bindMount(source string, dest string) error {
 	createOpt := "create=dir"
 	stat, err := os.Lstat(source)
@@ -184,6 +443,10 @@ func (c *container) bindMount(source string, dest string) error {
 	return c.setConfig("lxc.mount.entry", val)
 }
 
+func (c *container) setEnv(kv string) error {
+	return c.setConfig("lxc.environment", kv)
+}
+
 func (c *container) setConfigs(config map[string]string) error {
 	for k, v := range config {
 		if err := c.setConfig(k, v); err != nil {
@@ -232,7 +495,7 @@ func (c *container) containerError(theErr error, msg string) error {
 	return errors.Wrap(theErr, fmt.Sprintf("%s\nLast few LXC errors:\n%s\n", msg, extra))
 }
 
-func (c *container) execute(args string, stdin io.Reader) error {
+func (c *container) execute(args string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
 	if err := c.setConfig("lxc.execute.cmd", args); err != nil {
 		return err
 	}
@@ -258,11 +521,15 @@ func (c *container) execute(args string, stdin io.Reader) error {
 
 	cmd.Stdin = stdin
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	return cmd.Run()
 }
 
+func (c *container) stop() error {
+	return c.c.Stop()
+}
+
 func umociMapOptions() *layer.MapOptions {
 	os := &layer.MapOptions{}
 	if IdmapSet == nil {
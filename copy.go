@@ -0,0 +1,364 @@
+package stacker
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// FICLONE isn't in our version of x/sys; it is _IOW(0x94, 9, int).
+	ficlone = 0x40049409
+
+	seekData = 3
+	seekHole = 4
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// CopyTree recursively copies the file or directory src to dest, like cp -a:
+// ownership (when we're allowed to set it), permissions, timestamps, and
+// xattrs are preserved, hardlinks within src stay hardlinked in dest, holes
+// in sparse files aren't filled in, and file contents are reflinked rather
+// than copied when the filesystem (e.g. btrfs) supports it. Existing files
+// in dest are replaced; files in dest that aren't in src are left alone.
+func CopyTree(dest string, src string) error {
+	return copyTreeWith(dest, src, copyOpts{})
+}
+
+type copyOpts struct {
+	// skip, if not nil, is called with the paths in src (relative to it);
+	// the ones it returns true for aren't copied, and are removed from
+	// dest if they were copied before.
+	skip func(rel string, isDir bool) bool
+
+	// followSymlinks copies what symlinks in src point to, rather than
+	// the symlinks themselves.
+	followSymlinks bool
+
+	// following are the (real paths of the) directories being copied
+	// through symlinks, to catch loops.
+	following map[string]bool
+}
+
+// copiedDir is a directory copyTreeWith created, whose metadata is copied
+// once its contents have been.
+type copiedDir struct {
+	target string
+	src    string
+	info   os.FileInfo
+}
+
+// copyTreeWith is CopyTree with options.
+func copyTreeWith(dest string, src string, opts copyOpts) error {
+	if opts.followSymlinks && opts.following == nil {
+		real, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return err
+		}
+		opts.following = map[string]bool{real: true}
+	}
+
+	skip := opts.skip
+	links := map[inode]string{}
+	dirs := []copiedDir{}
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, rel)
+
+		if skip != nil && rel != "." && skip(rel, info.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if opts.followSymlinks && info.Mode()&os.ModeSymlink != 0 {
+			resolved, err := os.Stat(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			// Dangling symlinks have nothing to follow, so they're
+			// copied as they are.
+			if err == nil && resolved.IsDir() {
+				return copySymlinkedDir(target, p, rel, opts)
+			} else if err == nil {
+				info = resolved
+			}
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+
+		if info.IsDir() {
+			existing, err := os.Lstat(target)
+			if err == nil && !existing.IsDir() {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+
+			// Set dir metadata and timestamps once we're done
+			// writing into them: a read only dir's mode would stop
+			// us (when we're not root) from copying its contents.
+			dirs = append(dirs, copiedDir{target: target, src: p, info: info})
+			return nil
+		}
+
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if st.Nlink > 1 {
+			key := inode{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		switch info.Mode() & os.ModeType {
+		case 0:
+			if err := copyFileContents(target, p, info.Mode()); err != nil {
+				return errors.Wrapf(err, "couldn't copy %s", p)
+			}
+		case os.ModeSymlink:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return errors.Wrapf(err, "couldn't mknod %s", target)
+			}
+		}
+
+		if err := copyMetadata(target, p, info, st); err != nil {
+			return err
+		}
+
+		return copyTimes(target, st)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		st := d.info.Sys().(*syscall.Stat_t)
+		if err := copyMetadata(d.target, d.src, d.info, st); err != nil {
+			return err
+		}
+
+		if err := copyTimes(d.target, st); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copySymlinkedDir copies the directory the symlink p (at rel in the tree
+// being copied) points to, for copyTreeWith when it is following symlinks.
+func copySymlinkedDir(target string, p string, rel string, opts copyOpts) error {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+
+	if opts.following[real] {
+		return errors.Errorf("symlink loop at %s", p)
+	}
+
+	following := map[string]bool{real: true}
+	for k := range opts.following {
+		following[k] = true
+	}
+
+	inner := opts
+	inner.following = following
+	if opts.skip != nil {
+		inner.skip = func(r string, isDir bool) bool {
+			return opts.skip(path.Join(rel, r), isDir)
+		}
+	}
+
+	if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	return copyTreeWith(target, real, inner)
+}
+
+// copyMetadata copies the ownership, mode and xattrs of src to dest.
+// Unprivileged users can't give files away or set some xattr namespaces,
+// so those failures are ignored when we're not root, the way cp -a does.
+func copyMetadata(dest string, src string, info os.FileInfo, st *syscall.Stat_t) error {
+	err := os.Lchown(dest, int(st.Uid), int(st.Gid))
+	if err != nil && !(os.IsPermission(err) && os.Geteuid() != 0) {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(dest, info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return copyXattrs(dest, src)
+}
+
+func copyXattrs(dest string, src string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return errors.Wrapf(err, "couldn't list xattrs of %s", src)
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list xattrs of %s", src)
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", name, src)
+		}
+
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", name, src)
+		}
+
+		err = unix.Lsetxattr(dest, name, value[:vsize], 0)
+		if err != nil {
+			if err == unix.ENOTSUP || (err == unix.EPERM && os.Geteuid() != 0) {
+				continue
+			}
+			return errors.Wrapf(err, "couldn't set xattr %s on %s", name, dest)
+		}
+	}
+
+	return nil
+}
+
+func copyTimes(dest string, st *syscall.Stat_t) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dest, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// copyFileContents creates dest with the contents of src. It tries to
+// reflink the file first; if the filesystem doesn't support that, the data
+// is copied, skipping over any holes.
+func copyFileContents(dest string, src string, mode os.FileMode) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if err := unix.IoctlSetInt(int(d.Fd()), ficlone, int(s.Fd())); err != nil {
+		fi, err := s.Stat()
+		if err == nil {
+			err = copySparse(d, s, fi.Size())
+		}
+		if err != nil {
+			d.Close()
+			return err
+		}
+	}
+
+	return d.Close()
+}
+
+// copySparse copies the data regions of s (of the given size) to d, leaving
+// holes where s has them. If the filesystem can't tell us where the holes
+// are, the whole file is copied.
+func copySparse(d *os.File, s *os.File, size int64) error {
+	var offset int64
+	for offset < size {
+		start, err := unix.Seek(int(s.Fd()), offset, seekData)
+		if err != nil {
+			if err == unix.ENXIO {
+				// Only a hole left.
+				break
+			}
+
+			if offset == 0 {
+				// SEEK_DATA isn't supported; copy the whole thing.
+				if _, err := s.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				_, err = io.Copy(d, s)
+				return err
+			}
+
+			return err
+		}
+
+		end, err := unix.Seek(int(s.Fd()), start, seekHole)
+		if err != nil {
+			return err
+		}
+
+		if _, err := d.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(d, io.NewSectionReader(s, start, end-start)); err != nil {
+			return err
+		}
+
+		offset = end
+	}
+
+	return d.Truncate(size)
+}
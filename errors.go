@@ -0,0 +1,110 @@
+package stacker
+
+// ErrorKind classifies why a build failed, so that callers (e.g. CI) can
+// tell a broken stackerfile or run section from a broken build machine.
+type ErrorKind int
+
+const (
+	// InternalError is anything not otherwise classified.
+	InternalError ErrorKind = iota
+
+	// UserError means the input was bad: an invalid stackerfile,
+	// substitution, or command line.
+	UserError
+
+	// EnvironmentError means the build machine is missing something
+	// stacker needs, like btrfs or user namespaces.
+	EnvironmentError
+
+	// RunError means a layer's run section failed.
+	RunError
+
+	// InterruptedError means the build was stopped by a signal (or its
+	// context being cancelled).
+	InterruptedError
+)
+
+// ExitCode is the exit code the stacker binary uses for errors of this kind.
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case UserError:
+		return 2
+	case EnvironmentError:
+		return 3
+	case RunError:
+		return 4
+	case InterruptedError:
+		return 130
+	default:
+		return 1
+	}
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case UserError:
+		return "user error"
+	case EnvironmentError:
+		return "environment error"
+	case RunError:
+		return "run error"
+	case InterruptedError:
+		return "interrupted"
+	default:
+		return "internal error"
+	}
+}
+
+type kindError struct {
+	kind ErrorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Cause() error {
+	return e.err
+}
+
+// WithKind marks err as being of the given kind; it returns nil if err is
+// nil. Errors that are already marked keep their original kind.
+func WithKind(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := findKind(err); ok {
+		return err
+	}
+
+	return &kindError{kind: kind, err: err}
+}
+
+func findKind(err error) (ErrorKind, bool) {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if ke, ok := err.(*kindError); ok {
+			return ke.kind, true
+		}
+
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+
+	return InternalError, false
+}
+
+// KindOf returns the kind err (or any error it wraps with
+// github.com/pkg/errors) was marked with, or InternalError.
+func KindOf(err error) ErrorKind {
+	kind, _ := findKind(err)
+	return kind
+}
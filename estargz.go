@@ -0,0 +1,343 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// These are the names and annotations of eStargz, as defined by
+// stargz-snapshotter's estargz package.
+const (
+	estargzTOCName          = "stargz.index.json"
+	estargzNoPrefetchName   = ".no.prefetch.landmark"
+	estargzPrefetchName     = ".prefetch.landmark"
+	estargzLandmarkContents = 0xf
+	estargzChunkSize        = 4 << 20
+
+	EstargzTOCDigestAnnotation        = "containerd.io/snapshot/stargz/toc.digest"
+	EstargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+)
+
+// isEstargz returns true if the layer desc is an eStargz layer.
+func isEstargz(desc ispec.Descriptor) bool {
+	_, ok := desc.Annotations[EstargzTOCDigestAnnotation]
+	return ok
+}
+
+// estargzEntry is an entry of an eStargz table of contents.
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+type estargzTOC struct {
+	Version int             `json:"version"`
+	Entries []*estargzEntry `json:"entries"`
+}
+
+// estargzWriter writes an eStargz blob: a gzip stream made of many gzip
+// members, so that each file's content (in chunks, for big files) can be
+// decompressed on its own, followed by a member with the table of contents
+// and a footer pointing to it. Decompressed as a whole, it is still a plain
+// tar stream.
+type estargzWriter struct {
+	out   *countingWriter
+	w     io.Writer
+	level int
+	gz    *gzip.Writer
+
+	// uncompressed is the digest and size of the decompressed stream.
+	uncompressed digest.Digester
+	size         *countingWriter
+
+	toc estargzTOC
+}
+
+func newEstargzWriter(w io.Writer, level int) *estargzWriter {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	counter := &countingWriter{}
+	return &estargzWriter{
+		out:          counter,
+		w:            io.MultiWriter(w, counter),
+		level:        level,
+		uncompressed: digest.Canonical.Digester(),
+		size:         &countingWriter{},
+		toc:          estargzTOC{Version: 1},
+	}
+}
+
+// Write writes to the current gzip member, starting one if needed.
+func (e *estargzWriter) Write(p []byte) (int, error) {
+	if e.gz == nil {
+		gz, err := gzip.NewWriterLevel(e.w, e.level)
+		if err != nil {
+			return 0, err
+		}
+		e.gz = gz
+	}
+
+	e.uncompressed.Hash().Write(p)
+	e.size.Write(p)
+	return e.gz.Write(p)
+}
+
+// closeMember ends the current gzip member, if there is one.
+func (e *estargzWriter) closeMember() error {
+	if e.gz == nil {
+		return nil
+	}
+
+	err := e.gz.Close()
+	e.gz = nil
+	return err
+}
+
+func estargzEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func estargzEntryType(typeflag byte) (string, error) {
+	switch typeflag {
+	case tar.TypeReg:
+		return "reg", nil
+	case tar.TypeDir:
+		return "dir", nil
+	case tar.TypeSymlink:
+		return "symlink", nil
+	case tar.TypeLink:
+		return "hardlink", nil
+	case tar.TypeChar:
+		return "char", nil
+	case tar.TypeBlock:
+		return "block", nil
+	case tar.TypeFifo:
+		return "fifo", nil
+	default:
+		return "", fmt.Errorf("unsupported tar entry type %q", typeflag)
+	}
+}
+
+// appendEntry writes the tar entry hdr, with content, as eStargz does: the
+// header goes in the current member, and each chunk of the content in a
+// member of its own, whose offset is recorded in the table of contents.
+func (e *estargzWriter) appendEntry(tw *tar.Writer, hdr *tar.Header, content io.Reader) error {
+	entryType, err := estargzEntryType(hdr.Typeflag)
+	if err != nil {
+		return errors.Wrapf(err, "%s", hdr.Name)
+	}
+
+	entry := &estargzEntry{
+		Name:     estargzEntryName(hdr.Name),
+		Type:     entryType,
+		ModTime:  hdr.ModTime.UTC().Format(time.RFC3339),
+		LinkName: hdr.Linkname,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		DevMajor: int(hdr.Devmajor),
+		DevMinor: int(hdr.Devminor),
+	}
+
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if entry.Xattrs == nil {
+				entry.Xattrs = map[string][]byte{}
+			}
+			entry.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = []byte(v)
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if entryType != "reg" || hdr.Size == 0 {
+		e.toc.Entries = append(e.toc.Entries, entry)
+		return tw.Flush()
+	}
+
+	entry.Size = hdr.Size
+	file := entry
+	fileDigester := digest.Canonical.Digester()
+	content = io.TeeReader(content, fileDigester.Hash())
+
+	for written := int64(0); written < hdr.Size; {
+		if err := e.closeMember(); err != nil {
+			return err
+		}
+
+		chunkSize := hdr.Size - written
+		if chunkSize > estargzChunkSize {
+			chunkSize = estargzChunkSize
+			entry.ChunkSize = chunkSize
+		}
+
+		entry.Offset = e.out.n
+		entry.ChunkOffset = written
+
+		chunkDigester := digest.Canonical.Digester()
+		if _, err := io.CopyN(tw, io.TeeReader(content, chunkDigester.Hash()), chunkSize); err != nil {
+			return errors.Wrapf(err, "couldn't write %s", hdr.Name)
+		}
+		entry.ChunkDigest = chunkDigester.Digest().String()
+
+		e.toc.Entries = append(e.toc.Entries, entry)
+		written += chunkSize
+		entry = &estargzEntry{Name: file.Name, Type: "chunk"}
+	}
+
+	file.Digest = fileDigester.Digest().String()
+	return tw.Flush()
+}
+
+// estargzFooter is the last member of an eStargz blob: an empty gzip member
+// whose extra field holds the offset of the table of contents. Readers expect
+// it to be exactly 51 bytes, i.e. for the empty content to be a stored deflate
+// block, which compress/flate doesn't guarantee, so it is put together by hand.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff}
+	footer = append(footer, 0, 0, 'S', 'G', 0, 0)
+	binary.LittleEndian.PutUint16(footer[10:], uint16(len(subfield)+4))
+	binary.LittleEndian.PutUint16(footer[14:], uint16(len(subfield)))
+	footer = append(footer, []byte(subfield)...)
+
+	// A final, empty stored block, and a CRC and size of 0.
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	return append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// writeEstargz converts the tar stream r to eStargz, writing it to w. It
+// returns the digest and size of the new blob's uncompressed content, which
+// differ from r's because of the landmark and table of contents entries, and
+// the digest of the table of contents.
+func writeEstargz(r io.Reader, w io.Writer, level int) (digest.Digest, int64, digest.Digest, error) {
+	e := newEstargzWriter(w, level)
+	tw := tar.NewWriter(e)
+
+	// Without a list of files to prefetch, eStargz wants this landmark
+	// first, so that lazy pulling snapshotters don't prefetch anything.
+	landmark := &tar.Header{Typeflag: tar.TypeReg, Name: estargzNoPrefetchName, Size: 1}
+	if err := e.appendEntry(tw, landmark, bytes.NewReader([]byte{estargzLandmarkContents})); err != nil {
+		return "", 0, "", err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", 0, "", errors.Wrapf(err, "couldn't read layer")
+		}
+
+		if err := e.appendEntry(tw, hdr, tr); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	if err := e.closeMember(); err != nil {
+		return "", 0, "", err
+	}
+
+	rawTOC, err := json.MarshalIndent(e.toc, "", "\t")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	tocOffset := e.out.n
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargzTOCName, Size: int64(len(rawTOC)), Mode: 0444}); err != nil {
+		return "", 0, "", err
+	}
+
+	if _, err := tw.Write(rawTOC); err != nil {
+		return "", 0, "", err
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", 0, "", err
+	}
+
+	if err := e.closeMember(); err != nil {
+		return "", 0, "", err
+	}
+
+	if _, err := e.w.Write(estargzFooter(tocOffset)); err != nil {
+		return "", 0, "", err
+	}
+
+	return e.uncompressed.Digest(), e.size.n, digest.FromBytes(rawTOC), nil
+}
+
+// withoutEstargzEntries filters the landmark and table of contents entries
+// out of the tar stream of an eStargz layer, so that recompressing it some
+// other way doesn't leave them in the image as files.
+func withoutEstargzEntries(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tr := tar.NewReader(r)
+		tw := tar.NewWriter(pw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			switch estargzEntryName(hdr.Name) {
+			case estargzTOCName, estargzNoPrefetchName, estargzPrefetchName:
+				continue
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			if _, err := io.Copy(tw, tr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		pw.CloseWithError(tw.Close())
+	}()
+
+	return pr
+}
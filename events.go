@@ -0,0 +1,61 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The kinds of BuildEvent.
+const (
+	EventImportStart = "import_start"
+	EventImportDone  = "import_done"
+	EventCacheHit    = "cache_hit"
+	EventRunStart    = "run_start"
+	EventRunDone     = "run_done"
+	EventRepackDone  = "repack_done"
+	EventLayerDone   = "layer_done"
+	EventBuildDone   = "build_done"
+	EventBuildFailed = "build_failed"
+)
+
+// BuildEvent is a machine readable record of a build phase transition.
+type BuildEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Layer  string    `json:"layer,omitempty"`
+	Digest string    `json:"digest,omitempty"`
+	Error  string    `json:"error,omitempty"`
+
+	// Size is the total size of the image's layers, for cache_hit and
+	// layer_done events.
+	Size int64 `json:"size,omitempty"`
+}
+
+// EventWriter writes BuildEvents as a stream of JSON objects, one per line.
+// A nil *EventWriter discards events, so callers don't have to check whether
+// events were requested.
+type EventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes ev, timestamping it if it doesn't have a time already.
+func (ew *EventWriter) Emit(ev BuildEvent) error {
+	if ew == nil {
+		return nil
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	return ew.enc.Encode(ev)
+}
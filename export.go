@@ -0,0 +1,99 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// exportDest fills in the reference of a docker-archive destination that
+// doesn't have one, so that "docker load" gives the image a name rather than
+// leaving it untagged.
+func exportDest(name string, dest string) string {
+	if !strings.HasPrefix(dest, "docker-archive:") {
+		return dest
+	}
+
+	if strings.Contains(strings.TrimPrefix(dest, "docker-archive:"), ":") {
+		return dest
+	}
+
+	return fmt.Sprintf("%s:%s:latest", dest, name)
+}
+
+// Export copies the image tagged name out of the OCI layout to dest, which
+// may be anything skopeo can copy to, e.g. docker-archive:img.tar for a
+// tarball that "docker load" understands, or oci-archive:img.tar.
+func Export(sc StackerConfig, name string, dest string) error {
+	dest = exportDest(name, dest)
+	log.Infof("exporting %s to %s", name, dest)
+
+	output, err := exec.Command(
+		"skopeo",
+		"--insecure-policy",
+		"copy",
+		fmt.Sprintf("oci:%s:%s", sc.OCIDir, name),
+		dest,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("skopeo copy %s to %s: %s: %s", name, dest, err, output)
+	}
+
+	return nil
+}
+
+const (
+	LoadContainerd = "containerd"
+	LoadPodman     = "podman"
+	LoadDocker     = "docker"
+)
+
+// Load copies the image tagged name into the local image store of a
+// container engine, as name:latest: podman's (via containers-storage),
+// docker's (via its daemon), or containerd's (via ctr, in the given
+// namespace).
+func Load(sc StackerConfig, name string, to string, namespace string) error {
+	switch to {
+	case LoadPodman:
+		return Export(sc, name, fmt.Sprintf("containers-storage:localhost/%s:latest", name))
+	case LoadDocker:
+		return Export(sc, name, fmt.Sprintf("docker-daemon:%s:latest", name))
+	case LoadContainerd:
+		// ctr can't read an OCI layout directly, so go via an
+		// archive.
+		if err := os.MkdirAll(sc.StackerDir, 0755); err != nil {
+			return err
+		}
+
+		f, err := ioutil.TempFile(sc.StackerDir, "load-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		// skopeo won't write to an existing archive.
+		os.Remove(f.Name())
+		if err := Export(sc, name, fmt.Sprintf("docker-archive:%s", f.Name())); err != nil {
+			return err
+		}
+
+		if namespace == "" {
+			namespace = "default"
+		}
+
+		log.Infof("importing %s into containerd namespace %s", name, namespace)
+		output, err := exec.Command("ctr", "-n", namespace, "images", "import", f.Name()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ctr images import: %s: %s", err, output)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown container engine %s", to)
+	}
+}
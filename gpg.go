@@ -0,0 +1,49 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// verifyImport checks the detached gpg signature of the import i, which was
+// acquired to p, against the import's keyring.
+func verifyImport(c StackerConfig, i ImportSpec, p string) error {
+	if err := gpgVerify(c, i.Signature, i.Keyring, p); err != nil {
+		return errors.Wrapf(err, "couldn't verify signature of %s", i.Path)
+	}
+
+	log.Infof("verified signature of %s", i.Path)
+	return nil
+}
+
+// gpgVerify checks p against the detached gpg signature at the path or url
+// signature with gpgv, trusting the keys in keyring.
+func gpgVerify(c StackerConfig, signature string, keyring string, p string) error {
+	sigDir := path.Join(c.StackerDir, "signatures")
+	if err := os.MkdirAll(sigDir, 0755); err != nil {
+		return err
+	}
+
+	sig, err := acquireUrl(c, signature, sigDir, DefaultSymlinks)
+	if err != nil {
+		return err
+	}
+
+	return gpgv(keyring, sig, p)
+}
+
+// gpgv checks p against the detached gpg signature file sig, trusting the keys
+// in keyring.
+func gpgv(keyring string, sig string, p string) error {
+	output, err := exec.Command("gpgv", "--keyring", keyring, sig, p).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(output))
+	}
+
+	return nil
+}
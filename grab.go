@@ -7,7 +7,7 @@ import (
 )
 
 func Grab(sc StackerConfig, name string, source string) error {
-	c, err := newContainer(sc, ".working")
+	c, err := newRunContainer(sc, ".working")
 	if err != nil {
 		return err
 	}
@@ -23,5 +23,5 @@ func Grab(sc StackerConfig, name string, source string) error {
 	}
 	defer os.Remove(path.Join(sc.RootFSDir, ".working", "rootfs", "stacker"))
 
-	return c.execute(fmt.Sprintf("cp -a %s /stacker", source), nil)
+	return c.execute(fmt.Sprintf("cp -a %s /stacker", source), nil, os.Stdout, os.Stderr)
 }
@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// HookInfo describes the layer a hook is run for; it is passed to the hook
+// as STACKER_* environment variables.
+type HookInfo struct {
+	// Hook is the kind of hook, i.e. "prebuild" or "postbuild".
+	Hook string
+
+	Layer string
+
+	// Tag is the tag of the image in the OCI layout.
+	Tag string
+
+	// Digest is the manifest digest of the built image; it is empty for
+	// prebuild hooks and build only layers.
+	Digest string
+}
+
+// RunHooks runs each of the hooks on the host with sh -c in the directory
+// dir, stopping at the first one that fails.
+func RunHooks(sc StackerConfig, hooks []string, dir string, info HookInfo) error {
+	env := append(os.Environ(),
+		fmt.Sprintf("STACKER_HOOK=%s", info.Hook),
+		fmt.Sprintf("STACKER_LAYER=%s", info.Layer),
+		fmt.Sprintf("STACKER_TAG=%s", info.Tag),
+		fmt.Sprintf("STACKER_DIGEST=%s", info.Digest),
+		fmt.Sprintf("STACKER_OCI_DIR=%s", sc.OCIDir),
+	)
+
+	for _, hook := range hooks {
+		log.Infof("running %s hook %s", info.Hook, hook)
+		cmd := exec.Command("sh", "-c", hook)
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "%s hook %s failed", info.Hook, hook)
+		}
+	}
+
+	return nil
+}
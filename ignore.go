@@ -0,0 +1,127 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StackerignoreFile is the name of the file in an imported directory that
+// lists (in gitignore syntax) what not to import from it.
+const StackerignoreFile = ".stackerignore"
+
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// ignoreMatcher matches paths against the patterns of a .stackerignore. As
+// in gitignore, later patterns override earlier ones, a leading ! re-includes
+// what an earlier pattern excluded, a trailing / only matches directories, a
+// pattern with a / in it is relative to the imported directory (and one
+// without matches at any depth), and ** matches any number of directories.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+func parseIgnorePatterns(content string) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		p.segments = strings.Split(line, "/")
+		if !anchored {
+			p.segments = append([]string{"**"}, p.segments...)
+		}
+
+		m.patterns = append(m.patterns, p)
+	}
+
+	return m
+}
+
+// readStackerignore reads the .stackerignore in dir, if there is one.
+func readStackerignore(dir string) (*ignoreMatcher, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, StackerignoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", StackerignoreFile)
+	}
+
+	return parseIgnorePatterns(string(content)), nil
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(pattern[0], segments[0])
+	if err != nil || !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// ignored returns true if rel, a path relative to the imported directory,
+// should be left out. A nil *ignoreMatcher ignores nothing.
+func (m *ignoreMatcher) ignored(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	segments := strings.Split(path.Clean(rel), "/")
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		if matchSegments(p.segments, segments) {
+			ignored = !p.negate
+		}
+	}
+
+	return ignored
+}
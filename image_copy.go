@@ -0,0 +1,275 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// copyEndpoint is one end of a CopyImage: an OCI layout or a registry
+// repository.
+type copyEndpoint interface {
+	manifest(reference string) ([]byte, string, error)
+	blob(d digest.Digest) (io.ReadCloser, error)
+	hasBlob(d digest.Digest) (bool, error)
+	putBlob(desc ispec.Descriptor, content io.Reader) error
+	putManifest(reference string, mediaType string, raw []byte) error
+	close() error
+}
+
+// layoutEndpoint is an OCI layout on disk.
+type layoutEndpoint struct {
+	dir string
+	oci *umoci.Layout
+}
+
+func (l *layoutEndpoint) manifest(reference string) ([]byte, string, error) {
+	d, err := digest.Parse(reference)
+	if err != nil {
+		desc, err := l.oci.LookupManifestDescriptor(reference)
+		if err != nil {
+			return nil, "", err
+		}
+		d = desc.Digest
+	}
+
+	raw, err := readLayoutBlob(l.dir, ispec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, "", err
+	}
+
+	mediaType, err := manifestMediaType(raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return raw, mediaType, nil
+}
+
+func (l *layoutEndpoint) blob(d digest.Digest) (io.ReadCloser, error) {
+	return os.Open(layoutBlobPath(l.dir, d))
+}
+
+func (l *layoutEndpoint) hasBlob(d digest.Digest) (bool, error) {
+	_, err := os.Stat(layoutBlobPath(l.dir, d))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// putBlob writes the blob to a temporary file first, and only renames it
+// into place once its digest has been checked.
+func (l *layoutEndpoint) putBlob(desc ispec.Descriptor, content io.Reader) error {
+	p := layoutBlobPath(l.dir, desc.Digest)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(path.Dir(p), ".partial-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	verifier := desc.Digest.Verifier()
+	_, err = io.Copy(io.MultiWriter(f, verifier), content)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s has bad digest", desc.Digest)
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+func (l *layoutEndpoint) putManifest(reference string, mediaType string, raw []byte) error {
+	desc, err := writeLayoutBlob(l.dir, mediaType, raw)
+	if err != nil {
+		return err
+	}
+
+	if _, err := digest.Parse(reference); err == nil {
+		return nil
+	}
+
+	return l.oci.UpdateReference(reference, desc)
+}
+
+func (l *layoutEndpoint) close() error {
+	return l.oci.Close()
+}
+
+// openCopyEndpoint opens an image reference as CopyImage understands them,
+// oci:<dir>:<tag> or docker://<image>, and returns it with the tag or digest
+// it refers to. A layout that will be written to is created if it doesn't
+// exist yet.
+func openCopyEndpoint(c StackerConfig, ref string, write bool) (copyEndpoint, string, error) {
+	if strings.HasPrefix(ref, "docker://") {
+		return newRegistryClient(c, ref, write)
+	}
+
+	if !strings.HasPrefix(ref, "oci:") {
+		return nil, "", fmt.Errorf("can't copy %s: only oci:<dir>:<tag> and docker:// are supported", ref)
+	}
+
+	spec := strings.TrimPrefix(ref, "oci:")
+	idx := strings.LastIndex(spec, ":")
+	if idx <= 0 || idx == len(spec)-1 {
+		return nil, "", fmt.Errorf("%s needs a tag, as oci:<dir>:<tag>", ref)
+	}
+	dir, tag := spec[:idx], spec[idx+1:]
+
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil && write && os.IsNotExist(errors.Cause(err)) {
+		oci, err = umoci.CreateLayout(dir)
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "couldn't open %s", dir)
+	}
+
+	return &layoutEndpoint{dir: dir, oci: oci}, tag, nil
+}
+
+// copyBlobs copies the blobs dest doesn't have yet from src, jobs at a time.
+func copyBlobs(src copyEndpoint, dest copyEndpoint, blobs []ispec.Descriptor, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	sem := make(chan struct{}, jobs)
+	errs := make(chan error, len(blobs))
+	wg := sync.WaitGroup{}
+	for _, desc := range blobs {
+		wg.Add(1)
+		go func(desc ispec.Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			errs <- copyBlob(src, dest, desc)
+		}(desc)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyBlob(src copyEndpoint, dest copyEndpoint, desc ispec.Descriptor) error {
+	has, err := dest.hasBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	if has {
+		log.Debugf("blob %s already exists", desc.Digest)
+		return nil
+	}
+
+	content, err := src.blob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	log.Infof("copying blob %s (%d bytes)", desc.Digest, desc.Size)
+	return dest.putBlob(desc, content)
+}
+
+// copyImageManifest copies the manifest (or index, and every manifest in it)
+// srcRef refers to, and the blobs they need, to destRef. The manifests are
+// copied byte for byte, so their digests stay the same.
+func copyImageManifest(src copyEndpoint, dest copyEndpoint, srcRef string, destRef string, jobs int) (digest.Digest, error) {
+	raw, mediaType, err := src.manifest(srcRef)
+	if err != nil {
+		return "", err
+	}
+
+	if isIndexMediaType(mediaType) {
+		index := ispec.Index{}
+		if err := json.Unmarshal(raw, &index); err != nil {
+			return "", errors.Wrapf(err, "bad index %s", srcRef)
+		}
+
+		for _, m := range index.Manifests {
+			if _, err := copyImageManifest(src, dest, m.Digest.String(), m.Digest.String(), jobs); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		found := false
+		for _, mt := range manifestMediaTypes {
+			found = found || mt == mediaType
+		}
+		if !found {
+			return "", fmt.Errorf("can't copy %s: unsupported manifest type %s", srcRef, mediaType)
+		}
+
+		manifest := ispec.Manifest{}
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return "", errors.Wrapf(err, "bad manifest %s", srcRef)
+		}
+
+		blobs := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+		if err := copyBlobs(src, dest, blobs, jobs); err != nil {
+			return "", err
+		}
+	}
+
+	if err := dest.putManifest(destRef, mediaType, raw); err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(raw), nil
+}
+
+// CopyImage copies an image between OCI layouts and registries, in either
+// direction: src and dest are oci:<dir>:<tag> or docker://<image>. Blobs the
+// destination already has are skipped, and the others are copied jobs at a
+// time. The manifests are not rewritten, so the image keeps its digest.
+func CopyImage(c StackerConfig, src string, dest string, jobs int) error {
+	srcEnd, srcRef, err := openCopyEndpoint(c, src, false)
+	if err != nil {
+		return err
+	}
+	defer srcEnd.close()
+
+	destEnd, destRef, err := openCopyEndpoint(c, dest, true)
+	if err != nil {
+		return err
+	}
+	defer destEnd.close()
+
+	d, err := copyImageManifest(srcEnd, destEnd, srcRef, destRef, jobs)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("copied %s to %s (%s)", src, dest, d)
+	return nil
+}
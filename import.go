@@ -1,41 +1,85 @@
 package stacker
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/apex/log"
+	"github.com/pkg/errors"
 	"github.com/udhos/equalfile"
 )
 
-func fileCopy(dest string, source string) error {
-	s, err := os.Open(source)
-	if err != nil {
-		return err
+// RunImportCmd runs the layer's import_cmd (if it has one) on the host with
+// sh -c, from the directory of its stackerfile, and adds each line of its
+// output to the layer's imports. Relative paths are taken to be relative to
+// the stackerfile's directory; blank lines and lines starting with # are
+// ignored.
+func (l *Layer) RunImportCmd(name string) error {
+	l.generatedImports = nil
+	if l.ImportCmd == "" {
+		return nil
 	}
-	defer s.Close()
 
-	fi, err := s.Stat()
+	dir := l.contextDir
+
+	log.Infof("running import_cmd %s", l.ImportCmd)
+	cmd := exec.Command("sh", "-c", l.ImportCmd)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("STACKER_LAYER=%s", name))
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "import_cmd %s failed", l.ImportCmd)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		u, err := url.Parse(line)
+		if err == nil && u.Scheme == "" && !path.IsAbs(line) {
+			line = path.Join(dir, line)
+		}
+
+		l.generatedImports = append(l.generatedImports, line)
 	}
 
-	d, err := os.Create(dest)
+	return scanner.Err()
+}
+
+// importName is the name the import imp is stored under in the imports dir,
+// i.e. what it's called in /stacker: the last element of its path, without
+// any query string if it is a url.
+func importName(imp string) string {
+	if u, err := url.Parse(imp); err == nil && u.Scheme != "" {
+		return path.Base(u.Path)
+	}
+
+	return path.Base(imp)
+}
+
+func fileCopy(dest string, source string) error {
+	fi, err := os.Stat(source)
 	if err != nil {
 		return err
 	}
-	defer d.Close()
 
-	err = d.Chmod(fi.Mode())
-	if err != nil {
+	if err := copyFileContents(dest, source, fi.Mode()); err != nil {
 		return err
 	}
 
-	_, err = io.Copy(d, s)
-	return err
+	return os.Chmod(dest, fi.Mode())
 }
 
 // filesDiffer returns true if the files are different, false if they are the same.
@@ -44,21 +88,26 @@ func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo) (bo
 		return false, fmt.Errorf("comparing files without the same name?")
 	}
 
+	// A symlink that became a file (or vice versa) needs copying again.
+	if (info1.Mode()&os.ModeSymlink != 0) != (info2.Mode()&os.ModeSymlink != 0) {
+		return true, nil
+	}
+
 	if info1.Mode()&os.ModeSymlink != 0 {
-		if info2.Mode()&os.ModeSymlink != 0 {
-			link1, err := os.Readlink(p1)
-			if err != nil {
-				return false, err
-			}
+		link1, err := os.Readlink(p1)
+		if err != nil {
+			return false, err
+		}
 
-			link2, err := os.Readlink(p2)
-			if err != nil {
-				return false, err
-			}
-			return link1 != link2, err
+		link2, err := os.Readlink(p2)
+		if err != nil {
+			return false, err
 		}
+		return link1 != link2, err
+	}
 
-		return false, fmt.Errorf("symlink -> not symlink not supported")
+	if !info1.Mode().IsRegular() || !info2.Mode().IsRegular() {
+		return info1.Mode().IsRegular() != info2.Mode().IsRegular(), nil
 	}
 
 	if info1.Size() != info2.Size() {
@@ -85,27 +134,42 @@ func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo) (bo
 	return !eq, nil
 }
 
-func importFile(imp string, cacheDir string) (string, error) {
-	e1, err := os.Stat(imp)
+func importFile(imp string, cacheDir string, symlinks SymlinkPolicy) (string, error) {
+	dest := path.Join(cacheDir, path.Base(imp))
+
+	stat := os.Stat
+	if symlinks == PreserveSymlinks {
+		stat = os.Lstat
+	}
+
+	e1, err := stat(imp)
 	if err != nil {
 		return "", err
 	}
 
 	if e1.IsDir() {
-		binary := "cp"
-		if haveRsync() == nil {
-			binary = "rsync"
-		}
-		output, err := exec.Command(binary, "-a", imp, cacheDir).CombinedOutput()
+		ignore, err := readStackerignore(imp)
 		if err != nil {
-			return "", fmt.Errorf("%s", string(output))
+			return "", err
 		}
-		return path.Join(cacheDir, path.Base(imp)), nil
+
+		src := imp
+		if symlinks == FollowSymlinks {
+			src, err = filepath.EvalSymlinks(imp)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		opts := copyOpts{skip: ignore.ignored, followSymlinks: symlinks == FollowSymlinks}
+		if err := copyTreeWith(dest, src, opts); err != nil {
+			return "", errors.Wrapf(err, "couldn't import %s", imp)
+		}
+		return dest, nil
 	}
 
 	needsCopy := false
-	dest := path.Join(cacheDir, path.Base(imp))
-	e2, err := os.Stat(dest)
+	e2, err := os.Lstat(dest)
 	if err != nil {
 		needsCopy = true
 	} else {
@@ -118,18 +182,36 @@ func importFile(imp string, cacheDir string) (string, error) {
 	}
 
 	if needsCopy {
-		fmt.Printf("copying %s\n", imp)
-		if err := fileCopy(dest, imp); err != nil {
+		log.Infof("copying %s", imp)
+
+		// Don't write through whatever was there before, e.g. a
+		// symlink from a previous import.
+		if err := os.RemoveAll(dest); err != nil {
+			return "", err
+		}
+
+		if e1.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(imp)
+			if err != nil {
+				return "", err
+			}
+
+			if err := os.Symlink(link, dest); err != nil {
+				return "", err
+			}
+		} else if err := fileCopy(dest, imp); err != nil {
 			return "", err
 		}
 	} else {
-		fmt.Println("using cached copy of", imp)
+		log.Infof("using cached copy of %s", imp)
 	}
 
 	return dest, nil
 }
 
-func acquireUrl(c StackerConfig, i string, cache string) (string, error) {
+// acquireUrl gets the import i into cache; symlinks only matters for local
+// paths.
+func acquireUrl(c StackerConfig, i string, cache string, symlinks SymlinkPolicy) (string, error) {
 	url, err := url.Parse(i)
 	if err != nil {
 		return "", err
@@ -137,30 +219,128 @@ func acquireUrl(c StackerConfig, i string, cache string) (string, error) {
 
 	// It's just a path, let's copy it to .stacker.
 	if url.Scheme == "" {
-		return importFile(i, cache)
-	} else if url.Scheme == "http" || url.Scheme == "https" {
-		// otherwise, we need to download it
-		return download(cache, i)
-	} else if url.Scheme == "stacker" {
-		p := path.Join(c.RootFSDir, url.Host, "rootfs", url.Path)
-		return importFile(p, cache)
+		return importFile(i, cache, symlinks)
+	}
+
+	h, err := importHandler(url.Scheme)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't import %s", i)
+	}
+
+	if c.ImportCAS != "" && isRemoteImport(i) {
+		return acquireWithCAS(c, h, url, cache)
 	}
 
-	return "", fmt.Errorf("unsupported url scheme %s", i)
+	return h.Acquire(c, url, cache)
+}
+
+func Import(c StackerConfig, name string, imports []ImportSpec) error {
+	return importShared(c, name, imports, nil, nil)
 }
 
-func Import(c StackerConfig, name string, imports []string) error {
+// sharedImport is a file a layer imported, and its digest when it was
+// imported, i.e. before that layer's run section had a chance to change it.
+type sharedImport struct {
+	path   string
+	digest string
+}
+
+// importShared imports the layer name's imports, like Import. shared maps the
+// imports that other layers of the same build already imported to where they
+// are; files that are in it, and haven't been changed since, are copied
+// (reflinked, where possible) from there, rather than being downloaded or
+// copied from their source again, and the files this layer imports are added
+// to it. shared may be nil. Besides the imports, the files named in others
+// aren't removed from the imports dir as stale.
+func importShared(c StackerConfig, name string, imports []ImportSpec, shared map[string]sharedImport, others []string) error {
 	dir := path.Join(c.StackerDir, "imports", name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
+	// The run script is in there too, but it's rewritten for each run.
+	keep := map[string]bool{".stacker-run.sh": true}
+	for _, o := range others {
+		keep[o] = true
+	}
 	for _, i := range imports {
-		_, err := acquireUrl(c, i, dir)
+		var p string
+		var err error
+		if src, ok := shared[i.Path]; ok && sharedUnchanged(src) {
+			p = path.Join(dir, path.Base(src.path))
+			log.Infof("using %s from %s", i.Path, src.path)
+			err = cloneOrCopy(src.path, p)
+		} else {
+			p, err = acquireImport(c, i, dir)
+		}
 		if err != nil {
 			return err
 		}
+
+		keep[path.Base(p)] = true
+
+		if i.Signature != "" {
+			if err := verifyImport(c, i, p); err != nil {
+				// Don't leave the unverified file around to be
+				// picked up as a cached copy next time.
+				os.RemoveAll(p)
+				return err
+			}
+		}
+
+		if i.Checksums != "" {
+			if err := verifyChecksums(c, i, p); err != nil {
+				os.RemoveAll(p)
+				return err
+			}
+		}
+
+		// Only files are shared; directories are reflinked where
+		// possible anyway.
+		if fi, err := os.Lstat(p); err == nil && fi.Mode().IsRegular() && shared != nil {
+			digest, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			shared[i.Path] = sharedImport{path: p, digest: digest}
+		}
+	}
+
+	return removeStaleImports(dir, keep)
+}
+
+// sharedUnchanged returns true if the shared import is still what was
+// imported, i.e. the run section of the layer that imported it didn't change
+// it, since its imports dir is mounted read-write.
+func sharedUnchanged(src sharedImport) bool {
+	digest, err := hashFile(src.path)
+	if err != nil || digest != src.digest {
+		log.Infof("%s was changed after it was imported, not sharing it", src.path)
+		return false
+	}
+
+	return true
+}
+
+// removeStaleImports removes everything in the imports dir that isn't in
+// keep, i.e. what was imported by previous builds but has since been removed
+// from the layer's imports, so it doesn't linger in /stacker or use disk.
+func removeStaleImports(dir string, keep map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+
+		log.Infof("removing %s, which is no longer imported", e.Name())
+		if err := os.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			return errors.Wrapf(err, "couldn't remove stale import %s", e.Name())
+		}
 	}
 
 	return nil
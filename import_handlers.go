@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// ImportHandler fetches imports whose urls have a particular scheme.
+type ImportHandler interface {
+	// Acquire fetches the import at u into the directory cacheDir, and
+	// returns its path there, which must be path.Join(cacheDir,
+	// path.Base(u.Path)). If there is already a copy there, handlers
+	// should only update it if the source changed.
+	Acquire(c StackerConfig, u *url.URL, cacheDir string) (string, error)
+}
+
+// ImportHandlerFunc adapts a function to an ImportHandler.
+type ImportHandlerFunc func(c StackerConfig, u *url.URL, cacheDir string) (string, error)
+
+func (f ImportHandlerFunc) Acquire(c StackerConfig, u *url.URL, cacheDir string) (string, error) {
+	return f(c, u, cacheDir)
+}
+
+var (
+	importHandlersLock sync.RWMutex
+	importHandlers     = map[string]ImportHandler{}
+)
+
+// RegisterImportHandler makes imports with the url scheme use h. Registering
+// a handler for a scheme that already has one replaces it.
+func RegisterImportHandler(scheme string, h ImportHandler) {
+	importHandlersLock.Lock()
+	defer importHandlersLock.Unlock()
+	importHandlers[scheme] = h
+}
+
+// importHandler returns the handler for scheme: a registered one if there is
+// one, otherwise a stacker-import-<scheme> plugin binary in $PATH.
+func importHandler(scheme string) (ImportHandler, error) {
+	importHandlersLock.RLock()
+	h, ok := importHandlers[scheme]
+	importHandlersLock.RUnlock()
+	if ok {
+		return h, nil
+	}
+
+	plugin, err := exec.LookPath(fmt.Sprintf("stacker-import-%s", scheme))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported url scheme %s", scheme)
+	}
+
+	return pluginImportHandler(plugin), nil
+}
+
+// pluginImportHandler runs the plugin binary as `plugin <url> <dest>`; it
+// should write the import to dest and exit 0, or exit non-zero with an error
+// on stderr.
+func pluginImportHandler(plugin string) ImportHandler {
+	return ImportHandlerFunc(func(c StackerConfig, u *url.URL, cacheDir string) (string, error) {
+		dest := path.Join(cacheDir, path.Base(u.Path))
+		log.Infof("importing %s with %s", u, plugin)
+		output, err := exec.Command(plugin, u.String(), dest).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%s %s: %s: %s", plugin, u, err, string(output))
+		}
+
+		return dest, nil
+	})
+}
+
+func acquireHTTP(c StackerConfig, u *url.URL, cacheDir string) (string, error) {
+	name, err := download(c, cacheDir, u.String())
+	if err != nil {
+		return "", err
+	}
+
+	if c.Lock != nil {
+		h, err := hashFile(name)
+		if err != nil {
+			return "", err
+		}
+
+		if err := c.Lock.VerifyImport(u.String(), h); err != nil {
+			return "", err
+		}
+	}
+
+	return name, nil
+}
+
+func acquireStacker(c StackerConfig, u *url.URL, cacheDir string) (string, error) {
+	p := path.Join(c.RootFSDir, u.Host, "rootfs", u.Path)
+	return importFile(p, cacheDir, DefaultSymlinks)
+}
+
+func init() {
+	RegisterImportHandler("http", ImportHandlerFunc(acquireHTTP))
+	RegisterImportHandler("https", ImportHandlerFunc(acquireHTTP))
+	RegisterImportHandler("stacker", ImportHandlerFunc(acquireStacker))
+	RegisterImportHandler("sftp", ImportHandlerFunc(acquireSFTP))
+	RegisterImportHandler("scp", ImportHandlerFunc(acquireSFTP))
+}
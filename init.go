@@ -0,0 +1,89 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// InitOpts are the options for GenerateStackerfile.
+type InitOpts struct {
+	// Name is the name of the layer.
+	Name string
+
+	// From is the base image: a docker reference like ubuntu:20.04 (or a
+	// docker:// url), a tarball path or url, oci:<layout>:<tag>, or
+	// scratch.
+	From string
+}
+
+// InitBase guesses what kind of base from (see InitOpts.From) is.
+func InitBase(from string) ImageSource {
+	switch {
+	case from == "scratch":
+		return ImageSource{Type: ScratchType}
+	case strings.HasPrefix(from, "oci:"):
+		return ImageSource{Type: OCIType, Url: strings.TrimPrefix(from, "oci:")}
+	case strings.HasSuffix(from, ".tar") || strings.HasSuffix(from, ".tar.gz") || strings.HasSuffix(from, ".tgz"):
+		return ImageSource{Type: TarType, Url: from}
+	case strings.Contains(from, "://"):
+		return ImageSource{Type: DockerType, Url: from}
+	default:
+		return ImageSource{Type: DockerType, Url: "docker://" + from}
+	}
+}
+
+var stackerfileTemplate = template.Must(template.New("stacker.yaml").Parse(`# See doc/stacker_yaml.md for everything that can go in here.
+{{.Name}}:
+    from:
+        type: {{.Base.Type}}
+{{- if .Base.Url}}
+        url: {{.Base.Url}}
+{{- end}}
+    # Files and urls listed in import are available in /stacker during run,
+    # e.g.:
+    # import:
+    #     - ./src
+    #     - https://example.com/release.tar.gz
+{{- if ne .Base.Type "scratch"}}
+    run: |
+        # The commands that set up the image go here, e.g.:
+        # cp -a /stacker/src /opt/{{.Name}}
+        echo "building {{.Name}}"
+{{- end}}
+    labels:
+        org.opencontainers.image.title: {{.Name}}
+`))
+
+// GenerateStackerfile returns a starter stackerfile for a layer with the
+// given name and base, with examples of the commonly used directives.
+func GenerateStackerfile(opts InitOpts) (string, error) {
+	if opts.Name == "" || strings.ContainsAny(opts.Name, ": \t\n") {
+		return "", fmt.Errorf("invalid layer name %q", opts.Name)
+	}
+
+	if opts.From == "" {
+		return "", fmt.Errorf("no base image")
+	}
+
+	buf := &bytes.Buffer{}
+	err := stackerfileTemplate.Execute(buf, struct {
+		Name string
+		Base ImageSource
+	}{opts.Name, InitBase(opts.From)})
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// DefaultStackerignore is the .stackerignore that stacker init generates: it
+// keeps stacker's own output, and version control metadata, out of imports of
+// the project directory.
+const DefaultStackerignore = `.stacker
+oci
+roots
+.git
+`
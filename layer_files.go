@@ -0,0 +1,203 @@
+package stacker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerFile is an entry in a layer's tar stream.
+type LayerFile struct {
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Uid      int         `json:"uid"`
+	Gid      int         `json:"gid"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+// FindLayer returns the descriptor of one of the layers of the image tagged
+// name. layer is either its index in the manifest, or (a unique prefix of)
+// its digest, with or without the algorithm.
+func FindLayer(oci *umoci.Layout, name string, layer string) (ispec.Descriptor, error) {
+	man, err := oci.LookupManifest(name)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if i, err := strconv.Atoi(layer); err == nil {
+		if i < 0 || i >= len(man.Layers) {
+			return ispec.Descriptor{}, fmt.Errorf("%s has %d layers, no layer %d", name, len(man.Layers), i)
+		}
+		return man.Layers[i], nil
+	}
+
+	found := []ispec.Descriptor{}
+	for _, l := range man.Layers {
+		if strings.HasPrefix(l.Digest.String(), layer) || strings.HasPrefix(l.Digest.Hex(), layer) {
+			found = append(found, l)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return ispec.Descriptor{}, fmt.Errorf("%s has no layer %s", name, layer)
+	case 1:
+		return found[0], nil
+	default:
+		return ispec.Descriptor{}, fmt.Errorf("layer %s of %s is ambiguous", layer, name)
+	}
+}
+
+// ListLayerFiles calls fn with each entry of the layer blob desc in the
+// layout, in the order they appear in the blob. Whiteouts are listed as they
+// are, i.e. as .wh. files.
+func ListLayerFiles(ociDir string, desc ispec.Descriptor, fn func(LayerFile) error) error {
+	blob, err := os.Open(layoutBlobPath(ociDir, desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	uncompressed, err := decompressor(desc.MediaType, blob)
+	if err != nil {
+		return err
+	}
+	defer uncompressed.Close()
+
+	tr := tar.NewReader(uncompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(LayerFile{
+			Path:     hdr.Name,
+			Size:     hdr.Size,
+			Mode:     hdr.FileInfo().Mode(),
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Linkname: hdr.Linkname,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadImageFile returns the content of the file at p in the image tagged name,
+// as it would be in its unpacked rootfs. If there is no such file, the error
+// satisfies os.IsNotExist.
+func ReadImageFile(ociDir string, oci *umoci.Layout, name string, p string) ([]byte, error) {
+	man, err := oci.LookupManifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return readLayersFile(ociDir, man.Layers, p)
+}
+
+// readLayersFile looks for p in layers, from the top one down, respecting
+// whiteouts and following hardlinks.
+func readLayersFile(ociDir string, layers []ispec.Descriptor, p string) ([]byte, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	notExist := &os.PathError{Op: "open", Path: "/" + p, Err: os.ErrNotExist}
+	seen := map[string]bool{p: true}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		content, link, found, hidden, err := readLayerFile(ociDir, layers[i], p)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			return content, nil
+		}
+
+		if link != "" {
+			if seen[link] {
+				return nil, fmt.Errorf("hardlink loop at /%s", link)
+			}
+			seen[link] = true
+
+			// The target of a hardlink comes before it in the
+			// same layer, or is in a lower one, so look for it
+			// again starting from this layer.
+			p = link
+			i++
+			continue
+		}
+
+		if hidden {
+			return nil, notExist
+		}
+	}
+
+	return nil, notExist
+}
+
+// readLayerFile looks for p in the layer desc. If it is a hardlink, link is
+// what it links to; if it is deleted by a whiteout in the layer, hidden is
+// true.
+func readLayerFile(ociDir string, desc ispec.Descriptor, p string) ([]byte, string, bool, bool, error) {
+	blob, err := os.Open(layoutBlobPath(ociDir, desc.Digest))
+	if err != nil {
+		return nil, "", false, false, err
+	}
+	defer blob.Close()
+
+	uncompressed, err := decompressor(desc.MediaType, blob)
+	if err != nil {
+		return nil, "", false, false, err
+	}
+	defer uncompressed.Close()
+
+	hidden := false
+	tr := tar.NewReader(uncompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, "", false, hidden, nil
+		}
+		if err != nil {
+			return nil, "", false, false, err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case name == p && hdr.Typeflag == tar.TypeLink:
+			return nil, strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/"), false, false, nil
+		case name == p:
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				return nil, "", false, false, fmt.Errorf("/%s isn't a regular file", p)
+			}
+
+			content, err := ioutil.ReadAll(tr)
+			return content, "", true, false, err
+		case base == ".wh..wh..opq" && (dir == "" || strings.HasPrefix(p, dir+"/")):
+			// Lower layers' contents of an ancestor are hidden,
+			// but this layer may still have the file.
+			hidden = true
+		case strings.HasPrefix(base, ".wh."):
+			deleted := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+			if deleted == p || strings.HasPrefix(p, deleted+"/") {
+				hidden = true
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestListLayerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "etc/issue", Typeflag: tar.TypeSymlink, Linkname: "motd"})
+	tw.Close()
+	gz.Close()
+
+	desc, err := writeLayoutBlob(dir, ispec.MediaTypeImageLayerGzip, buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	files := []LayerFile{}
+	err = ListLayerFiles(dir, desc, func(f LayerFile) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("couldn't list files: %s", err)
+	}
+
+	if len(files) != 3 {
+		t.Fatalf("bad files %v", files)
+	}
+
+	if !files[0].Mode.IsDir() || files[1].Size != 5 || files[1].Mode.Perm() != 0644 {
+		t.Fatalf("bad files %v", files)
+	}
+
+	if files[2].Mode&os.ModeSymlink == 0 || files[2].Linkname != "motd" {
+		t.Fatalf("bad symlink %v", files[2])
+	}
+}
+
+func TestReadLayersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := func(files map[string]string, links map[string]string) ispec.Descriptor {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for name, content := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+			tw.Write([]byte(content))
+		}
+		for name, target := range links {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target})
+		}
+		tw.Close()
+
+		desc, err := writeLayoutBlob(dir, ispec.MediaTypeImageLayer, buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return desc
+	}
+
+	layers := []ispec.Descriptor{
+		layer(map[string]string{"etc/motd": "old", "etc/issue": "issue", "opt/a": "a", "usr/lib/old": "lower"}, nil),
+		layer(map[string]string{"etc/motd": "new", "etc/.wh.issue": "", "opt/.wh..wh..opq": "", "usr/bin/a": "linked"},
+			map[string]string{"usr/bin/b": "usr/bin/a", "usr/lib/new": "/usr/lib/old", "loop": "loop"}),
+	}
+
+	content, err := readLayersFile(dir, layers, "/etc/motd")
+	if err != nil || string(content) != "new" {
+		t.Fatalf("bad /etc/motd %s: %v", string(content), err)
+	}
+
+	for p, expected := range map[string]string{"/usr/bin/b": "linked", "/usr/lib/new": "lower"} {
+		content, err := readLayersFile(dir, layers, p)
+		if err != nil || string(content) != expected {
+			t.Fatalf("hardlink %s not followed: %s: %v", p, string(content), err)
+		}
+	}
+
+	if _, err := readLayersFile(dir, layers, "/loop"); err == nil {
+		t.Fatalf("hardlink loop followed")
+	}
+
+	for _, p := range []string{"/etc/issue", "/opt/a", "/nope"} {
+		if _, err := readLayersFile(dir, layers, p); !os.IsNotExist(err) {
+			t.Fatalf("%s wasn't deleted: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci"
+)
+
+// largestFiles is how many of a layer's largest files are listed when it is
+// over its size budget.
+const largestFiles = 10
+
+// ParseMaxSize returns the layer's size budget in bytes, or 0 if it doesn't
+// have one.
+func (l *Layer) ParseMaxSize() (int64, error) {
+	if l.MaxSize == "" {
+		return 0, nil
+	}
+
+	size, err := units.RAMInBytes(l.MaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max_size: %s", err)
+	}
+
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid max_size %s", l.MaxSize)
+	}
+
+	return size, nil
+}
+
+// checkLayerSize returns an error listing the largest files of the layer
+// just generated for the image tagged name if its blob is bigger than max.
+func checkLayerSize(ociDir string, oci *umoci.Layout, name string, max int64) error {
+	man, err := oci.LookupManifest(name)
+	if err != nil {
+		return err
+	}
+
+	if len(man.Layers) == 0 {
+		return nil
+	}
+
+	desc := man.Layers[len(man.Layers)-1]
+	if desc.Size <= max {
+		return nil
+	}
+
+	files := []LayerFile{}
+	err = ListLayerFiles(ociDir, desc, func(f LayerFile) error {
+		if f.Mode.IsRegular() {
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	if len(files) > largestFiles {
+		files = files[:largestFiles]
+	}
+
+	largest := []string{}
+	for _, f := range files {
+		largest = append(largest, fmt.Sprintf("%s (%s)", f.Path, units.HumanSize(float64(f.Size))))
+	}
+
+	return fmt.Errorf("%s's layer is %s, over its max_size of %s; its largest files are: %s",
+		name, units.HumanSize(float64(desc.Size)), units.HumanSize(float64(max)), strings.Join(largest, ", "))
+}
+
+// layerAntipatterns are things that often end up in layers by accident, and
+// just make images bigger.
+var layerAntipatterns = []struct {
+	what    string
+	pattern *regexp.Regexp
+}{
+	{"apt cache", regexp.MustCompile(`^var/cache/apt/|^var/lib/apt/lists/`)},
+	{"yum/dnf cache", regexp.MustCompile(`^var/cache/(yum|dnf)/`)},
+	{"apk cache", regexp.MustCompile(`^var/cache/apk/`)},
+	{"pip cache", regexp.MustCompile(`(^|/)\.cache/pip/`)},
+	{"npm cache", regexp.MustCompile(`(^|/)\.npm/_cacache/`)},
+	{"go build cache", regexp.MustCompile(`(^|/)\.cache/go-build/`)},
+	// Processes in run sections start in /, so that's where they dump
+	// core; other files called core are often legitimate.
+	{"core dump", regexp.MustCompile(`^core(\.[0-9]+)?$`)},
+}
+
+// layerFileWarnings returns warnings about the files of a layer: ones that
+// are at least largeFile bytes, and package manager caches and core dumps.
+func layerFileWarnings(files []LayerFile, largeFile int64) []string {
+	warnings := []string{}
+	sizes := map[string]int64{}
+	counts := map[string]int{}
+
+outer:
+	for _, f := range files {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+
+		p := strings.TrimPrefix(path.Clean(f.Path), "/")
+		for _, a := range layerAntipatterns {
+			if a.pattern.MatchString(p) {
+				sizes[a.what] += f.Size
+				counts[a.what]++
+				continue outer
+			}
+		}
+
+		if f.Size >= largeFile {
+			warnings = append(warnings, fmt.Sprintf("/%s is %s", p, units.HumanSize(float64(f.Size))))
+		}
+	}
+
+	for _, a := range layerAntipatterns {
+		if counts[a.what] > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: %d file(s), %s",
+				a.what, counts[a.what], units.HumanSize(float64(sizes[a.what]))))
+		}
+	}
+
+	return warnings
+}
+
+// layerWarnings returns the layerFileWarnings of the layer just generated for
+// the image tagged name.
+func layerWarnings(ociDir string, oci *umoci.Layout, name string, largeFile int64) ([]string, error) {
+	man, err := oci.LookupManifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(man.Layers) == 0 {
+		return nil, nil
+	}
+
+	files := []LayerFile{}
+	err = ListLayerFiles(ociDir, man.Layers[len(man.Layers)-1], func(f LayerFile) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return layerFileWarnings(files, largeFile), nil
+}
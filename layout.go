@@ -0,0 +1,305 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DockerHealthcheck is the healthcheck as docker stores it in the image
+// config. The OCI image spec has no equivalent, so we write it into the
+// config blob ourselves; docker and podman both honor it.
+type DockerHealthcheck struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+func layoutBlobPath(ociDir string, d digest.Digest) string {
+	return path.Join(ociDir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func readLayoutBlob(ociDir string, desc ispec.Descriptor) ([]byte, error) {
+	content, err := ioutil.ReadFile(layoutBlobPath(ociDir, desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	if digest.FromBytes(content) != desc.Digest {
+		return nil, errors.Errorf("blob %s has bad digest", desc.Digest)
+	}
+
+	return content, nil
+}
+
+func writeLayoutBlob(ociDir string, mediaType string, content []byte) (ispec.Descriptor, error) {
+	desc := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+
+	p := layoutBlobPath(ociDir, desc.Digest)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := ioutil.WriteFile(p, content, 0644); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// moveLayoutBlob moves the file p, which must be on the same filesystem as
+// the layout (e.g. in a temporary dir in its blobs dir), into the layout as
+// a blob with the given media type. Unlike writeLayoutBlob, the content is
+// never all in memory.
+func moveLayoutBlob(ociDir string, mediaType string, p string) (ispec.Descriptor, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer f.Close()
+
+	d, err := digest.Canonical.FromReader(f)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    d,
+		Size:      fi.Size(),
+	}
+
+	blob := layoutBlobPath(ociDir, desc.Digest)
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := os.Chmod(p, 0644); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := os.Rename(p, blob); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// removeUnusedBlobs removes the blobs digests from the layout, unless an
+// image tagged in it still refers to them.
+func removeUnusedBlobs(ociDir string, oci *umoci.Layout, digests []digest.Digest) error {
+	if len(digests) == 0 {
+		return nil
+	}
+
+	tags, err := oci.ListTags()
+	if err != nil {
+		return err
+	}
+
+	used := map[digest.Digest]bool{}
+	for _, tag := range tags {
+		desc, err := oci.LookupManifestDescriptor(tag)
+		if err != nil {
+			return err
+		}
+
+		// If we can't tell what an image uses, it could be anything.
+		if err := markUsedBlobs(ociDir, desc, used); err != nil {
+			log.Warnf("not removing unused blobs: couldn't read %s: %v", tag, err)
+			return nil
+		}
+	}
+
+	for _, d := range digests {
+		if used[d] {
+			continue
+		}
+
+		if err := os.Remove(layoutBlobPath(ociDir, d)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markUsedBlobs adds the manifest or index desc, and everything it refers to,
+// to used.
+func markUsedBlobs(ociDir string, desc ispec.Descriptor, used map[digest.Digest]bool) error {
+	if used[desc.Digest] {
+		return nil
+	}
+	used[desc.Digest] = true
+
+	raw, err := readLayoutBlob(ociDir, desc)
+	if err != nil {
+		return err
+	}
+
+	mediaType, err := manifestMediaType(raw)
+	if err != nil {
+		return err
+	}
+
+	if isIndexMediaType(mediaType) {
+		index := ispec.Index{}
+		if err := json.Unmarshal(raw, &index); err != nil {
+			return err
+		}
+
+		for _, m := range index.Manifests {
+			if err := markUsedBlobs(ociDir, m, used); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return err
+	}
+
+	used[manifest.Config.Digest] = true
+	for _, layer := range manifest.Layers {
+		used[layer.Digest] = true
+	}
+
+	return nil
+}
+
+// marshalBlob is json.Marshal without the HTML escaping, so that things like
+// "<" in labels are left as-is in the blob.
+func marshalBlob(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// UpdateManifest rewrites the manifest of the image tagged name by calling
+// mutate on it. The new manifest is written to the layout, the tag is
+// updated, and the new manifest descriptor is returned.
+func UpdateManifest(ociDir string, oci *umoci.Layout, name string, mutate func(*ispec.Manifest) error) (ispec.Descriptor, error) {
+	return copyManifest(ociDir, oci, name, name, mutate)
+}
+
+// copyManifest is like UpdateManifest, but tags the new manifest as newName,
+// leaving name as it was.
+func copyManifest(ociDir string, oci *umoci.Layout, name string, newName string, mutate func(*ispec.Manifest) error) (ispec.Descriptor, error) {
+	manifestDesc, err := oci.LookupManifestDescriptor(name)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	rawManifest, err := readLayoutBlob(ociDir, manifestDesc)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := mutate(&manifest); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	rawManifest, err = marshalBlob(manifest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	newDesc, err := writeLayoutBlob(ociDir, manifestDesc.MediaType, rawManifest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	newDesc.Annotations = manifestDesc.Annotations
+	newDesc.Platform = manifestDesc.Platform
+
+	if err := oci.UpdateReference(newName, newDesc); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return newDesc, nil
+}
+
+// UpdateRawConfig rewrites the config of the image tagged name by calling
+// mutate on the raw (i.e. map, not ispec.Image, so that non-OCI fields like
+// docker's Healthcheck survive) decoding of it. The manifest is rewritten to
+// point to the new config, the tag is updated, and the new manifest
+// descriptor is returned.
+func UpdateRawConfig(ociDir string, oci *umoci.Layout, name string, mutate func(map[string]interface{}) error) (ispec.Descriptor, error) {
+	return UpdateManifest(ociDir, oci, name, func(manifest *ispec.Manifest) error {
+		rawConfig, err := readLayoutBlob(ociDir, manifest.Config)
+		if err != nil {
+			return err
+		}
+
+		config := map[string]interface{}{}
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return err
+		}
+
+		if err := mutate(config); err != nil {
+			return err
+		}
+
+		rawConfig, err = marshalBlob(config)
+		if err != nil {
+			return err
+		}
+
+		manifest.Config, err = writeLayoutBlob(ociDir, manifest.Config.MediaType, rawConfig)
+		return err
+	})
+}
+
+// SetHealthcheck sets the docker healthcheck of the image tagged name.
+func SetHealthcheck(ociDir string, oci *umoci.Layout, name string, hc *DockerHealthcheck) (ispec.Descriptor, error) {
+	return UpdateRawConfig(ociDir, oci, name, func(config map[string]interface{}) error {
+		imageConfig, ok := config["config"].(map[string]interface{})
+		if !ok {
+			imageConfig = map[string]interface{}{}
+			config["config"] = imageConfig
+		}
+
+		imageConfig["Healthcheck"] = hc
+		return nil
+	})
+}
+
+// SetVariant sets the architecture variant (e.g. v8) of the image tagged name.
+// It isn't in the image-spec's Image struct, so it is set in the raw config.
+func SetVariant(ociDir string, oci *umoci.Layout, name string, variant string) (ispec.Descriptor, error) {
+	return UpdateRawConfig(ociDir, oci, name, func(config map[string]interface{}) error {
+		config["variant"] = variant
+		return nil
+	})
+}
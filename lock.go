@@ -0,0 +1,198 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Lockfile records the digests that the mutable references in a stackerfile
+// (docker tags, http imports) resolved to, so that subsequent builds use
+// exactly the same inputs until the lock is explicitly updated.
+type Lockfile struct {
+	path string
+
+	// Bases is a map of the url of a docker base to the manifest digest
+	// it resolved to.
+	Bases map[string]string `yaml:"bases"`
+
+	// Imports is a map of the url of a downloaded import to its digest.
+	Imports map[string]string `yaml:"imports"`
+}
+
+// OpenLockfile reads the lockfile at path, if it exists. If update is true,
+// the existing entries are ignored and re-resolved.
+func OpenLockfile(path string, update bool) (*Lockfile, error) {
+	lock := &Lockfile{
+		path:    path,
+		Bases:   map[string]string{},
+		Imports: map[string]string{},
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lock, nil
+		}
+		return nil, err
+	}
+
+	if update {
+		return lock, nil
+	}
+
+	if err := yaml.Unmarshal(content, lock); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", path)
+	}
+
+	if lock.Bases == nil {
+		lock.Bases = map[string]string{}
+	}
+
+	if lock.Imports == nil {
+		lock.Imports = map[string]string{}
+	}
+
+	return lock, nil
+}
+
+func (l *Lockfile) save() error {
+	content, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(l.path, content, 0644)
+}
+
+// ResolveBase returns the url that the docker base at url should be pulled
+// from: the url pinned to its locked digest, resolving and locking it first
+// if necessary.
+func (l *Lockfile) ResolveBase(c StackerConfig, src *ImageSource) (string, error) {
+	d, ok := l.Bases[baseLockKey(c, src)]
+	if !ok {
+		var err error
+		d, err = inspectDigest(c, src)
+		if err != nil {
+			return "", err
+		}
+
+		l.Bases[baseLockKey(c, src)] = d
+		if err := l.save(); err != nil {
+			return "", err
+		}
+	}
+
+	return pinDigest(src.Url, d)
+}
+
+// resolveBaseDigest sets l.baseDigest to the digest its docker base resolves
+// to, so that the build cache notices when that changes. If resolve is false,
+// only an already locked digest is used; if refresh is true, the locked one
+// is ignored and the base is resolved again.
+func resolveBaseDigest(c StackerConfig, l *Layer, resolve bool, refresh bool) error {
+	l.baseDigest = ""
+	if l.From.Type != DockerType || c.Lock == nil {
+		return nil
+	}
+
+	key := baseLockKey(c, l.From)
+	if refresh {
+		delete(c.Lock.Bases, key)
+	}
+
+	if resolve {
+		if _, err := c.Lock.ResolveBase(c, l.From); err != nil {
+			return err
+		}
+	}
+
+	l.baseDigest = c.Lock.Bases[key]
+	return nil
+}
+
+// VerifyImport checks that the downloaded import from url has digest d,
+// locking it if it hasn't been seen before.
+func (l *Lockfile) VerifyImport(url string, d string) error {
+	locked, ok := l.Imports[url]
+	if !ok {
+		l.Imports[url] = d
+		return l.save()
+	}
+
+	if locked != d {
+		return fmt.Errorf("%s has digest %s but %s is locked to %s; use --update to accept it", url, d, l.path, locked)
+	}
+
+	return nil
+}
+
+// baseLockKey is the key of the docker base src in Lockfile.Bases. The same
+// tag resolves to different images for different arches, so builds for
+// other arches than the host's lock them separately.
+func baseLockKey(c StackerConfig, src *ImageSource) string {
+	if c.Arch == "" {
+		return src.Url
+	}
+
+	return fmt.Sprintf("%s#%s", src.Url, c.Arch)
+}
+
+func inspectDigest(c StackerConfig, src *ImageSource) (string, error) {
+	registryArgs, cleanup, err := skopeoRegistryArgs(c, src, "")
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	args := []string{"inspect"}
+	if c.Arch != "" {
+		args = append([]string{"--override-arch", c.Arch}, args...)
+	}
+	args = append(args, registryArgs...)
+	args = append(args, src.Url)
+
+	output, err := exec.Command("skopeo", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("skopeo inspect %s: %s", src.Url, err)
+	}
+
+	result := struct {
+		Digest string
+	}{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", err
+	}
+
+	if result.Digest == "" {
+		return "", fmt.Errorf("no digest for %s", src.Url)
+	}
+
+	return result.Digest, nil
+}
+
+// pinDigest replaces the tag (if any) in a docker:// url with the digest d;
+// skopeo does not accept references with both.
+func pinDigest(dockerUrl string, d string) (string, error) {
+	parts := strings.SplitN(dockerUrl, "://", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid docker url %s", dockerUrl)
+	}
+
+	ref := parts[1]
+	if idx := strings.LastIndex(ref, "@"); idx >= 0 {
+		ref = ref[:idx]
+	}
+
+	if idx := strings.LastIndex(ref, ":"); idx >= 0 && !strings.Contains(ref[idx:], "/") {
+		ref = ref[:idx]
+	}
+
+	return fmt.Sprintf("%s://%s@%s", parts[0], ref, d), nil
+}
@@ -0,0 +1,72 @@
+package stacker
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+var rootLogger log.Interface = log.Log
+
+// SetLogger sets the logger that stacker logs to.
+func SetLogger(l *log.Logger) {
+	rootLogger = l
+	log.Log = l
+}
+
+// SetLogContext tags subsequent log lines with the layer being built and the
+// phase of its build; either may be empty to leave it out.
+func SetLogContext(layer string, phase string) {
+	fields := log.Fields{}
+	if layer != "" {
+		fields["layer"] = layer
+	}
+
+	if phase != "" {
+		fields["phase"] = phase
+	}
+
+	log.Log = rootLogger.WithFields(fields)
+}
+
+// timestampWriter prefixes each line written to it with the time it was
+// written at. It is safe to use from several goroutines, e.g. as both the
+// stdout and stderr of a command.
+type timestampWriter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	startOfLine bool
+}
+
+func newTimestampWriter(w io.Writer) *timestampWriter {
+	return &timestampWriter{w: w, startOfLine: true}
+}
+
+func (tw *timestampWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if tw.startOfLine {
+			buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+			buf.WriteString(" ")
+		}
+
+		buf.Write(line)
+		tw.startOfLine = line[len(line)-1] == '\n'
+	}
+
+	if _, err := tw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,129 @@
+package stacker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// matrixVariables does a best effort parse of the raw stackerfile content to
+// find the names of all the variables used in matrix: directives, so that
+// their ${FOO} references can be left alone until the matrix is expanded.
+func matrixVariables(content string) map[string]bool {
+	vars := map[string]bool{}
+
+	raw := map[string]interface{}{}
+	yaml.Unmarshal([]byte(content), &raw)
+
+	for _, v := range raw {
+		layer, ok := v.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		matrix, ok := layer["matrix"].(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		for k := range matrix {
+			if name, ok := k.(string); ok {
+				vars[name] = true
+			}
+		}
+	}
+
+	return vars
+}
+
+// matrixCombinations returns the cartesian product of the matrix's values, as
+// a list of variable assignments.
+func matrixCombinations(matrix map[string][]string) []map[string]string {
+	keys := []string{}
+	for k := range matrix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	combos := []map[string]string{{}}
+	for _, k := range keys {
+		next := []map[string]string{}
+		for _, combo := range combos {
+			for _, v := range matrix[k] {
+				c := map[string]string{k: v}
+				for ck, cv := range combo {
+					c[ck] = cv
+				}
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+
+	return combos
+}
+
+// matrixName is the name of the layer generated for a particular combination
+// of the matrix's variables: the values, in order of variable name, appended
+// to the original name, e.g. app-3.9.
+func matrixName(name string, combo map[string]string) string {
+	keys := []string{}
+	for k := range combo {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, combo[k])
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// expandMatrices replaces each layer that has a matrix: with one layer per
+// combination of the matrix's variables, with the ${VAR} (and
+// ${VAR:-default}) references in it replaced by that combination's values.
+func (s Stackerfile) expandMatrices() error {
+	for name, layer := range s {
+		if len(layer.Matrix) == 0 {
+			continue
+		}
+
+		matrix := layer.Matrix
+		layer.Matrix = nil
+		content, err := yaml.Marshal(layer)
+		if err != nil {
+			return err
+		}
+
+		delete(s, name)
+
+		for k, vs := range matrix {
+			if len(vs) == 0 {
+				return fmt.Errorf("layer %s: matrix variable %s has no values", name, k)
+			}
+		}
+
+		for _, combo := range matrixCombinations(matrix) {
+			expanded := expandVars(string(content), combo)
+
+			newName := matrixName(name, combo)
+			if _, ok := s[newName]; ok {
+				return fmt.Errorf("matrix layer %s conflicts with an existing layer", newName)
+			}
+
+			l := &Layer{}
+			if err := yaml.UnmarshalStrict([]byte(expanded), l); err != nil {
+				return errors.Wrapf(err, "couldn't expand matrix for layer %s", name)
+			}
+
+			s[newName] = l
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildMetrics collects metrics about a build from its events, to push to
+// statsd or a Prometheus Pushgateway; pass its Record method as (or from)
+// BuildOpts.Progress.
+type BuildMetrics struct {
+	summary    BuildSummary
+	start      time.Time
+	end        time.Time
+	failed     bool
+	downloaded int64
+}
+
+// NewBuildMetrics starts collecting metrics for a build that is about to
+// start.
+func NewBuildMetrics() *BuildMetrics {
+	return &BuildMetrics{start: time.Now(), downloaded: DownloadedBytes()}
+}
+
+// Record updates the metrics with ev.
+func (m *BuildMetrics) Record(ev BuildEvent) {
+	m.summary.Record(ev)
+
+	switch ev.Event {
+	case EventBuildDone:
+		m.end = ev.Time
+	case EventBuildFailed:
+		m.end = ev.Time
+		m.failed = true
+	}
+}
+
+// metricSample is a single value; layer, if set, is its only label.
+type metricSample struct {
+	name  string
+	help  string
+	layer string
+	value float64
+}
+
+func (m *BuildMetrics) samples() []metricSample {
+	end := m.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	success := 1.0
+	if m.failed {
+		success = 0
+	}
+
+	hits := 0
+	for _, l := range m.summary.Layers {
+		if l.Cached {
+			hits++
+		}
+	}
+
+	hitRatio := 0.0
+	if len(m.summary.Layers) > 0 {
+		hitRatio = float64(hits) / float64(len(m.summary.Layers))
+	}
+
+	samples := []metricSample{
+		{name: "build_duration_seconds", help: "How long the build took.", value: end.Sub(m.start).Seconds()},
+		{name: "build_success", help: "1 if the build succeeded, 0 if it failed.", value: success},
+		{name: "build_layers", help: "How many layers were built or taken from the cache.", value: float64(len(m.summary.Layers))},
+		{name: "build_cache_hits", help: "How many layers were taken from the cache.", value: float64(hits)},
+		{name: "build_cache_hit_ratio", help: "The fraction of layers taken from the cache.", value: hitRatio},
+		{name: "build_downloaded_bytes", help: "How much was downloaded over http(s).", value: float64(DownloadedBytes() - m.downloaded)},
+	}
+
+	for _, l := range m.summary.Layers {
+		cached := 0.0
+		if l.Cached {
+			cached = 1
+		}
+
+		samples = append(samples,
+			metricSample{name: "layer_duration_seconds", help: "How long building the layer took.", layer: l.Layer, value: l.Total},
+			metricSample{name: "layer_run_seconds", help: "How long the layer's run section took.", layer: l.Layer, value: l.Run},
+			metricSample{name: "layer_size_bytes", help: "The total size of the layer's image.", layer: l.Layer, value: float64(l.Size)},
+			metricSample{name: "layer_cached", help: "1 if the layer was taken from the cache.", layer: l.Layer, value: cached},
+		)
+	}
+
+	return samples
+}
+
+var statsdUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// PushStatsd sends the metrics to the statsd server at addr (host:port) as
+// gauges named stacker.<metric>, or stacker.<metric>.<layer> for per layer
+// ones.
+func (m *BuildMetrics) PushStatsd(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, s := range m.samples() {
+		name := "stacker." + s.name
+		if s.layer != "" {
+			name = fmt.Sprintf("%s.%s", name, statsdUnsafe.ReplaceAllString(s.layer, "_"))
+		}
+
+		// One packet per metric, so none of them are too big.
+		if _, err := fmt.Fprintf(conn, "%s:%g|g", name, s.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writePrometheus writes the metrics in the Prometheus text format, as
+// stacker_<metric>{layer="<layer>"}.
+func (m *BuildMetrics) writePrometheus(buf *bytes.Buffer) {
+	byName := map[string][]metricSample{}
+	names := []string{}
+	for _, s := range m.samples() {
+		if _, ok := byName[s.name]; !ok {
+			names = append(names, s.name)
+		}
+		byName[s.name] = append(byName[s.name], s)
+	}
+	sort.Strings(names)
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, name := range names {
+		samples := byName[name]
+		fmt.Fprintf(buf, "# HELP stacker_%s %s\n", name, samples[0].help)
+		fmt.Fprintf(buf, "# TYPE stacker_%s gauge\n", name)
+		for _, s := range samples {
+			labels := ""
+			if s.layer != "" {
+				labels = fmt.Sprintf(`{layer="%s"}`, escape.Replace(s.layer))
+			}
+			fmt.Fprintf(buf, "stacker_%s%s %g\n", name, labels, s.value)
+		}
+	}
+}
+
+// PushGateway pushes the metrics to the Prometheus Pushgateway at url, under
+// the job name, replacing the job's previous metrics.
+func (m *BuildMetrics) PushGateway(c StackerConfig, url string, job string) error {
+	buf := &bytes.Buffer{}
+	m.writePrometheus(buf)
+
+	target := fmt.Sprintf("%s/metrics/job/%s", strings.TrimSuffix(url, "/"), neturl.PathEscape(job))
+	client, err := httpClient(c, target)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, target, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushing metrics to %s: %s", target, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package stacker
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// importCandidates returns the places to try fetching the import i from, in
+// order: its path, then its own mirrors, then the mirrors configured in c
+// for the longest prefix of its path. Mirrors ending in / are prefixes that
+// the import's name is appended to.
+func importCandidates(c StackerConfig, i ImportSpec) []string {
+	candidates := []string{i.Path}
+
+	for _, m := range i.Mirrors {
+		if strings.HasSuffix(m, "/") {
+			m += importName(i.Path)
+		}
+		candidates = append(candidates, m)
+	}
+
+	prefixes := []string{}
+	for prefix := range c.ImportMirrors {
+		if strings.HasPrefix(i.Path, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return candidates
+	}
+
+	sort.Slice(prefixes, func(a, b int) bool { return len(prefixes[a]) > len(prefixes[b]) })
+	for _, m := range c.ImportMirrors[prefixes[0]] {
+		candidates = append(candidates, m+strings.TrimPrefix(i.Path, prefixes[0]))
+	}
+
+	return candidates
+}
+
+// acquireImport gets the import i into dir, trying its mirrors in turn if it
+// can't be fetched. Whichever it comes from, it's stored under the import's
+// own name, and checked against what the import's own url is locked to.
+func acquireImport(c StackerConfig, i ImportSpec, dir string) (string, error) {
+	candidates := importCandidates(c, i)
+
+	var firstErr error
+	errs := []string{}
+	for n, candidate := range candidates {
+		if n > 0 {
+			log.Infof("couldn't import %s, trying %s", candidates[n-1], candidate)
+		}
+
+		p, err := acquireUrl(c, candidate, dir, i.Symlinks)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if n == 0 {
+			return p, nil
+		}
+
+		dest := path.Join(dir, importName(i.Path))
+		if p != dest {
+			if err := os.RemoveAll(dest); err != nil {
+				return "", err
+			}
+
+			if err := os.Rename(p, dest); err != nil {
+				return "", err
+			}
+		}
+
+		if c.Lock != nil && isRemoteImport(i.Path) {
+			fi, err := os.Stat(dest)
+			if err != nil {
+				return "", err
+			}
+
+			if !fi.IsDir() {
+				h, err := hashFile(dest)
+				if err != nil {
+					return "", err
+				}
+
+				if err := c.Lock.VerifyImport(i.Path, h); err != nil {
+					os.RemoveAll(dest)
+					return "", err
+				}
+			}
+		}
+
+		return dest, nil
+	}
+
+	if len(candidates) == 1 {
+		return "", firstErr
+	}
+
+	return "", fmt.Errorf("couldn't import %s from any of its mirrors: %s", i.Path, strings.Join(errs, "; "))
+}
+
+// isRemoteImport is true for http(s) and sftp imports, the ones the lockfile
+// pins.
+func isRemoteImport(p string) bool {
+	u, err := url.Parse(p)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https", "sftp", "scp":
+		return true
+	default:
+		return false
+	}
+}
@@ -1,23 +1,145 @@
 package stacker
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 
-	"github.com/cheggaaa/pb"
+	"github.com/apex/log"
+	"github.com/pkg/errors"
 )
 
-// download with caching support in the specified cache dir.
-func download(cacheDir string, url string) (string, error) {
-	name := path.Join(cacheDir, path.Base(url))
+// isInsecure returns true if host is one of the configured insecure
+// registries.
+func (c StackerConfig) isInsecure(host string) bool {
+	for _, h := range c.InsecureRegistries {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// httpClient returns a client for fetching url that honors the proxy
+// environment variables, the configured CA bundle, and insecure hosts.
+func httpClient(c StackerConfig, url string) (*http.Client, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		content, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.isInsecure(u.Host) {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// registryHost returns the registry host of a docker:// url, the way docker
+// decides it: the first path component if it looks like a host, and
+// docker.io otherwise.
+func registryHost(dockerUrl string) string {
+	ref := dockerUrl
+	if idx := strings.Index(ref, "://"); idx >= 0 {
+		ref = ref[idx+3:]
+	}
+	ref = strings.TrimPrefix(ref, "//")
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+
+	return "docker.io"
+}
+
+// skopeoRegistryArgs returns the skopeo arguments to access the registry of
+// src. prefix is the prefix skopeo uses for the flags of this command,
+// e.g. "src-" for copy and "" for inspect. The returned function removes the
+// credentials written for skopeo, and must be called once it has run.
+func skopeoRegistryArgs(c StackerConfig, src *ImageSource, prefix string) ([]string, func(), error) {
+	host := registryHost(src.Url)
+
+	args := []string{}
+	if src.Insecure || c.isInsecure(host) {
+		args = append(args, fmt.Sprintf("--%stls-verify=false", prefix))
+	}
+
+	if c.CACert != "" {
+		// skopeo wants a directory of *.crt files rather than a
+		// bundle, so let's make one.
+		certDir := path.Join(c.StackerDir, "certs")
+		if err := os.MkdirAll(certDir, 0755); err != nil {
+			return nil, nil, err
+		}
+
+		content, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := ioutil.WriteFile(path.Join(certDir, "ca.crt"), content, 0644); err != nil {
+			return nil, nil, err
+		}
+
+		args = append(args, fmt.Sprintf("--%scert-dir", prefix), certDir)
+	}
+
+	authFile, err := writeAuthFile(c, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if authFile == "" {
+		return args, func() {}, nil
+	}
+
+	args = append(args, fmt.Sprintf("--%sauthfile", prefix), authFile)
+	return args, func() { os.Remove(authFile) }, nil
+}
+
+// download with caching support in the specified cache dir, as
+// importName(url).
+func download(c StackerConfig, cacheDir string, url string) (string, error) {
+	name := path.Join(cacheDir, importName(url))
 	out, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
 		// It already exists, let's just use that one.
 		if os.IsExist(err) {
-			fmt.Println("using cached copy of", url)
+			log.Infof("using cached copy of %s", url)
 			return name, nil
 		} else if os.IsNotExist(err) {
 			out, err = os.OpenFile(name, os.O_RDWR, 0644)
@@ -30,28 +152,51 @@ func download(cacheDir string, url string) (string, error) {
 	}
 	defer out.Close()
 
-	fmt.Println("downloading", url)
+	log.Infof("downloading %s", url)
 
-	resp, err := http.Get(url)
+	err = fetch(c, url, out)
 	if err != nil {
+		// Don't leave a partial file around to be used as the cached
+		// copy next time.
+		os.Remove(name)
 		return "", err
 	}
+
+	return name, nil
+}
+
+// downloadedBytes is how much fetch has downloaded, for metrics.
+var downloadedBytes int64
+
+// DownloadedBytes returns how many bytes this process has downloaded over
+// http(s).
+func DownloadedBytes() int64 {
+	return atomic.LoadInt64(&downloadedBytes)
+}
+
+func fetch(c StackerConfig, url string, out io.Writer) error {
+	client, err := httpClient(c, url)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		if strings.Contains(err.Error(), "x509") {
+			return errors.Wrapf(err, "couldn't download %s (behind a TLS intercepting proxy? try --ca-cert)", url)
+		}
+		return err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("couldn't download %s: %s", url, resp.Status)
+		return fmt.Errorf("couldn't download %s: %s", url, resp.Status)
 	}
 
-	source := resp.Body
-	if resp.ContentLength >= 0 {
-		bar := pb.New(int(resp.ContentLength)).SetUnits(pb.U_BYTES)
-		bar.ShowTimeLeft = true
-		bar.ShowSpeed = true
-		bar.Start()
-		source = bar.NewProxyReader(source)
-		defer bar.Finish()
-	}
+	source, finish := withDownloadProgress(fmt.Sprintf("downloading %s", url), limitDownload(c, resp.Body), resp.ContentLength)
+	defer finish()
 
-	_, err = io.Copy(out, source)
-	return name, err
+	n, err := io.Copy(out, source)
+	atomic.AddInt64(&downloadedBytes, n)
+	return err
 }
@@ -0,0 +1,215 @@
+package stacker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+)
+
+// PackageManifestMediaType is the media type of the package manifests
+// attached to images.
+const PackageManifestMediaType = "application/vnd.stacker.packages+json"
+
+// InstalledPackage is a package installed in an image's rootfs.
+type InstalledPackage struct {
+	Manager string `json:"manager"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+}
+
+// PackageManifest is the list of packages installed in an image.
+type PackageManifest struct {
+	Packages []InstalledPackage `json:"packages"`
+}
+
+// parseDpkgStatus parses dpkg's status database, the way dpkg -l reads it;
+// only packages that are actually installed are returned.
+func parseDpkgStatus(content string) []InstalledPackage {
+	result := []InstalledPackage{}
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		p := InstalledPackage{Manager: "dpkg"}
+		installed := false
+		for _, line := range strings.Split(paragraph, "\n") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value := strings.TrimSpace(parts[1])
+			switch parts[0] {
+			case "Package":
+				p.Name = value
+			case "Version":
+				p.Version = value
+			case "Architecture":
+				p.Arch = value
+			case "Status":
+				installed = strings.HasSuffix(value, " installed")
+			}
+		}
+
+		if p.Name != "" && installed {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
+
+// parseApkInstalled parses apk's installed database, the way apk info
+// reads it.
+func parseApkInstalled(content string) []InstalledPackage {
+	result := []InstalledPackage{}
+	p := InstalledPackage{Manager: "apk"}
+	scanner := bufio.NewScanner(strings.NewReader(content + "\n"))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if p.Name != "" {
+				result = append(result, p)
+			}
+			p = InstalledPackage{Manager: "apk"}
+			continue
+		}
+
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		switch line[0] {
+		case 'P':
+			p.Name = line[2:]
+		case 'V':
+			p.Version = line[2:]
+		case 'A':
+			p.Arch = line[2:]
+		}
+	}
+
+	return result
+}
+
+// rpmQueryFormat is what rpm -qa is asked to print for each package, and
+// parseRpmQuery parses.
+const rpmQueryFormat = `%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\n`
+
+func parseRpmQuery(content string) []InstalledPackage {
+	result := []InstalledPackage{}
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 || parts[0] == "gpg-pubkey" {
+			continue
+		}
+
+		result = append(result, InstalledPackage{Manager: "rpm", Name: parts[0], Version: parts[1], Arch: parts[2]})
+	}
+
+	return result
+}
+
+// queryRpm lists the packages in the rpm database of rootfs with the host's
+// rpm, since the database isn't a format that's easy to read otherwise.
+func queryRpm(sc StackerConfig, rootfs string) ([]InstalledPackage, error) {
+	tmpdir, err := ioutil.TempDir(sc.StackerDir, "packages")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Run it in the userns, so that it can read the database regardless
+	// of who owns it.
+	out := path.Join(tmpdir, "rpm.txt")
+	args := []string{"sh", "-c", `rpm --root "$1" -qa --qf "$2" > "$3"`, "sh", rootfs, rpmQueryFormat, out}
+	if err := MaybeRunInUserns(args, "listing rpm packages failed"); err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRpmQuery(string(content)), nil
+}
+
+// InstalledPackages lists the packages installed in rootfs by dpkg, rpm and
+// apk, whichever it has databases for.
+func InstalledPackages(sc StackerConfig, rootfs string) ([]InstalledPackage, error) {
+	packages := []InstalledPackage{}
+
+	content, err := ioutil.ReadFile(path.Join(rootfs, "var/lib/dpkg/status"))
+	if err == nil {
+		packages = append(packages, parseDpkgStatus(string(content))...)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	content, err = ioutil.ReadFile(path.Join(rootfs, "lib/apk/db/installed"))
+	if err == nil {
+		packages = append(packages, parseApkInstalled(string(content))...)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, db := range []string{"var/lib/rpm", "usr/lib/sysimage/rpm"} {
+		if _, err := os.Stat(path.Join(rootfs, db)); err != nil {
+			continue
+		}
+
+		rpms, err := queryRpm(sc, rootfs)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, rpms...)
+		break
+	}
+
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Manager != packages[j].Manager {
+			return packages[i].Manager < packages[j].Manager
+		}
+		return packages[i].Name < packages[j].Name
+	})
+
+	return packages, nil
+}
+
+// GeneratePackageManifest lists the packages installed in the rootfs of the
+// image tagged name, and attaches the list to the image (as
+// sha256-<manifest hex>.packages). If outDir is not empty, it is also written
+// there as <name>.packages.json.
+func GeneratePackageManifest(sc StackerConfig, oci *umoci.Layout, name string, rootfs string, outDir string) error {
+	packages, err := InstalledPackages(sc, rootfs)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%s has %d packages installed", name, len(packages))
+
+	content, err := json.Marshal(PackageManifest{Packages: packages})
+	if err != nil {
+		return err
+	}
+
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+
+		p := path.Join(outDir, fmt.Sprintf("%s.packages.json", name))
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	return addArtifact(sc.OCIDir, oci, name, "packages", PackageManifestMediaType, content, nil)
+}
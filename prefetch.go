@@ -0,0 +1,103 @@
+package stacker
+
+import (
+	"net/url"
+
+	"github.com/apex/log"
+)
+
+// Prefetch resolves and downloads the imports and base images a Build with
+// opts would need into the cache, without building anything, so that a later
+// build can run without network access. Imports of other layers' outputs
+// (stacker:// urls) can't be fetched ahead of time, and are skipped; what
+// earlier builds imported from them is left where it is.
+func (b *Builder) Prefetch(opts BuildOpts) error {
+	sc := b.config
+
+	files := opts.StackerFiles
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	parseOpts := ParseOpts{
+		Substitutions: opts.Substitutions,
+		Template:      opts.Template,
+		BuildContext:  opts.BuildContext,
+		Config:        sc,
+
+		ImportsRelativeToStackerfile: opts.ImportsRelativeToStackerfile,
+	}
+
+	sf, err := NewStackerfiles(files, parseOpts)
+	if err != nil {
+		return err
+	}
+
+	if err := sf.Validate(); err != nil {
+		return err
+	}
+
+	sc.Lock, err = OpenLockfile(opts.lockfile(files), opts.Update)
+	if err != nil {
+		return err
+	}
+
+	order, err := sf.DependencyOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		l := sf[name]
+
+		layerConfig, _, err := l.config(sc)
+		if err != nil {
+			return err
+		}
+
+		SetLogContext(name, "base")
+		switch l.From.Type {
+		case DockerType:
+			log.Infof("fetching base image %s", l.From.Url)
+			if _, err := fetchDockerBase(layerConfig, l.From); err != nil {
+				return err
+			}
+		case TarType:
+			log.Infof("fetching base tarball %s", l.From.Url)
+			if _, err := fetchTarBase(layerConfig, l.From); err != nil {
+				return err
+			}
+		}
+
+		SetLogContext(name, "import")
+		if err := l.RunImportCmd(name); err != nil {
+			return err
+		}
+
+		imports, err := l.ParseImports()
+		if err != nil {
+			return err
+		}
+
+		fetchable := []ImportSpec{}
+		skipped := []string{}
+		for _, imp := range imports {
+			u, err := url.Parse(imp.Path)
+			if err == nil && u.Scheme == "stacker" {
+				log.Infof("skipping %s, it is built", imp.Path)
+				skipped = append(skipped, importName(imp.Path))
+				continue
+			}
+
+			fetchable = append(fetchable, imp)
+		}
+
+		log.Infof("fetching %d imports", len(fetchable))
+		if err := importShared(sc, name, fetchable, nil, skipped); err != nil {
+			return err
+		}
+	}
+
+	SetLogContext("", "")
+	return nil
+}
@@ -0,0 +1,106 @@
+package stacker
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cheggaaa/pb"
+)
+
+// isTerminal returns true if f is a terminal, i.e. if it's reasonable to draw
+// progress bars on it.
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// progressInterval is how often RunWithProgress reports progress.
+const progressInterval = 30 * time.Second
+
+// RunWithProgress runs f, which is the (long running, and otherwise silent)
+// phase what, periodically printing how long it has been running so that it
+// doesn't look like the build is hung.
+func RunWithProgress(what string, f func() error) error {
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Infof("%s: still running after %s", what, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+
+	err := f()
+	close(done)
+	<-finished
+
+	if err == nil {
+		log.Infof("%s done in %s", what, time.Since(start).Round(time.Second))
+	}
+
+	return err
+}
+
+// progressReader reports how much of a download of size bytes (or -1 if
+// unknown) has been read every so often, for when stdout isn't a terminal.
+type progressReader struct {
+	io.Reader
+	what  string
+	size  int64
+	read  int64
+	last  time.Time
+	every time.Duration
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.read += int64(n)
+
+	if time.Since(pr.last) >= pr.every {
+		pr.last = time.Now()
+		if pr.size > 0 {
+			log.Infof("%s: %d of %d bytes (%d%%)", pr.what, pr.read, pr.size, pr.read*100/pr.size)
+		} else {
+			log.Infof("%s: %d bytes", pr.what, pr.read)
+		}
+	}
+
+	return n, err
+}
+
+// withDownloadProgress wraps r, the body of a download of size bytes, so that
+// progress is reported as it's read: a progress bar on a terminal and
+// periodic log lines otherwise. The returned function should be called when
+// the download is done.
+func withDownloadProgress(what string, r io.Reader, size int64) (io.Reader, func()) {
+	if !isTerminal(os.Stdout) {
+		pr := &progressReader{Reader: r, what: what, size: size, last: time.Now(), every: 10 * time.Second}
+		return pr, func() {}
+	}
+
+	if size < 0 {
+		return r, func() {}
+	}
+
+	bar := pb.New(int(size)).SetUnits(pb.U_BYTES)
+	bar.ShowTimeLeft = true
+	bar.ShowSpeed = true
+	bar.Start()
+	return bar.NewProxyReader(r), bar.Finish
+}
@@ -0,0 +1,177 @@
+package stacker
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	MediaTypeInToto       = "application/vnd.in-toto+json"
+	MediaTypeDSSEEnvelope = "application/vnd.dsse.envelope.v1+json"
+)
+
+// ProvenanceOpts are the build-wide inputs recorded in provenance documents.
+type ProvenanceOpts struct {
+	BuilderVersion string
+	Substitutions  []string
+
+	// Signer, if not nil, is used to sign the provenance in a DSSE
+	// envelope.
+	Signer crypto.Signer
+}
+
+type provenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+func digestMap(d string) map[string]string {
+	parsed, err := digest.Parse(d)
+	if err != nil {
+		return nil
+	}
+
+	return map[string]string{parsed.Algorithm().String(): parsed.Hex()}
+}
+
+// provenanceMaterials returns the inputs of the layer: its base and imports,
+// with their digests where stacker knows them.
+func provenanceMaterials(sc StackerConfig, oci *umoci.Layout, name string, l *Layer) ([]provenanceMaterial, error) {
+	materials := []provenanceMaterial{}
+
+	base := provenanceMaterial{URI: l.From.Url}
+	switch l.From.Type {
+	case BuiltType:
+		base.URI = fmt.Sprintf("stacker://%s", l.From.Tag)
+		desc, err := oci.LookupManifestDescriptor(l.From.Tag)
+		if err == nil {
+			base.Digest = digestMap(desc.Digest.String())
+		}
+	case DockerType:
+		if sc.Lock != nil {
+			base.Digest = digestMap(sc.Lock.Bases[baseLockKey(sc, l.From)])
+		}
+	case TarType:
+		h, err := hashFile(path.Join(sc.StackerDir, "layer-bases", importName(l.From.Url)))
+		if err == nil {
+			base.Digest = digestMap(h)
+		}
+	case ScratchType:
+		base.URI = "scratch"
+	}
+	materials = append(materials, base)
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+
+	importDir := path.Join(sc.StackerDir, "imports", name)
+	for _, imp := range imports {
+		m := provenanceMaterial{URI: imp}
+
+		// Directories don't have a single digest, so we just record
+		// where they came from.
+		p := path.Join(importDir, importName(imp))
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			h, err := hashFile(p)
+			if err != nil {
+				return nil, err
+			}
+			m.Digest = digestMap(h)
+		}
+
+		materials = append(materials, m)
+	}
+
+	return materials, nil
+}
+
+// dssePAE is the DSSE pre-authentication encoding of a payload, which is what
+// actually gets signed.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// GenerateProvenance attaches a SLSA provenance statement for the image
+// tagged name to it (as sha256-<manifest hex>.att, the way cosign does). It
+// records the stackerfile the layer was defined in, the substitutions, the
+// digests of the base and imports, and the version of stacker.
+func GenerateProvenance(sc StackerConfig, oci *umoci.Layout, name string, l *Layer, opts ProvenanceOpts) error {
+	manifestDesc, err := oci.LookupManifestDescriptor(name)
+	if err != nil {
+		return err
+	}
+
+	materials, err := provenanceMaterials(sc, oci, name, l)
+	if err != nil {
+		return err
+	}
+
+	configSource := map[string]interface{}{
+		"uri":        l.Source(),
+		"entryPoint": name,
+	}
+	if h, err := hashFile(l.Source()); err == nil {
+		configSource["digest"] = digestMap(h)
+	}
+
+	statement := map[string]interface{}{
+		"_type": "https://in-toto.io/Statement/v0.1",
+		"subject": []map[string]interface{}{
+			{
+				"name":   name,
+				"digest": digestMap(manifestDesc.Digest.String()),
+			},
+		},
+		"predicateType": "https://slsa.dev/provenance/v0.2",
+		"predicate": map[string]interface{}{
+			"builder": map[string]string{
+				"id": fmt.Sprintf("https://github.com/anuvu/stacker@%s", opts.BuilderVersion),
+			},
+			"buildType": "https://github.com/anuvu/stacker/build@v1",
+			"invocation": map[string]interface{}{
+				"configSource": configSource,
+				"parameters": map[string]interface{}{
+					"substitutions": opts.Substitutions,
+				},
+			},
+			"materials": materials,
+		},
+	}
+
+	content, err := marshalBlob(statement)
+	if err != nil {
+		return err
+	}
+
+	if opts.Signer == nil {
+		return addArtifact(sc.OCIDir, oci, name, "att", MediaTypeInToto, content, nil)
+	}
+
+	sig, err := signPayload(opts.Signer, dssePAE(MediaTypeInToto, content))
+	if err != nil {
+		return err
+	}
+
+	envelope := map[string]interface{}{
+		"payloadType": MediaTypeInToto,
+		"payload":     base64.StdEncoding.EncodeToString(content),
+		"signatures": []map[string]string{
+			{"sig": base64.StdEncoding.EncodeToString(sig)},
+		},
+	}
+
+	content, err = marshalBlob(envelope)
+	if err != nil {
+		return err
+	}
+
+	return addArtifact(sc.OCIDir, oci, name, "att", MediaTypeDSSEEnvelope, content, nil)
+}
@@ -0,0 +1,268 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci"
+)
+
+// DiskUsage returns the space allocated to the files under p, counting
+// hardlinked files only once. Subtrees we aren't allowed to read are
+// skipped. If p doesn't exist, its usage is 0.
+func DiskUsage(p string) (int64, error) {
+	seen := map[inode]bool{}
+	total := int64(0)
+
+	err := filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsPermission(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Nlink > 1 && !info.IsDir() {
+			key := inode{uint64(st.Dev), st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+
+		total += st.Blocks * 512
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return total, err
+}
+
+// TargetUsage is the disk space used by one target.
+type TargetUsage struct {
+	Name string `json:"name"`
+
+	// Imports is the size of the target's imports in the stacker dir.
+	Imports int64 `json:"imports"`
+
+	// Snapshot is the size of the target's filesystem in the roots dir.
+	// On btrfs, extents shared with other snapshots are counted in each
+	// of them.
+	Snapshot int64 `json:"snapshot"`
+
+	// OCI is the size of the blobs of the target's image; like snapshots,
+	// layers shared between images are counted in each of them.
+	OCI int64 `json:"oci"`
+}
+
+// Usage is the disk space used by stacker's build state.
+type Usage struct {
+	Targets []TargetUsage `json:"targets"`
+
+	// LayerBases is the size of the downloaded base images.
+	LayerBases int64 `json:"layer_bases"`
+
+	// StackerDir, OCIDir and RootFSDir are the total sizes of each of the
+	// directories.
+	StackerDir int64 `json:"stacker_dir"`
+	OCIDir     int64 `json:"oci_dir"`
+	RootFSDir  int64 `json:"roots_dir"`
+}
+
+func listDir(p string) ([]string, error) {
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+
+	return names, nil
+}
+
+// GetUsage reports the disk space used by the imports, snapshots, and images
+// of every target stacker knows about.
+func GetUsage(sc StackerConfig) (*Usage, error) {
+	usage := &Usage{}
+	targets := map[string]*TargetUsage{}
+	target := func(name string) *TargetUsage {
+		t, ok := targets[name]
+		if !ok {
+			t = &TargetUsage{Name: name}
+			targets[name] = t
+		}
+		return t
+	}
+
+	importDirs, err := listDir(path.Join(sc.StackerDir, "imports"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range importDirs {
+		target(name).Imports, err = DiskUsage(path.Join(sc.StackerDir, "imports", name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	snapshots, err := listDir(sc.RootFSDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range snapshots {
+		if name == ".working" {
+			continue
+		}
+
+		target(name).Snapshot, err = DiskUsage(path.Join(sc.RootFSDir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(sc.OCIDir); err == nil {
+		oci, err := umoci.OpenLayout(sc.OCIDir)
+		if err != nil {
+			return nil, err
+		}
+		defer oci.Close()
+
+		tags, err := oci.ListTags()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range tags {
+			if IsArtifactTag(tag) {
+				continue
+			}
+
+			target(tag).OCI = imageSize(oci, tag)
+		}
+	}
+
+	for _, t := range targets {
+		usage.Targets = append(usage.Targets, *t)
+	}
+	sort.Slice(usage.Targets, func(i, j int) bool {
+		return usage.Targets[i].Name < usage.Targets[j].Name
+	})
+
+	dirs := []struct {
+		p    string
+		size *int64
+	}{
+		{path.Join(sc.StackerDir, "layer-bases"), &usage.LayerBases},
+		{sc.StackerDir, &usage.StackerDir},
+		{sc.OCIDir, &usage.OCIDir},
+		{sc.RootFSDir, &usage.RootFSDir},
+	}
+	for _, d := range dirs {
+		*d.size, err = DiskUsage(d.p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return usage, nil
+}
+
+// touchCacheEntry marks the import or base cache entry at p as used now, for
+// the purposes of EnforceCacheQuota.
+func touchCacheEntry(p string) {
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil && !os.IsNotExist(err) {
+		log.Debugf("couldn't mark %s as used: %v", p, err)
+	}
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// EnforceCacheQuota evicts the least recently used imports and downloaded
+// base images in the stacker dir until they take up no more than
+// sc.MaxCacheSize bytes. These can always be fetched again, so evicting them
+// only costs time. Entries used since inUseSince (i.e. by the current build)
+// are never evicted.
+func EnforceCacheQuota(sc StackerConfig, inUseSince time.Time) error {
+	if sc.MaxCacheSize <= 0 {
+		return nil
+	}
+
+	entries := []cacheEntry{}
+	total := int64(0)
+	for _, dir := range []string{"imports", "layer-bases"} {
+		names, err := listDir(path.Join(sc.StackerDir, dir))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			p := path.Join(sc.StackerDir, dir, name)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+
+			size, err := DiskUsage(p)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, cacheEntry{p, size, fi.ModTime()})
+			total += size
+		}
+	}
+
+	if total <= sc.MaxCacheSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+
+	for _, e := range entries {
+		if total <= sc.MaxCacheSize {
+			break
+		}
+
+		if !e.lastUse.Before(inUseSince) {
+			continue
+		}
+
+		log.Infof("evicting %s (%s) from the cache", e.path, units.HumanSize(float64(e.size)))
+		if err := os.RemoveAll(e.path); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+
+	if total > sc.MaxCacheSize {
+		log.Warnf("cache is %s, over its %s limit, but everything left is in use",
+			units.HumanSize(float64(total)), units.HumanSize(float64(sc.MaxCacheSize)))
+	}
+
+	return nil
+}
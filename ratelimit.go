@@ -0,0 +1,68 @@
+package stacker
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter spreads reads out over time so that, together, they go no
+// faster than a rate. There is one of these for all downloads (see
+// downloadLimiter), so that parallel downloads share the limit instead of
+// each getting all of it.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// next is when the bytes that haven't been reserved yet may be read.
+	next time.Time
+}
+
+var downloadLimiter = &rateLimiter{}
+
+// reserve reserves n bytes at rate bytes per second, and returns how long to
+// wait before using them.
+func (l *rateLimiter) reserve(n int, rate int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	return wait
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	rate    int64
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Read at most a tenth of a second's worth at a time, so that the
+	// download is smooth rather than bursts followed by long pauses.
+	max := int(r.rate / 10)
+	if max < 1 {
+		max = 1
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := r.r.Read(p)
+	time.Sleep(r.limiter.reserve(n, r.rate))
+	return n, err
+}
+
+// limitDownload limits reads from r to c.DownloadRateLimit, shared with all
+// other downloads.
+func limitDownload(c StackerConfig, r io.Reader) io.Reader {
+	if c.DownloadRateLimit <= 0 {
+		return r
+	}
+
+	return &rateLimitedReader{r: r, rate: c.DownloadRateLimit, limiter: downloadLimiter}
+}
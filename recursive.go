@@ -0,0 +1,55 @@
+package stacker
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FindStackerfiles returns the paths of the files called name (usually
+// stacker.yaml) under dir, in lexical order. Hidden directories and the
+// directories in skip (e.g. stacker's own output, whose rootfses may well
+// contain stacker.yaml files) aren't searched.
+func FindStackerfiles(dir string, name string, skip []string) ([]string, error) {
+	skipped := map[string]bool{}
+	for _, s := range skip {
+		abs, err := filepath.Abs(s)
+		if err != nil {
+			return nil, err
+		}
+		skipped[abs] = true
+	}
+
+	found := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+
+			if skipped[abs] || (p != dir && strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.Name() == name {
+			found = append(found, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(found)
+	return found, nil
+}
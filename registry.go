@@ -0,0 +1,462 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestMediaTypes are the manifest media types stacker can copy.
+var manifestMediaTypes = []string{
+	ispec.MediaTypeImageManifest,
+	ispec.MediaTypeImageIndex,
+	dockerManifestMediaType,
+	dockerManifestListMediaType,
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageIndex || mediaType == dockerManifestListMediaType
+}
+
+// manifestMediaType is the media type of a raw manifest or index, from its
+// mediaType field, or from its shape if it doesn't have one (which OCI
+// doesn't require).
+func manifestMediaType(raw []byte) (string, error) {
+	m := struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return "", errors.Wrapf(err, "bad manifest")
+	}
+
+	if m.MediaType != "" {
+		return m.MediaType, nil
+	}
+
+	if m.Manifests != nil {
+		return ispec.MediaTypeImageIndex, nil
+	}
+
+	return ispec.MediaTypeImageManifest, nil
+}
+
+// parseDockerReference splits a docker:// url into the registry host, the
+// repository and the tag or digest, filling in docker.io's library/ and
+// latest the way docker does.
+func parseDockerReference(dockerUrl string) (string, string, string, error) {
+	if !strings.HasPrefix(dockerUrl, "docker://") {
+		return "", "", "", fmt.Errorf("%s is not a docker:// url", dockerUrl)
+	}
+
+	host := registryHost(dockerUrl)
+	ref := strings.TrimPrefix(strings.TrimPrefix(dockerUrl, "docker://"), "//")
+	if strings.HasPrefix(ref, host+"/") {
+		ref = strings.TrimPrefix(ref, host+"/")
+	}
+
+	repo, reference := ref, "latest"
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		repo, reference = ref[:idx], ref[idx+1:]
+		// A tag next to the digest is ignored, as in lock.go.
+		if colon := strings.LastIndex(repo, ":"); colon > strings.LastIndex(repo, "/") {
+			repo = repo[:colon]
+		}
+	} else if colon := strings.LastIndex(ref, ":"); colon > strings.LastIndex(ref, "/") {
+		repo, reference = ref[:colon], ref[colon+1:]
+	}
+
+	if repo == "" || reference == "" {
+		return "", "", "", fmt.Errorf("bad docker reference %s", dockerUrl)
+	}
+
+	if host == "docker.io" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+
+	return host, repo, reference, nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header into its scheme and
+// parameters, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return scheme, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
+
+// registryClient talks the OCI distribution API to one repository of a
+// registry.
+type registryClient struct {
+	c      StackerConfig
+	client *http.Client
+	host   string
+	base   string
+	repo   string
+	push   bool
+	auth   string
+}
+
+// newRegistryClient returns a client for the repository of dockerUrl,
+// authorized to pull from it (and push to it, if push is set) with the
+// configured credentials, and the tag or digest dockerUrl refers to.
+func newRegistryClient(c StackerConfig, dockerUrl string, push bool) (*registryClient, string, error) {
+	host, repo, reference, err := parseDockerReference(dockerUrl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiHost := host
+	if host == "docker.io" {
+		apiHost = "registry-1.docker.io"
+	}
+
+	client, err := httpClient(c, fmt.Sprintf("https://%s/v2/", apiHost))
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := &registryClient{c: c, client: client, host: host, base: fmt.Sprintf("https://%s", apiHost), repo: repo, push: push}
+
+	resp, err := client.Get(r.base + "/v2/")
+	if err != nil && c.isInsecure(host) {
+		r.base = fmt.Sprintf("http://%s", apiHost)
+		resp, err = client.Get(r.base + "/v2/")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return r, reference, nil
+	}
+
+	if err := r.authorize(resp); err != nil {
+		return nil, "", err
+	}
+
+	return r, reference, nil
+}
+
+// authorize sets up the client's authorization from the challenge in the
+// 401 response resp, with the configured credentials.
+func (r *registryClient) authorize(resp *http.Response) error {
+	username, password, err := registryCredentials(r.c, r.host)
+	if err != nil {
+		return err
+	}
+
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "basic":
+		if username == "" {
+			return fmt.Errorf("%s requires credentials", r.host)
+		}
+		r.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	case "bearer":
+		actions := "pull"
+		if r.push {
+			actions = "pull,push"
+		}
+
+		token, err := r.token(params, fmt.Sprintf("repository:%s:%s", r.repo, actions), username, password)
+		if err != nil {
+			return err
+		}
+		r.auth = "Bearer " + token
+	default:
+		return fmt.Errorf("%s wants unsupported authentication %q", r.host, scheme)
+	}
+
+	return nil
+}
+
+// token gets a bearer token for scope from the challenge's realm.
+func (r *registryClient) token(challenge map[string]string, scope string, username string, password string) (string, error) {
+	realm, err := neturl.Parse(challenge["realm"])
+	if err != nil || challenge["realm"] == "" {
+		return "", fmt.Errorf("bad bearer realm %q", challenge["realm"])
+	}
+
+	q := realm.Query()
+	if challenge["service"] != "" {
+		q.Set("service", challenge["service"])
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkRegistryResponse(resp, "getting token for %s", scope); err != nil {
+		return "", err
+	}
+
+	result := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrapf(err, "bad token response from %s", realm.Host)
+	}
+
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	return result.AccessToken, nil
+}
+
+// checkRegistryResponse turns a response that wasn't a success into an error
+// with the registry's explanation.
+func checkRegistryResponse(resp *http.Response, format string, args ...interface{}) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s: %s", fmt.Sprintf(format, args...), resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (r *registryClient) do(method string, url string, body io.Reader, header map[string]string) (*http.Response, error) {
+	return r.send(func() (*http.Request, error) {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	}, body)
+}
+
+// send sends the request newRequest makes, with the client's authorization.
+// If the registry rejects that (e.g. because the bearer token, which only
+// lasts a few minutes, expired), it is renewed and a new request is sent,
+// once, so long as body (the request's body, if any) can be rewound.
+func (r *registryClient) send(newRequest func() (*http.Request, error), body io.Reader) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || retried {
+			return resp, err
+		}
+
+		seeker, ok := body.(io.Seeker)
+		if body != nil && !ok {
+			return resp, nil
+		}
+
+		err = r.authorize(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (r *registryClient) url(kind string, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", r.base, r.repo, kind, reference)
+}
+
+func (r *registryClient) manifest(reference string) ([]byte, string, error) {
+	resp, err := r.do("GET", r.url("manifests", reference), nil, map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkRegistryResponse(resp, "getting manifest %s of %s", reference, r.repo); err != nil {
+		return nil, "", err
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mediaType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	if mediaType == "" || mediaType == "application/json" {
+		mediaType, err = manifestMediaType(raw)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return raw, mediaType, nil
+}
+
+func (r *registryClient) blob(d digest.Digest) (io.ReadCloser, error) {
+	resp, err := r.do("GET", r.url("blobs", d.String()), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegistryResponse(resp, "getting blob %s of %s", d, r.repo); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{limitDownload(r.c, resp.Body), resp.Body}, nil
+}
+
+func (r *registryClient) hasBlob(d digest.Digest) (bool, error) {
+	resp, err := r.do("HEAD", r.url("blobs", d.String()), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	return resp.StatusCode == http.StatusOK, checkRegistryResponse(resp, "checking for blob %s in %s", d, r.repo)
+}
+
+// putBlob uploads a blob in one go: a POST to start the upload, and a PUT of
+// the content to the location the registry gives back.
+func (r *registryClient) putBlob(desc ispec.Descriptor, content io.Reader) error {
+	resp, err := r.do("POST", fmt.Sprintf("%s/v2/%s/blobs/uploads/", r.base, r.repo), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := checkRegistryResponse(resp, "starting upload of %s to %s", desc.Digest, r.repo); err != nil {
+		return err
+	}
+
+	base, err := neturl.Parse(r.base)
+	if err != nil {
+		return err
+	}
+
+	location, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return errors.Wrapf(err, "bad upload location from %s", base.Host)
+	}
+
+	q := location.Query()
+	q.Set("digest", desc.Digest.String())
+	location.RawQuery = q.Encode()
+
+	// Streamed content can't be sent again, but the token was renewed
+	// for the POST if it had expired.
+	resp, err = r.send(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", location.String(), content)
+		if err != nil {
+			return nil, err
+		}
+
+		req.ContentLength = desc.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	}, content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkRegistryResponse(resp, "uploading %s to %s", desc.Digest, r.repo)
+}
+
+func (r *registryClient) putManifest(reference string, mediaType string, raw []byte) error {
+	resp, err := r.do("PUT", r.url("manifests", reference), bytes.NewReader(raw), map[string]string{
+		"Content-Type": mediaType,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkRegistryResponse(resp, "putting manifest %s to %s", reference, r.repo)
+}
+
+func (r *registryClient) close() error {
+	return nil
+}
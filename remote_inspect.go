@@ -0,0 +1,168 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RemotePlatform is one of the images of a multi-platform image in a
+// registry.
+type RemotePlatform struct {
+	Platform
+	Digest string
+}
+
+// RemoteLayer is a layer of an image in a registry.
+type RemoteLayer struct {
+	Digest    string
+	MediaType string
+	Size      int64
+}
+
+// RemoteImage is what InspectRemote finds out about an image in a registry.
+type RemoteImage struct {
+	Url string
+
+	// Digest is the digest of the manifest of the image for the
+	// configured (or host's) platform. For a multi-platform image,
+	// that's the digest of one of the Platforms, not of the index.
+	Digest string
+
+	// Platforms are the platforms the image is available for, if it is a
+	// multi-platform image.
+	Platforms []RemotePlatform
+
+	Layers []RemoteLayer
+	Config ispec.Image
+}
+
+// parseRemotePlatforms returns the platforms of the raw manifest, which are
+// only there if it is an index (or docker manifest list).
+func parseRemotePlatforms(raw []byte) ([]RemotePlatform, error) {
+	index := ispec.Index{}
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, err
+	}
+
+	platforms := []RemotePlatform{}
+	for _, m := range index.Manifests {
+		p := RemotePlatform{Digest: m.Digest.String()}
+		if m.Platform != nil {
+			p.OS = m.Platform.OS
+			p.Architecture = m.Platform.Architecture
+			p.Variant = m.Platform.Variant
+		}
+		platforms = append(platforms, p)
+	}
+
+	return platforms, nil
+}
+
+// remotePlatformDigest returns the digest of the manifest in platforms for
+// want, or "" if there isn't one. Without a variant, want matches any.
+func remotePlatformDigest(platforms []RemotePlatform, want Platform) string {
+	for _, p := range platforms {
+		if p.OS != want.OS || p.Architecture != want.Architecture {
+			continue
+		}
+
+		if want.Variant == "" || p.Variant == want.Variant {
+			return p.Digest
+		}
+	}
+
+	return ""
+}
+
+// skopeoInspect runs skopeo inspect on the image at dockerUrl, with args.
+func skopeoInspect(c StackerConfig, dockerUrl string, args ...string) ([]byte, error) {
+	registryArgs, cleanup, err := skopeoRegistryArgs(c, &ImageSource{Type: DockerType, Url: dockerUrl}, "")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	cmdArgs := []string{}
+	if c.Arch != "" {
+		cmdArgs = append(cmdArgs, "--override-arch", c.Arch)
+	}
+	cmdArgs = append(cmdArgs, "inspect")
+	cmdArgs = append(cmdArgs, args...)
+	cmdArgs = append(cmdArgs, registryArgs...)
+	cmdArgs = append(cmdArgs, dockerUrl)
+
+	output, err := exec.Command("skopeo", cmdArgs...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("skopeo inspect %s: %s: %s", dockerUrl, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("skopeo inspect %s: %s", dockerUrl, err)
+	}
+
+	return output, nil
+}
+
+// InspectRemote fetches the manifest and config of the image at the
+// docker:// url dockerUrl, without pulling its layers.
+func InspectRemote(c StackerConfig, dockerUrl string) (*RemoteImage, error) {
+	raw, err := skopeoInspect(c, dockerUrl, "--raw")
+	if err != nil {
+		return nil, err
+	}
+
+	platforms, err := parseRemotePlatforms(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := skopeoInspect(c, dockerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := struct {
+		Digest     string
+		LayersData []struct {
+			MIMEType string
+			Digest   string
+			Size     int64
+		}
+	}{}
+	if err := json.Unmarshal(output, &summary); err != nil {
+		return nil, err
+	}
+
+	result := &RemoteImage{Url: dockerUrl, Digest: summary.Digest, Platforms: platforms}
+
+	// skopeo gives the digest of what it fetched first, which for a
+	// multi-platform image is the index.
+	if len(platforms) > 0 {
+		want, err := (&Layer{}).ParsePlatform(c)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Digest = remotePlatformDigest(platforms, want)
+		if result.Digest == "" {
+			return nil, fmt.Errorf("%s has no image for %s/%s", dockerUrl, want.OS, want.Architecture)
+		}
+	}
+	for _, l := range summary.LayersData {
+		result.Layers = append(result.Layers, RemoteLayer{Digest: l.Digest, MediaType: l.MIMEType, Size: l.Size})
+	}
+
+	config, err := skopeoInspect(c, dockerUrl, "--config")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(config, &result.Config); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,248 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+func bundleMtreePath(bundle string, d ispec.Descriptor) string {
+	return path.Join(bundle, strings.Replace(d.Digest.String(), ":", "_", 1)+".mtree")
+}
+
+// Repack generates a layer from the changes made to the rootfs of the umoci
+// bundle since it was unpacked (or last repacked), adds it on top of the
+// image the bundle was unpacked from, and tags the result as name in the
+// layout at ociDir. If created isn't zero, it is used as the layer's history
+// timestamp. The bundle's mtree and metadata are updated to refer to the new
+// image, so that the bundle can be repacked again later.
+//
+// This does what "umoci repack --refresh-bundle" does, without needing the
+// umoci binary (which is still used to create and unpack images, see
+// umociInit and unpackBase). Since it needs to read every file in the
+// rootfs, it must be run as (possibly user namespaced) root; see RepackLayer.
+//
+// If touchedSince isn't zero, only the files whose ctime is after it are
+// re-hashed; the rest are assumed to have the digests recorded in the
+// bundle's mtree. Since nothing short of changing the clock can set a ctime
+// back, this is safe as long as touchedSince is taken before anything in the
+// rootfs is modified. Note that this only saves reading the files' contents:
+// the whole rootfs is still walked, and every file in it stat()ed, since
+// nothing tells us which paths the run section changed.
+func Repack(ociDir string, name string, bundle string, created time.Time, touchedSince time.Time) error {
+	meta, err := umoci.ReadBundleMeta(bundle)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read bundle metadata of %s", bundle)
+	}
+
+	oldMtree := bundleMtreePath(bundle, meta.From.Descriptor())
+	f, err := os.Open(oldMtree)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open bundle mtree")
+	}
+	defer f.Close()
+
+	spec, err := mtree.ParseSpec(f)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't parse %s", oldMtree)
+	}
+
+	rootfs := path.Join(bundle, "rootfs")
+	var newDH *mtree.DirectoryHierarchy
+	if touchedSince.IsZero() {
+		newDH, err = mtree.Walk(rootfs, nil, umoci.MtreeKeywords, nil)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't walk %s", rootfs)
+		}
+	} else {
+		keywords := []mtree.Keyword{}
+		for _, k := range umoci.MtreeKeywords {
+			if k != digestKeyword {
+				keywords = append(keywords, k)
+			}
+		}
+
+		newDH, err = mtree.Walk(rootfs, nil, keywords, nil)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't walk %s", rootfs)
+		}
+
+		if err := addDigests(rootfs, spec, newDH, touchedSince); err != nil {
+			return err
+		}
+	}
+
+	diffs, err := mtree.Compare(spec, newDH, umoci.MtreeKeywords)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't diff %s", rootfs)
+	}
+
+	reader, err := layer.GenerateLayer(rootfs, diffs, &layer.MapOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't generate layer")
+	}
+	defer reader.Close()
+
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	// Built bases aren't copied to the tag of the layer being built, so
+	// make sure it refers to what the bundle was unpacked from.
+	if err := oci.UpdateReference(name, meta.From.Root()); err != nil {
+		return err
+	}
+
+	mutator, err := oci.Mutator(name)
+	if err != nil {
+		return errors.Wrapf(err, "mutator failed")
+	}
+
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	history := &ispec.History{
+		Created:   &created,
+		CreatedBy: "stacker build",
+	}
+
+	ctx := context.Background()
+	if err := mutator.Add(ctx, reader, history); err != nil {
+		return errors.Wrapf(err, "couldn't add layer")
+	}
+
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := oci.UpdateReference(name, newPath.Root()); err != nil {
+		return err
+	}
+
+	// Now refresh the bundle, so that it can be repacked again.
+	out, err := os.Create(bundleMtreePath(bundle, newPath.Descriptor()))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := newDH.WriteTo(out); err != nil {
+		return err
+	}
+
+	if err := os.Remove(oldMtree); err != nil {
+		return err
+	}
+
+	return umoci.WriteBundleMeta(bundle, umoci.UmociMeta{Version: umoci.UmociMetaVersion, From: newPath})
+}
+
+const digestKeyword = mtree.Keyword("sha256digest")
+
+// ctimeSlop is how much earlier than touchedSince a ctime has to be for the
+// file to be considered untouched: the kernel stamps ctimes with a coarse
+// clock that can lag behind time.Now().
+const ctimeSlop = time.Second
+
+// addDigests adds sha256digest keywords to the regular files in dh, which
+// was walked without them. Files that are in old and haven't changed since
+// touchedSince keep the digest they had there; the others are hashed.
+func addDigests(rootfs string, old *mtree.DirectoryHierarchy, dh *mtree.DirectoryHierarchy, touchedSince time.Time) error {
+	oldDigests := map[string]mtree.KeyVal{}
+	for _, e := range old.Entries {
+		if e.Type != mtree.RelativeType && e.Type != mtree.FullType {
+			continue
+		}
+
+		p, err := e.Path()
+		if err != nil {
+			return err
+		}
+
+		if kv := mtree.HasKeyword(e.AllKeys(), digestKeyword); len(kv) > 0 {
+			oldDigests[p] = kv[0]
+		}
+	}
+
+	cutoff := touchedSince.Add(-ctimeSlop)
+	rehashed := 0
+	for i := range dh.Entries {
+		e := &dh.Entries[i]
+		if e.Type != mtree.RelativeType && e.Type != mtree.FullType {
+			continue
+		}
+
+		kind := mtree.HasKeyword(e.AllKeys(), "type")
+		if len(kind) == 0 || kind[0].Value() != "file" {
+			continue
+		}
+
+		p, err := e.Path()
+		if err != nil {
+			return err
+		}
+
+		// New files have to be hashed anyway, so only the ones that
+		// were there before need their ctime checked.
+		full := path.Join(rootfs, p)
+		if kv, ok := oldDigests[p]; ok {
+			st := unix.Stat_t{}
+			if err := unix.Lstat(full, &st); err != nil {
+				return errors.Wrapf(err, "couldn't stat %s", full)
+			}
+
+			if time.Unix(st.Ctim.Unix()).Before(cutoff) {
+				e.Keywords = append(e.Keywords, kv)
+				continue
+			}
+		}
+
+		h, err := hashFile(full)
+		if err != nil {
+			return err
+		}
+
+		hex := strings.TrimPrefix(h, "sha256:")
+		e.Keywords = append(e.Keywords, mtree.KeyVal(fmt.Sprintf("%s=%s", digestKeyword, hex)))
+		rehashed++
+	}
+
+	log.Debugf("re-hashed %d files changed since %s", rehashed, touchedSince)
+	return nil
+}
+
+// RepackLayer runs Repack for the bundle in the working rootfs. Unprivileged
+// users can't read everything in the rootfs, so in that case stacker re-execs
+// itself in the user namespace to do it.
+func RepackLayer(sc StackerConfig, name string, created time.Time, touchedSince time.Time) error {
+	bundle := path.Join(sc.RootFSDir, ".working")
+	if IdmapSet == nil {
+		return Repack(sc.OCIDir, name, bundle, created, touchedSince)
+	}
+
+	args := []string{os.Args[0], "internal-repack"}
+	if !created.IsZero() {
+		args = append(args, "--created", created.Format(time.RFC3339))
+	}
+	if !touchedSince.IsZero() {
+		args = append(args, "--touched-since", touchedSince.Format(time.RFC3339Nano))
+	}
+	args = append(args, sc.OCIDir, name, bundle)
+
+	return RunInUserns(args, fmt.Sprintf("repacking %s", name))
+}
@@ -0,0 +1,38 @@
+package stacker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ParseTimestamp parses a build timestamp, either as seconds since the epoch
+// (as in SOURCE_DATE_EPOCH) or in RFC3339 format.
+func ParseTimestamp(ts string) (time.Time, error) {
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s: must be seconds since the epoch or RFC3339", ts)
+	}
+
+	return t.UTC(), nil
+}
+
+// ClampMtimes sets the mtime of everything in rootfs that is newer than t to
+// t, so that files created or modified during the build don't make the
+// generated layer depend on when the build happened. This is done in the
+// userns, since the files may be owned by subuids.
+func ClampMtimes(rootfs string, t time.Time) error {
+	epoch := fmt.Sprintf("@%d", t.Unix())
+	args := []string{
+		"find", rootfs,
+		"-newermt", epoch,
+		"-exec", "touch", "--no-dereference", "--date", epoch, "{}", "+",
+	}
+
+	return MaybeRunInUserns(args, "clamping mtimes failed")
+}
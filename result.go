@@ -0,0 +1,79 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/openSUSE/umoci"
+)
+
+// LayerResult is one of the layer blobs of a built image.
+type LayerResult struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+// ImageResult describes one image a build produced.
+type ImageResult struct {
+	Tag            string        `json:"tag"`
+	ManifestDigest string        `json:"manifest_digest"`
+	ConfigDigest   string        `json:"config_digest"`
+	Size           int64         `json:"size"`
+	Layers         []LayerResult `json:"layers"`
+}
+
+// BuildResult describes what a build produced, so that later steps (e.g. in
+// CI) can use it without parsing stacker's output.
+type BuildResult struct {
+	Images []ImageResult `json:"images"`
+}
+
+// GetBuildResult looks up the images tagged tags in the layout at ociDir.
+func GetBuildResult(ociDir string, tags []string) (*BuildResult, error) {
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	result := &BuildResult{Images: []ImageResult{}}
+	for _, tag := range tags {
+		desc, err := oci.LookupManifestDescriptor(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := oci.LookupManifestByDescriptor(desc)
+		if err != nil {
+			return nil, err
+		}
+
+		image := ImageResult{
+			Tag:            tag,
+			ManifestDigest: desc.Digest.String(),
+			ConfigDigest:   manifest.Config.Digest.String(),
+			Layers:         []LayerResult{},
+		}
+
+		for _, l := range manifest.Layers {
+			image.Layers = append(image.Layers, LayerResult{
+				Digest:    l.Digest.String(),
+				MediaType: l.MediaType,
+				Size:      l.Size,
+			})
+			image.Size += l.Size
+		}
+
+		result.Images = append(result.Images, image)
+	}
+
+	return result, nil
+}
+
+// WriteJSON writes the result as JSON.
+func (r *BuildResult) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,153 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// buildProgress is what an atomic build records in the stacker dir while it
+// runs, so that if it fails or is killed part of the way through, a build
+// with BuildOpts.Resume can carry on in its staging layout, where the layers
+// it finished are cache hits, rather than starting over.
+type buildProgress struct {
+	// Staging is the staging layout, and Tmp the directory to remove with
+	// it; see stageLayout.
+	Staging string `json:"staging"`
+	Tmp     string `json:"tmp"`
+
+	// Index is the digest of the real layout's index.json when the build
+	// started; if it has changed since, committing the staging layout
+	// would lose the new tags, so it can't be resumed.
+	Index string `json:"index"`
+
+	// Layers are the layers the build finished.
+	Layers []string `json:"layers"`
+}
+
+func buildProgressPath(sc StackerConfig) string {
+	return path.Join(sc.StackerDir, "build-progress.json")
+}
+
+// readBuildProgress reads the progress of the last unfinished build, if
+// there is one.
+func readBuildProgress(sc StackerConfig) (*buildProgress, error) {
+	content, err := ioutil.ReadFile(buildProgressPath(sc))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p := &buildProgress{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, errors.Wrapf(err, "bad build progress %s", buildProgressPath(sc))
+	}
+
+	return p, nil
+}
+
+func (p *buildProgress) write(sc StackerConfig) error {
+	content, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(sc.StackerDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(buildProgressPath(sc), content, 0644)
+}
+
+// finished records that the layer name was built (or was a cache hit). A nil
+// *buildProgress (for non atomic builds) records nothing.
+func (p *buildProgress) finished(sc StackerConfig, name string) error {
+	if p == nil {
+		return nil
+	}
+
+	p.Layers = append(p.Layers, name)
+	return p.write(sc)
+}
+
+// done removes the progress and the staging layout, once the build has been
+// committed.
+func (p *buildProgress) done(sc StackerConfig) error {
+	if err := os.RemoveAll(p.Tmp); err != nil {
+		return err
+	}
+
+	return os.Remove(buildProgressPath(sc))
+}
+
+// indexDigest is the digest of the layout in ociDir's index.json, or "" if it
+// has none.
+func indexDigest(ociDir string) string {
+	content, err := ioutil.ReadFile(path.Join(ociDir, "index.json"))
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// stageBuild sets up the staging layout for an atomic build: with resume,
+// the one the last unfinished build left behind, if it is still usable;
+// otherwise a new one, throwing away what the unfinished build left.
+func stageBuild(sc StackerConfig, resume bool) (*buildProgress, error) {
+	prev, err := readBuildProgress(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	index := indexDigest(sc.OCIDir)
+	if prev != nil {
+		_, statErr := os.Stat(prev.Tmp)
+		if resume && statErr == nil && prev.Index == index {
+			log.Infof("resuming the previous build, which finished %d layers", len(prev.Layers))
+			prev.Layers = nil
+			return prev, nil
+		}
+
+		if resume {
+			log.Infof("%s has changed since the previous build, starting over", sc.OCIDir)
+		}
+
+		if err := os.RemoveAll(prev.Tmp); err != nil {
+			return nil, err
+		}
+	} else if resume {
+		log.Infof("no unfinished build to resume, starting over")
+	}
+
+	staging, tmp, err := stageLayout(sc.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &buildProgress{Staging: staging, Tmp: tmp, Index: index}
+	if err := p.write(sc); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// DiscardUnfinishedBuild removes what the last unfinished build left behind
+// for --resume, if anything.
+func DiscardUnfinishedBuild(sc StackerConfig) error {
+	p, err := readBuildProgress(sc)
+	if err != nil || p == nil {
+		return err
+	}
+
+	return p.done(sc)
+}
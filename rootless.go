@@ -0,0 +1,92 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+func init() {
+	RegisterStorage("dir", newDirStorage)
+}
+
+// dirStorage keeps each rootfs as a plain directory, and makes snapshots by
+// copying them. It is slower and uses more space than btrfs, but it doesn't
+// need any privilege to set up, so it's what --rootless uses. All the copies
+// are done inside the user namespace, so that the ownership of files in the
+// rootfs (which belong to subuids) is preserved.
+type dirStorage struct {
+	c StackerConfig
+}
+
+func newDirStorage(c StackerConfig) (Storage, error) {
+	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &dirStorage{c: c}, nil
+}
+
+func (d *dirStorage) Name() string {
+	return "dir"
+}
+
+func (d *dirStorage) Create(source string) error {
+	return os.MkdirAll(path.Join(d.c.RootFSDir, source), 0755)
+}
+
+func (d *dirStorage) copy(source string, target string) error {
+	// cp -a into an existing directory would copy source *into* it, so
+	// make sure it isn't there.
+	if err := d.Delete(target); err != nil {
+		return err
+	}
+
+	args := []string{
+		"cp",
+		"-a",
+		"--reflink=auto",
+		path.Join(d.c.RootFSDir, source),
+		path.Join(d.c.RootFSDir, target),
+	}
+	return MaybeRunInUserns(args, fmt.Sprintf("copying %s to %s", source, target))
+}
+
+func (d *dirStorage) Snapshot(source string, target string) error {
+	return d.copy(source, target)
+}
+
+func (d *dirStorage) Restore(source string, target string) error {
+	return d.copy(source, target)
+}
+
+func (d *dirStorage) Delete(source string) error {
+	p := path.Join(d.c.RootFSDir, source)
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return nil
+	}
+
+	return MaybeRunInUserns([]string{"rm", "-rf", p}, fmt.Sprintf("deleting %s", source))
+}
+
+func (d *dirStorage) Detach() error {
+	return nil
+}
+
+// CheckRootless checks that everything an unprivileged user needs to build
+// images is there: subuid and subgid delegations, unprivileged user
+// namespaces, and the helpers to set them up. It returns an error describing
+// the first thing that is missing.
+func CheckRootless() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	for _, r := range rootlessChecks() {
+		if r.Err != nil {
+			return WithKind(EnvironmentError, fmt.Errorf("%v; %s", r.Err, r.Remedy))
+		}
+	}
+
+	return nil
+}
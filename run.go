@@ -1,31 +1,142 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
+
+	"github.com/apex/log"
 )
 
-func Run(sc StackerConfig, name string, l *Layer, onFailure string) error {
+// ArtifactsDir is where run sections can write files for stacker to pick up:
+// KEY=VALUE lines in ArtifactsDir/labels and ArtifactsDir/annotations are
+// added to the image's labels and annotations.
+const ArtifactsDir = "/stacker-artifacts"
+
+// SSHAgentSocket is where the host's ssh agent socket is mounted in the
+// container during run sections, if it is being forwarded.
+const SSHAgentSocket = "/stacker-ssh-agent.sock"
+
+func artifactsDir(sc StackerConfig, name string) string {
+	return path.Join(sc.StackerDir, "artifacts", name)
+}
+
+// readKeyValues reads a file of KEY=VALUE lines; a missing file is the same
+// as an empty one.
+func readKeyValues(p string) (map[string]string, error) {
+	values := map[string]string{}
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid line in %s: %s", p, line)
+		}
+
+		values[parts[0]] = parts[1]
+	}
+
+	return values, nil
+}
+
+// RunArtifacts returns the labels and annotations that the last run of the
+// layer name's run section wrote to ArtifactsDir.
+func RunArtifacts(sc StackerConfig, name string) (map[string]string, map[string]string, error) {
+	dir := artifactsDir(sc, name)
+
+	labels, err := readKeyValues(path.Join(dir, "labels"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	annotations, err := readKeyValues(path.Join(dir, "annotations"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return labels, annotations, nil
+}
+
+// Run runs the layer's run section in the working rootfs. If it fails,
+// onFailure is run in the same container; if interactive is true, it (or a
+// shell, if onFailure is empty) is attached to stacker's terminal.
+func Run(ctx context.Context, sc StackerConfig, name string, l *Layer, onFailure string, interactive bool) error {
 	run, err := l.getRun()
 	if err != nil {
 		return err
 	}
 
+	// Don't pick up artifacts from a previous build of this layer.
+	artifacts := artifactsDir(sc, name)
+	if err := os.RemoveAll(artifacts); err != nil {
+		return err
+	}
+
 	if len(run) == 0 {
 		return nil
 	}
 
-	c, err := newContainer(sc, ".working")
+	c, err := newRunContainer(sc, ".working")
+	if err != nil {
+		return err
+	}
+
+	if err := c.setResources(l.Resources); err != nil {
+		return err
+	}
+
+	for _, kv := range l.buildEnv() {
+		if err := c.setEnv(kv); err != nil {
+			return err
+		}
+	}
+
+	network := l.Network
+	if network == "" {
+		network = sc.Network
+	}
+
+	if err := c.setNetwork(network); err != nil {
+		return err
+	}
+
+	dns := l.DNS
+	if len(dns) == 0 {
+		dns = sc.DNS
+	}
+
+	extraHosts := append([]string{}, sc.ExtraHosts...)
+	extraHosts = append(extraHosts, l.ExtraHosts...)
+
+	resolvConf, hosts, err := writeNetworkFiles(sc, name, dns, extraHosts)
 	if err != nil {
 		return err
 	}
 
 	importsDir := path.Join(sc.StackerDir, "imports", name)
 
-	script := fmt.Sprintf("#!/bin/bash -xe\n%s", strings.Join(run, "\n"))
+	if sc.SSHAuthSock != "" {
+		run = append([]string{fmt.Sprintf("export SSH_AUTH_SOCK=%s", SSHAgentSocket)}, run...)
+	}
+
+	script := l.runScript(run)
 	if err := ioutil.WriteFile(path.Join(importsDir, ".stacker-run.sh"), []byte(script), 0755); err != nil {
 		return err
 	}
@@ -36,24 +147,193 @@ func Run(sc StackerConfig, name string, l *Layer, onFailure string) error {
 	}
 	defer os.Remove(path.Join(sc.RootFSDir, ".working", "rootfs", "stacker"))
 
-	err = c.bindMount("/etc/resolv.conf", "/etc/resolv.conf")
+	if err := os.MkdirAll(artifacts, 0755); err != nil {
+		return err
+	}
+
+	err = c.bindMount(artifacts, ArtifactsDir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path.Join(sc.RootFSDir, ".working", "rootfs", ArtifactsDir))
+
+	if sc.SSHAuthSock != "" {
+		err = c.bindMount(sc.SSHAuthSock, SSHAgentSocket)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path.Join(sc.RootFSDir, ".working", "rootfs", SSHAgentSocket))
+	}
+
+	cleanupCacheDirs, err := mountBuildCacheDirs(sc, c, path.Join(sc.RootFSDir, ".working", "rootfs"), l.BuildCacheDirs)
+	if err != nil {
+		return err
+	}
+	defer cleanupCacheDirs()
+
+	if IsForeignArch(sc.Arch) {
+		cleanupEmulator, err := mountEmulator(c, path.Join(sc.RootFSDir, ".working", "rootfs"), sc.Arch)
+		if err != nil {
+			return err
+		}
+		defer cleanupEmulator()
+	}
+
+	if resolvConf == "" {
+		resolvConf = "/etc/resolv.conf"
+	}
+
+	err = c.bindMount(resolvConf, "/etc/resolv.conf")
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("running commands for", name)
+	if hosts != "" {
+		err = c.bindMount(hosts, "/etc/hosts")
+		if err != nil {
+			return err
+		}
+	}
+
+	timeout, err := l.ParseRunTimeout()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Join(sc.StackerDir, "logs"), 0755); err != nil {
+		return err
+	}
+
+	logPath := path.Join(sc.StackerDir, "logs", fmt.Sprintf("%s.log", name))
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	runLog := newTimestampWriter(logFile)
+	stdout := io.MultiWriter(os.Stdout, runLog)
+	stderr := io.MultiWriter(os.Stderr, runLog)
+
+	for attempt := 0; ; attempt++ {
+		log.Infof("running commands for %s", name)
+		fmt.Fprintf(runLog, "stacker: attempt %d of %d\n", attempt+1, l.RunRetries+1)
+
+		// These should all be non-interactive; let's ensure that.
+		err = executeWithTimeout(ctx, c, "/stacker/.stacker-run.sh", timeout, stdout, stderr)
+		if err == nil || attempt >= l.RunRetries {
+			break
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Infof("run commands failed (attempt %d of %d): %s; retrying", attempt+1, l.RunRetries+1, err)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		fmt.Fprintf(runLog, "stacker: run commands interrupted\n")
+		return interrupted(ctx)
+	}
 
-	// These should all be non-interactive; let's ensure that.
-	err = c.execute("/stacker/.stacker-run.sh", nil)
 	if err != nil {
+		if interactive {
+			if onFailure == "" {
+				onFailure = "/bin/sh"
+			}
+
+			log.Infof("run commands failed; running %s in the container, exit it to continue", onFailure)
+		}
+
 		if onFailure != "" {
-			err2 := c.execute(onFailure, os.Stdin)
+			err2 := c.execute(onFailure, os.Stdin, os.Stdout, os.Stderr)
 			if err2 != nil {
-				fmt.Printf("failed executing %s: %s\n", onFailure, err2)
+				log.Errorf("failed executing %s: %s", onFailure, err2)
 			}
 		}
-		err = fmt.Errorf("run commands failed: %s", err)
+		fmt.Fprintf(runLog, "stacker: run commands failed: %s\n", err)
+		err = WithKind(RunError, fmt.Errorf("run commands failed: %s (output is in %s)", err, logPath))
 	}
 
 	return err
 }
+
+// executeWithTimeout executes args in c with no stdin, stopping it and
+// failing if it takes longer than timeout (if timeout isn't 0), or if ctx is
+// cancelled.
+func executeWithTimeout(ctx context.Context, c runContainer, args string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.execute(args, nil, stdout, stderr)
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	stop := func() {
+		if err := c.stop(); err != nil {
+			log.Errorf("couldn't stop container: %s", err)
+		}
+		<-done
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-timedOut:
+		stop()
+		return fmt.Errorf("timed out after %s", timeout)
+	case <-ctx.Done():
+		log.Infof("interrupted, stopping container")
+		stop()
+		return ctx.Err()
+	}
+}
+
+// DefaultShell is the shell that run sections are run with if the layer
+// doesn't set one.
+const DefaultShell = "/bin/bash"
+
+// runScript is the script that runs the commands of the layer's run section,
+// with its shell and shell options.
+func (l *Layer) runScript(run []string) string {
+	shell := l.Shell
+	if shell == "" {
+		shell = DefaultShell
+	}
+
+	opts := l.ShellOptions
+	if opts == nil {
+		opts = &ShellOptions{}
+	}
+
+	enabled := func(opt *bool, def bool) bool {
+		if opt == nil {
+			return def
+		}
+		return *opt
+	}
+
+	lines := []string{fmt.Sprintf("#!%s", shell)}
+	if enabled(opts.Errexit, true) {
+		lines = append(lines, "set -e")
+	}
+	if enabled(opts.Nounset, false) {
+		lines = append(lines, "set -u")
+	}
+	if enabled(opts.Pipefail, false) {
+		lines = append(lines, "set -o pipefail")
+	}
+
+	// Last, so that the other options aren't traced.
+	if enabled(opts.Xtrace, true) {
+		lines = append(lines, "set -x")
+	}
+
+	return strings.Join(append(lines, run...), "\n")
+}
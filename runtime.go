@@ -0,0 +1,241 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/docker/go-units"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// LXCRuntime is the name of the built-in runtime, which runs containers with
+// liblxc. Any other StackerConfig.Runtime is taken to be the name (or path)
+// of an OCI runtime binary, e.g. runc or crun.
+const LXCRuntime = "lxc"
+
+// runContainer is a container that run sections are executed in.
+type runContainer interface {
+	setResources(r *Resources) error
+	setNetwork(mode string) error
+	bindMount(source string, dest string) error
+	// setEnv adds a KEY=value pair to the environment args are executed
+	// with.
+	setEnv(kv string) error
+	// execute runs args with the given stdio.
+	execute(args string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+
+	// stop kills whatever is running in the container.
+	stop() error
+}
+
+// newRunContainer sets up a container for the rootfs name with the runtime
+// selected in sc.
+func newRunContainer(sc StackerConfig, name string) (runContainer, error) {
+	if sc.Runtime == "" || sc.Runtime == LXCRuntime {
+		if len(sc.RuntimeArgs) > 0 {
+			return nil, fmt.Errorf("the lxc runtime doesn't take runtime arguments")
+		}
+
+		return newContainer(sc, name)
+	}
+
+	return newOCIContainer(sc, name)
+}
+
+// defaultCapabilities are the capabilities processes in OCI runtime
+// containers get; they're the same as docker's defaults.
+var defaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// ociContainer runs commands with an external OCI runtime, by generating a
+// runtime spec for the rootfs and calling "<runtime> run" on it.
+type ociContainer struct {
+	sc      StackerConfig
+	name    string
+	runtime string
+	spec    rspec.Spec
+}
+
+func newOCIContainer(sc StackerConfig, name string) (*ociContainer, error) {
+	runtime, err := exec.LookPath(sc.Runtime)
+	if err != nil {
+		return nil, fmt.Errorf("runtime %s not found: %s", sc.Runtime, err)
+	}
+
+	env := append([]string{fmt.Sprintf("PATH=%s", ReasonableDefaultPath)}, passthroughEnv()...)
+
+	c := &ociContainer{
+		sc:      sc,
+		name:    name,
+		runtime: runtime,
+		spec: rspec.Spec{
+			Version: rspec.Version,
+			Process: &rspec.Process{
+				Env: env,
+				Cwd: "/",
+				Capabilities: &rspec.LinuxCapabilities{
+					Bounding:    defaultCapabilities,
+					Effective:   defaultCapabilities,
+					Inheritable: defaultCapabilities,
+					Permitted:   defaultCapabilities,
+				},
+			},
+			Root: &rspec.Root{
+				Path: path.Join(sc.RootFSDir, name, "rootfs"),
+			},
+			Hostname: name,
+			Mounts: []rspec.Mount{
+				{Destination: "/proc", Type: "proc", Source: "proc"},
+				{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+				{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+				{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+				{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+				{Destination: "/sys", Type: "bind", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}},
+			},
+			Linux: &rspec.Linux{
+				Namespaces: []rspec.LinuxNamespace{
+					{Type: rspec.PIDNamespace},
+					{Type: rspec.IPCNamespace},
+					{Type: rspec.UTSNamespace},
+					{Type: rspec.MountNamespace},
+				},
+			},
+		},
+	}
+
+	if IdmapSet != nil {
+		mapOptions := umociMapOptions()
+		c.spec.Linux.UIDMappings = mapOptions.UIDMappings
+		c.spec.Linux.GIDMappings = mapOptions.GIDMappings
+		c.spec.Linux.Namespaces = append(c.spec.Linux.Namespaces, rspec.LinuxNamespace{Type: rspec.UserNamespace})
+	}
+
+	return c, nil
+}
+
+func (c *ociContainer) setResources(r *Resources) error {
+	if r == nil {
+		return nil
+	}
+
+	resources := &rspec.LinuxResources{}
+
+	if r.Memory != "" {
+		mem, err := units.RAMInBytes(r.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit %s: %s", r.Memory, err)
+		}
+		resources.Memory = &rspec.LinuxMemory{Limit: &mem}
+	}
+
+	if r.CPUs > 0 {
+		quota := int64(r.CPUs * cpuPeriod)
+		period := uint64(cpuPeriod)
+		resources.CPU = &rspec.LinuxCPU{Quota: &quota, Period: &period}
+	}
+
+	if r.Pids > 0 {
+		resources.Pids = &rspec.LinuxPids{Limit: r.Pids}
+	}
+
+	c.spec.Linux.Resources = resources
+	return nil
+}
+
+func (c *ociContainer) setNetwork(mode string) error {
+	switch mode {
+	case "", NetworkHost:
+		return nil
+	case NetworkNone:
+		c.spec.Linux.Namespaces = append(c.spec.Linux.Namespaces, rspec.LinuxNamespace{Type: rspec.NetworkNamespace})
+		return nil
+	case NetworkBridge:
+		return fmt.Errorf("bridge networking is only supported by the lxc runtime")
+	default:
+		return fmt.Errorf("unknown network mode %s", mode)
+	}
+}
+
+// id is the name the container is known as to the runtime.
+func (c *ociContainer) id() string {
+	return fmt.Sprintf("stacker-%d", os.Getpid())
+}
+
+func (c *ociContainer) stop() error {
+	args := append([]string{}, c.sc.RuntimeArgs...)
+	args = append(args, "kill", "--all", c.id(), "KILL")
+
+	output, err := exec.Command(c.runtime, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s kill: %s: %s", c.sc.Runtime, err, output)
+	}
+
+	return nil
+}
+
+func (c *ociContainer) setEnv(kv string) error {
+	c.spec.Process.Env = append(c.spec.Process.Env, kv)
+	return nil
+}
+
+func (c *ociContainer) bindMount(source string, dest string) error {
+	c.spec.Mounts = append(c.spec.Mounts, rspec.Mount{
+		Destination: dest,
+		Type:        "bind",
+		Source:      source,
+		Options:     []string{"rbind"},
+	})
+	return nil
+}
+
+func (c *ociContainer) execute(args string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	// The bundle lives outside the rootfs' directory, since that is also
+	// umoci's bundle and has its own config.json.
+	bundle := path.Join(c.sc.StackerDir, "runtime", c.name)
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return err
+	}
+
+	c.spec.Process.Args = []string{"/bin/sh", "-c", args}
+
+	// The runtime needs to set up a pty for interactive commands.
+	f, ok := stdin.(*os.File)
+	c.spec.Process.Terminal = ok && isTerminal(f)
+
+	content, err := json.MarshalIndent(c.spec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(bundle, "config.json"), content, 0644); err != nil {
+		return err
+	}
+
+	runtimeArgs := append([]string{}, c.sc.RuntimeArgs...)
+	runtimeArgs = append(runtimeArgs, "run", "--bundle", bundle, c.id())
+
+	cmd := exec.Command(c.runtime, runtimeArgs...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -0,0 +1,74 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/openSUSE/umoci"
+)
+
+// SBOMFormat is the name of a format that syft can generate an SBOM in.
+type SBOMFormat string
+
+const (
+	SPDXFormat      SBOMFormat = "spdx-json"
+	CycloneDXFormat SBOMFormat = "cyclonedx-json"
+)
+
+// ParseSBOMFormat parses the name of an SBOM format.
+func ParseSBOMFormat(name string) (SBOMFormat, error) {
+	switch f := SBOMFormat(name); f {
+	case SPDXFormat, CycloneDXFormat:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown sbom format %s", name)
+	}
+}
+
+// MediaType is the media type of an SBOM in this format.
+func (f SBOMFormat) MediaType() string {
+	if f == CycloneDXFormat {
+		return "application/vnd.cyclonedx+json"
+	}
+	return "text/spdx+json"
+}
+
+// GenerateSBOM scans the rootfs of the image tagged name with syft, and
+// attaches the resulting SBOM to the image (as sha256-<manifest hex>.sbom,
+// the way cosign does). If outDir is not empty, the SBOM is also written
+// there as <name>.<format>.
+func GenerateSBOM(sc StackerConfig, oci *umoci.Layout, name string, rootfs string, format SBOMFormat, outDir string) error {
+	tmpdir, err := ioutil.TempDir(sc.StackerDir, "sbom")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Run it in the userns so that syft can read everything in the
+	// rootfs, regardless of who owns it.
+	out := path.Join(tmpdir, "sbom.json")
+	args := []string{"syft", "-q", fmt.Sprintf("dir:%s", rootfs), "-o", fmt.Sprintf("%s=%s", format, out)}
+	if err := MaybeRunInUserns(args, "sbom generation failed"); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+
+		p := path.Join(outDir, fmt.Sprintf("%s.%s", name, format))
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	return addArtifact(sc.OCIDir, oci, name, "sbom", format.MediaType(), content, nil)
+}
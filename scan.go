@@ -0,0 +1,235 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/pkg/errors"
+)
+
+// Scanner is the name of a vulnerability scanner stacker can run against
+// built images.
+type Scanner string
+
+const (
+	TrivyScanner Scanner = "trivy"
+	GrypeScanner Scanner = "grype"
+)
+
+// ParseScanner parses the name of a vulnerability scanner.
+func ParseScanner(name string) (Scanner, error) {
+	switch s := Scanner(name); s {
+	case TrivyScanner, GrypeScanner:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown scanner %s", name)
+	}
+}
+
+// MediaType is the media type of this scanner's JSON reports.
+func (s Scanner) MediaType() string {
+	if s == GrypeScanner {
+		return "application/vnd.anchore.grype.report+json"
+	}
+	return "application/vnd.aquasec.trivy.report+json"
+}
+
+// Severity is how bad a vulnerability is; the zero value is unknown.
+type Severity int
+
+const (
+	UnknownSeverity Severity = iota
+	LowSeverity
+	MediumSeverity
+	HighSeverity
+	CriticalSeverity
+)
+
+// ParseSeverity parses a severity as reported by trivy or grype, case
+// insensitively. grype's "negligible" counts as low.
+func ParseSeverity(name string) (Severity, error) {
+	switch strings.ToLower(name) {
+	case "unknown", "":
+		return UnknownSeverity, nil
+	case "negligible", "low":
+		return LowSeverity, nil
+	case "medium":
+		return MediumSeverity, nil
+	case "high":
+		return HighSeverity, nil
+	case "critical":
+		return CriticalSeverity, nil
+	default:
+		return UnknownSeverity, fmt.Errorf("unknown severity %s", name)
+	}
+}
+
+func (s Severity) String() string {
+	switch s {
+	case LowSeverity:
+		return "LOW"
+	case MediumSeverity:
+		return "MEDIUM"
+	case HighSeverity:
+		return "HIGH"
+	case CriticalSeverity:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ScanOpts are the options for scanning built images.
+type ScanOpts struct {
+	Scanner Scanner
+
+	// Server, if not empty, is the url of a trivy server to scan with,
+	// rather than scanning locally.
+	Server string
+
+	// FailOn, if not UnknownSeverity, fails the build if anything at
+	// least this severe is found.
+	FailOn Severity
+
+	// OutDir, if not empty, is where to also write the reports, as
+	// <name>.<scanner>.json.
+	OutDir string
+}
+
+// ScanFinding is a vulnerability a scanner found.
+type ScanFinding struct {
+	ID       string
+	Package  string
+	Severity Severity
+}
+
+// parseScanReport gets the findings out of a scanner's JSON report.
+func parseScanReport(scanner Scanner, content []byte) ([]ScanFinding, error) {
+	findings := []ScanFinding{}
+
+	switch scanner {
+	case TrivyScanner:
+		report := struct {
+			Results []struct {
+				Vulnerabilities []struct {
+					VulnerabilityID string
+					PkgName         string
+					Severity        string
+				}
+			}
+		}{}
+		if err := json.Unmarshal(content, &report); err != nil {
+			return nil, errors.Wrapf(err, "bad trivy report")
+		}
+
+		for _, result := range report.Results {
+			for _, v := range result.Vulnerabilities {
+				severity, _ := ParseSeverity(v.Severity)
+				findings = append(findings, ScanFinding{ID: v.VulnerabilityID, Package: v.PkgName, Severity: severity})
+			}
+		}
+	case GrypeScanner:
+		report := struct {
+			Matches []struct {
+				Vulnerability struct {
+					ID       string `json:"id"`
+					Severity string `json:"severity"`
+				} `json:"vulnerability"`
+				Artifact struct {
+					Name string `json:"name"`
+				} `json:"artifact"`
+			} `json:"matches"`
+		}{}
+		if err := json.Unmarshal(content, &report); err != nil {
+			return nil, errors.Wrapf(err, "bad grype report")
+		}
+
+		for _, m := range report.Matches {
+			severity, _ := ParseSeverity(m.Vulnerability.Severity)
+			findings = append(findings, ScanFinding{ID: m.Vulnerability.ID, Package: m.Artifact.Name, Severity: severity})
+		}
+	default:
+		return nil, fmt.Errorf("unknown scanner %s", scanner)
+	}
+
+	return findings, nil
+}
+
+// scanArgs is the command line to scan rootfs with, writing a JSON report to
+// out.
+func scanArgs(opts ScanOpts, rootfs string, out string) []string {
+	if opts.Scanner == GrypeScanner {
+		return []string{"grype", "-q", fmt.Sprintf("dir:%s", rootfs), "-o", "json", "--file", out}
+	}
+
+	args := []string{"trivy", "rootfs", "-q", "--format", "json", "--output", out}
+	if opts.Server != "" {
+		args = append(args, "--server", opts.Server)
+	}
+	return append(args, rootfs)
+}
+
+// ScanImage scans the rootfs of the image tagged name for vulnerabilities,
+// and attaches the report to the image (as sha256-<manifest hex>.scan). If
+// opts.FailOn is set, it fails if anything that severe was found, after
+// attaching the report.
+func ScanImage(sc StackerConfig, oci *umoci.Layout, name string, rootfs string, opts ScanOpts) error {
+	tmpdir, err := ioutil.TempDir(sc.StackerDir, "scan")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Like syft, run it in the userns so that it can read everything in
+	// the rootfs.
+	out := path.Join(tmpdir, "report.json")
+	if err := MaybeRunInUserns(scanArgs(opts, rootfs, out), "vulnerability scan failed"); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+
+	findings, err := parseScanReport(opts.Scanner, content)
+	if err != nil {
+		return err
+	}
+
+	if opts.OutDir != "" {
+		if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+			return err
+		}
+
+		p := path.Join(opts.OutDir, fmt.Sprintf("%s.%s.json", name, opts.Scanner))
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := addArtifact(sc.OCIDir, oci, name, "scan", opts.Scanner.MediaType(), content, nil); err != nil {
+		return err
+	}
+
+	failed := []string{}
+	for _, f := range findings {
+		if opts.FailOn != UnknownSeverity && f.Severity >= opts.FailOn {
+			failed = append(failed, fmt.Sprintf("%s (%s, %s)", f.ID, f.Package, f.Severity))
+		}
+	}
+
+	log.Infof("%s found %d vulnerabilities in %s", opts.Scanner, len(findings), name)
+	if len(failed) > 0 {
+		return fmt.Errorf("%s has %d vulnerabilities of severity %s or worse: %s",
+			name, len(failed), opts.FailOn, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
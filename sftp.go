@@ -0,0 +1,115 @@
+package stacker
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// scpArgs are the arguments to scp to copy the sftp:// or scp:// url u to
+// dest. Paths in the url are absolute, except that /~/ at the start means
+// the user's home directory. rateLimit, if positive, is the most bytes per
+// second scp may use; scp can't share it with the other downloads.
+func scpArgs(u *url.URL, dest string, rateLimit int64) []string {
+	// BatchMode, so that a missing key fails rather than asking for a
+	// password that nobody will type.
+	args := []string{"-q", "-r", "-o", "BatchMode=yes"}
+	if rateLimit > 0 {
+		// scp's limit is in Kbit/s.
+		kbits := rateLimit * 8 / 1000
+		if kbits < 1 {
+			kbits = 1
+		}
+		args = append(args, "-l", strconv.FormatInt(kbits, 10))
+	}
+	if u.Port() != "" {
+		args = append(args, "-P", u.Port())
+	}
+
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = fmt.Sprintf("[%s]", host)
+	}
+
+	if u.User != nil {
+		host = fmt.Sprintf("%s@%s", u.User.Username(), host)
+	}
+
+	remote := u.Path
+	if strings.HasPrefix(remote, "/~/") {
+		remote = strings.TrimPrefix(remote, "/~/")
+	}
+
+	// The host is checked by acquireSFTP, but -- makes sure scp doesn't
+	// take it as an option anyway.
+	return append(args, "--", fmt.Sprintf("%s:%s", host, remote), dest)
+}
+
+// acquireSFTP fetches sftp:// and scp:// imports with scp, so that the user's
+// ssh config, keys and agent (or the one given with --ssh) are used. Like
+// http imports, they aren't fetched again while there is a cached copy.
+func acquireSFTP(c StackerConfig, u *url.URL, cacheDir string) (string, error) {
+	if _, ok := u.User.Password(); ok {
+		return "", fmt.Errorf("%s imports use ssh keys, not passwords", u.Scheme)
+	}
+
+	// ssh takes hosts (and users) starting with - as options, e.g.
+	// -oProxyCommand=..., which would run whatever they say.
+	if u.Hostname() == "" || strings.HasPrefix(u.Hostname(), "-") || strings.HasPrefix(u.User.Username(), "-") {
+		return "", fmt.Errorf("bad %s host in %s", u.Scheme, u)
+	}
+
+	dest := path.Join(cacheDir, path.Base(u.Path))
+	if _, err := os.Stat(dest); err == nil {
+		log.Infof("using cached copy of %s", u)
+	} else {
+		log.Infof("copying %s", u)
+
+		// Copy to a temporary name, so that a failure part of the
+		// way through doesn't leave a partial cached copy.
+		tmp := dest + ".partial"
+		os.RemoveAll(tmp)
+
+		cmd := exec.Command("scp", scpArgs(u, tmp, c.DownloadRateLimit)...)
+		cmd.Env = os.Environ()
+		if c.SSHAuthSock != "" {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", c.SSHAuthSock))
+		}
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", fmt.Errorf("couldn't copy %s: %s: %s", u, err, strings.TrimSpace(string(output)))
+		}
+
+		if err := os.Rename(tmp, dest); err != nil {
+			return "", err
+		}
+	}
+
+	if c.Lock != nil {
+		fi, err := os.Stat(dest)
+		if err != nil {
+			return "", err
+		}
+
+		if !fi.IsDir() {
+			h, err := hashFile(dest)
+			if err != nil {
+				return "", err
+			}
+
+			if err := c.Lock.VerifyImport(u.String(), h); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dest, nil
+}
@@ -0,0 +1,168 @@
+package stacker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnno    = "dev.cosignproject.cosign/signature"
+)
+
+// IsArtifactTag returns true if tag is one of the tags that stacker (and
+// cosign) use to attach artifacts to an image, e.g. sha256-<hex>.sig, rather
+// than an image itself.
+func IsArtifactTag(tag string) bool {
+	return artifactTagPattern.MatchString(tag)
+}
+
+var artifactTagPattern = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.[a-z]+$`)
+
+// artifactTag is the tag under which an artifact of kind (e.g. "sig") for the
+// manifest d is stored, following cosign's conventions.
+func artifactTag(d digest.Digest, kind string) string {
+	return fmt.Sprintf("%s-%s.%s", d.Algorithm(), d.Hex(), kind)
+}
+
+// LoadSigningKey loads an unencrypted PEM encoded ECDSA, RSA, or ed25519
+// private key.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key type %s in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", path)
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T in %s", key, path)
+	}
+}
+
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	h := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+// addArtifact writes an artifact manifest whose single layer is content to
+// the layout, and tags it as the kind artifact of the image tagged name.
+func addArtifact(ociDir string, oci *umoci.Layout, name string, kind string, mediaType string, content []byte, annotations map[string]string) error {
+	manifestDesc, err := oci.LookupManifestDescriptor(name)
+	if err != nil {
+		return err
+	}
+
+	configDesc, err := writeLayoutBlob(ociDir, ispec.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		return err
+	}
+
+	layerDesc, err := writeLayoutBlob(ociDir, mediaType, content)
+	if err != nil {
+		return err
+	}
+	layerDesc.Annotations = annotations
+
+	manifest := ispec.Manifest{
+		Config: configDesc,
+		Layers: []ispec.Descriptor{layerDesc},
+	}
+	manifest.SchemaVersion = 2
+
+	rawManifest, err := marshalBlob(manifest)
+	if err != nil {
+		return err
+	}
+
+	desc, err := writeLayoutBlob(ociDir, ispec.MediaTypeImageManifest, rawManifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(artifactTag(manifestDesc.Digest, kind), desc)
+}
+
+// SignImage signs the manifest of the image tagged name with signer, and
+// stores the signature in the layout the way cosign does: as an image tagged
+// sha256-<manifest hex>.sig whose layer is the signed payload, so that
+// pushing the layout to a registry yields a cosign-verifiable signature.
+func SignImage(ociDir string, oci *umoci.Layout, name string, signer crypto.Signer) error {
+	manifestDesc, err := oci.LookupManifestDescriptor(name)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{
+				"docker-reference": name,
+			},
+			"image": map[string]string{
+				"docker-manifest-digest": manifestDesc.Digest.String(),
+			},
+			"type": "cosign container image signature",
+		},
+		"optional": nil,
+	}
+
+	rawPayload, err := marshalBlob(payload)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signPayload(signer, rawPayload)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't sign %s", name)
+	}
+
+	annotations := map[string]string{
+		cosignSignatureAnno: base64.StdEncoding.EncodeToString(sig),
+	}
+
+	return addArtifact(ociDir, oci, name, "sig", MediaTypeSimpleSigning, rawPayload, annotations)
+}
@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSignPayload(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tf, err := ioutil.TempFile("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	if err := pem.Encode(tf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	signer, err := LoadSigningKey(tf.Name())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	payload := []byte(`{"critical":{}}`)
+	sig, err := signPayload(signer, payload)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	h := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(&key.PublicKey, h[:], sig) {
+		t.Fatalf("signature didn't verify")
+	}
+}
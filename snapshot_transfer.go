@@ -0,0 +1,153 @@
+package stacker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+)
+
+// snapshotHeader is the first line of a SendSnapshot stream, before the
+// storage's own serialization of the snapshot.
+type snapshotHeader struct {
+	Name    string `json:"name"`
+	Storage string `json:"storage"`
+
+	// Cache is the build cache entry for the layer, so that the receiver
+	// can use the snapshot instead of building it.
+	Cache map[string]CacheEntry `json:"cache"`
+
+	// Key is the cache key the snapshot was built with.
+	Key string `json:"key"`
+}
+
+// SendSnapshot writes the snapshot of the layer name, along with its build
+// cache entries, to w, for ReceiveSnapshot on another machine. This is meant
+// for build only layers (e.g. toolchains), which have no image: for other
+// layers, the receiver would need the image too to use the snapshot.
+func SendSnapshot(sc StackerConfig, name string, w io.Writer) error {
+	s, err := NewStorage(sc)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	sender, ok := s.(SnapshotSender)
+	if !ok {
+		return WithKind(UserError, fmt.Errorf("the %s storage can't send snapshots", s.Name()))
+	}
+
+	if _, err := os.Stat(path.Join(sc.RootFSDir, name, "rootfs")); err != nil {
+		return WithKind(UserError, fmt.Errorf("no snapshot %s", name))
+	}
+
+	header := snapshotHeader{Name: name, Storage: s.Name(), Cache: map[string]CacheEntry{}}
+
+	oci, err := umoci.OpenLayout(sc.OCIDir)
+	if err == nil {
+		defer oci.Close()
+
+		cache, err := OpenCache(sc.StackerDir, oci)
+		if err != nil {
+			return err
+		}
+
+		// Only the entry the snapshot was built from applies to it.
+		header.Key = cache.snapshotKey(name)
+		if ent, ok := cache.Cache[header.Key]; ok && ent.Name == name {
+			header.Cache[header.Key] = ent
+		}
+	}
+
+	if len(header.Cache) == 0 {
+		log.Infof("%s isn't in the build cache; it will be rebuilt where it is received", name)
+	}
+
+	content, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(content, '\n')); err != nil {
+		return err
+	}
+
+	return sender.Send(name, w)
+}
+
+// ReceiveSnapshot creates the snapshot that SendSnapshot wrote to r, and adds
+// its build cache entries to the build cache, returning its name. If force is
+// true, an existing snapshot with the same name is replaced.
+func ReceiveSnapshot(sc StackerConfig, r io.Reader, force bool) (string, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return "", fmt.Errorf("couldn't read snapshot header: %s", err)
+	}
+
+	header := snapshotHeader{}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return "", fmt.Errorf("bad snapshot header: %s", err)
+	}
+
+	if header.Name == "" || path.Base(header.Name) != header.Name {
+		return "", fmt.Errorf("bad snapshot name %q", header.Name)
+	}
+
+	s, err := NewStorage(sc)
+	if err != nil {
+		return "", err
+	}
+	defer s.Detach()
+
+	receiver, ok := s.(SnapshotSender)
+	if !ok {
+		return "", WithKind(UserError, fmt.Errorf("the %s storage can't receive snapshots", s.Name()))
+	}
+
+	if header.Storage != s.Name() {
+		return "", WithKind(UserError, fmt.Errorf("%s was sent from %s storage, not %s", header.Name, header.Storage, s.Name()))
+	}
+
+	if err := os.MkdirAll(sc.StackerDir, 0755); err != nil {
+		return "", err
+	}
+
+	cache, err := readCache(sc.StackerDir)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path.Join(sc.RootFSDir, header.Name)); err == nil {
+		if !force {
+			return "", WithKind(UserError, fmt.Errorf("snapshot %s already exists", header.Name))
+		}
+
+		if err := cache.ForgetSnapshot(header.Name); err != nil {
+			return "", err
+		}
+
+		if err := s.Delete(header.Name); err != nil {
+			return "", err
+		}
+	}
+
+	if err := receiver.Receive(header.Name, br); err != nil {
+		return "", err
+	}
+
+	for key, ent := range header.Cache {
+		cache.Cache[key] = ent
+	}
+
+	if err := cache.setSnapshotKey(header.Name, header.Key); err != nil {
+		return "", err
+	}
+
+	return header.Name, cache.persist()
+}
@@ -0,0 +1,110 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// squashfsCompressor is the tar2sqfs compressor for the layer compression
+// c, and its --comp-extra options for level (0 being the default).
+func squashfsCompressor(c Compression, level int) ([]string, error) {
+	var name string
+	switch c {
+	case GzipCompression, EstargzCompression:
+		name = "gzip"
+	case ZstdCompression:
+		name = "zstd"
+	default:
+		return nil, WithKind(UserError, fmt.Errorf("squashfs layers can't use %s compression", c))
+	}
+
+	args := []string{"--compressor", name}
+	if level != 0 {
+		args = append(args, "--comp-extra", fmt.Sprintf("level=%d", level))
+	}
+
+	return args, nil
+}
+
+// tarToSquashfs converts the tar layer blob desc to a squashfs layer blob,
+// compressed with c at level. Since tar2sqfs reads the ownership and modes
+// from the tar stream, this doesn't require any privilege.
+func tarToSquashfs(ociDir string, desc ispec.Descriptor, c Compression, level int) (ispec.Descriptor, error) {
+	compressor, err := squashfsCompressor(c, level)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	in, err := os.Open(layoutBlobPath(ociDir, desc.Digest))
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer in.Close()
+
+	uncompressed, err := decompressor(desc.MediaType, in)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer uncompressed.Close()
+
+	if isEstargz(desc) {
+		uncompressed = withoutEstargzEntries(uncompressed)
+		defer uncompressed.Close()
+	}
+
+	tmpdir, err := ioutil.TempDir(path.Join(ociDir, "blobs"), ".squashfs")
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	out := path.Join(tmpdir, "layer.squashfs")
+	args := append([]string{"--quiet", "--force"}, compressor...)
+	cmd := exec.Command("tar2sqfs", append(args, out)...)
+	cmd.Stdin = uncompressed
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("tar2sqfs: %s: %s", err, stderr.String())
+	}
+
+	return moveLayoutBlob(ociDir, MediaTypeImageSquashfsLayer, out)
+}
+
+// ConvertToSquashfs converts the layers of the image tagged name to squashfs
+// layers compressed with c at level, and tags the result as newName (which
+// may be the same as name). Layers that are squashfs already are left alone.
+// Since squashfs layers aren't compressed in the OCI sense, the layers'
+// diff_ids in the config are updated to the squashfs digests.
+func ConvertToSquashfs(ociDir string, oci *umoci.Layout, name string, newName string, c Compression, level int) (ispec.Descriptor, error) {
+	return copyManifest(ociDir, oci, name, newName, func(manifest *ispec.Manifest) error {
+		if len(manifest.Layers) == 0 {
+			return fmt.Errorf("%s has no layers to convert", name)
+		}
+
+		diffIDs := map[int]digest.Digest{}
+		for i, layer := range manifest.Layers {
+			if layer.MediaType == MediaTypeImageSquashfsLayer {
+				continue
+			}
+
+			newDesc, err := tarToSquashfs(ociDir, layer, c, level)
+			if err != nil {
+				return err
+			}
+
+			manifest.Layers[i] = newDesc
+			diffIDs[i] = newDesc.Digest
+		}
+
+		return updateDiffIDs(ociDir, name, manifest, diffIDs)
+	})
+}
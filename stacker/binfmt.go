@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var binfmtCmd = cli.Command{
+	Name:  "binfmt",
+	Usage: "manages the emulation of foreign architectures for --arch",
+	Subcommands: []cli.Command{
+		{
+			Name:      "install",
+			Usage:     "registers qemu-user-static with binfmt_misc for the given arches (default: all known ones)",
+			ArgsUsage: "[arch...]",
+			Action:    doBinfmtInstall,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "interpreter-dir",
+					Usage: "the directory the qemu-<arch>-static binaries are in",
+					Value: "/usr/bin",
+				},
+			},
+		},
+	},
+}
+
+func doBinfmtInstall(ctx *cli.Context) error {
+	arches := []string(ctx.Args())
+	if len(arches) == 0 {
+		arches = stacker.BinfmtArches()
+	}
+
+	return stacker.InstallBinfmt(arches, ctx.String("interpreter-dir"))
+}
@@ -3,339 +3,457 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path"
-	"runtime"
-	"strings"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/anuvu/stacker"
-	"github.com/openSUSE/umoci"
-	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/pkg/errors"
+	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
 )
 
 var buildCmd = cli.Command{
 	Name:   "build",
 	Usage:  "builds a new OCI image from a stacker yaml file",
-	Action: doBuild,
+	Action: withWorkspaceLock(doBuild),
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "leave-unladen",
 			Usage: "leave the built rootfs mount after image building",
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:  "stacker-file, f",
-			Usage: "the input stackerfile",
-			Value: "stacker.yaml",
+			Usage: "the input stackerfile(s), - for stdin, or an http(s) url; may be given more than once (default: stacker.yaml)",
+		},
+		cli.StringFlag{
+			Name:  "build-context",
+			Usage: "the directory relative imports are relative to, and that hooks and import_cmd run in",
 		},
 		cli.BoolFlag{
 			Name:  "no-cache",
 			Usage: "don't use the previous build cache",
 		},
+		cli.BoolFlag{
+			Name:  "ssh",
+			Usage: "make the ssh agent in $SSH_AUTH_SOCK available to run sections",
+		},
+		cli.BoolFlag{
+			Name:  "check-base-updates",
+			Usage: "check whether docker bases have changed, even if they are locked, and rebuild the layers on them if so",
+		},
+		cli.BoolFlag{
+			Name:  "no-atomic",
+			Usage: "build directly in the OCI layout, rather than only updating it once the whole build succeeds",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "carry on from the layers the last build built, if it didn't finish",
+		},
 		cli.StringSliceFlag{
 			Name:  "substitute",
 			Usage: "variable substitution in stackerfiles, FOO=bar format",
 		},
+		cli.StringFlag{
+			Name:  "lockfile",
+			Usage: "the lockfile pinning base and import digests (default: stacker.lock next to the first stackerfile)",
+		},
+		cli.BoolFlag{
+			Name:  "update",
+			Usage: "re-resolve the digests in the lockfile instead of using the locked ones",
+		},
+		cli.StringFlag{
+			Name:   "timestamp",
+			Usage:  "the creation time to use for reproducible images, in seconds since the epoch or RFC3339",
+			EnvVar: "SOURCE_DATE_EPOCH",
+		},
+		cli.StringFlag{
+			Name:  "layer-compression",
+			Usage: "compression for generated layers: gzip, zstd, estargz (seekable gzip, for lazy pulling), or none",
+			Value: "gzip",
+		},
+		cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "compression level for generated layers (default: the compression's default)",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "PEM private key to sign every built image with (cosign compatible)",
+		},
+		cli.StringFlag{
+			Name:  "sbom",
+			Usage: "generate an SBOM for each built image with syft, in spdx-json or cyclonedx-json format",
+		},
+		cli.StringFlag{
+			Name:  "sbom-dir",
+			Usage: "also write the generated SBOMs to this directory",
+		},
+		cli.BoolFlag{
+			Name:  "package-manifest",
+			Usage: "attach the list of installed dpkg, rpm or apk packages to each built image",
+		},
+		cli.StringFlag{
+			Name:  "package-manifest-dir",
+			Usage: "also write the package lists to this directory",
+		},
+		cli.StringFlag{
+			Name:  "scan",
+			Usage: "scan each built image for vulnerabilities with trivy or grype",
+		},
+		cli.StringFlag{
+			Name:  "scan-server",
+			Usage: "scan with the trivy server at this url, rather than locally",
+		},
+		cli.StringFlag{
+			Name:  "scan-fail-on",
+			Usage: "fail the build if the scan finds vulnerabilities of this severity (low, medium, high or critical) or worse",
+		},
+		cli.StringFlag{
+			Name:  "scan-dir",
+			Usage: "also write the scan reports to this directory",
+		},
+		cli.BoolFlag{
+			Name:  "size-warn",
+			Usage: "warn about layers over their max_size, rather than failing the build",
+		},
+		cli.StringFlag{
+			Name:  "large-file-warning",
+			Usage: "warn about files this big (e.g. 100M), package manager caches and core dumps in generated layers",
+			Value: "0",
+		},
+		cli.BoolFlag{
+			Name:  "provenance",
+			Usage: "attach a SLSA provenance attestation to each built image (signed if --sign-key is given)",
+		},
+		cli.BoolFlag{
+			Name:  "template",
+			Usage: "process stackerfiles as go templates before parsing them",
+		},
+		cli.StringSliceFlag{
+			Name:  "prebuild-hook",
+			Usage: "a host command to run before building each layer (may be given more than once)",
+		},
+		cli.StringSliceFlag{
+			Name:  "postbuild-hook",
+			Usage: "a host command to run after building each layer (may be given more than once)",
+		},
+		cli.StringFlag{
+			Name:  "progress",
+			Usage: "how to report progress: text, or json for a stream of JSON events on stdout",
+			Value: "text",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print which layers would be rebuilt and why, without building anything",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "rebuild whenever a stackerfile or local import changes, until interrupted",
+		},
+		cli.StringFlag{
+			Name:  "summary-file",
+			Usage: "also write the build summary as JSON to this file",
+		},
+		cli.StringFlag{
+			Name:  "result-file",
+			Usage: "where to write the tags and digests of the built images as JSON; empty to not write them",
+			Value: "build-result.json",
+		},
+		cli.StringFlag{
+			Name:  "statsd",
+			Usage: "send build metrics to the statsd server at this host:port",
+		},
+		cli.StringFlag{
+			Name:  "pushgateway",
+			Usage: "push build metrics to the Prometheus Pushgateway at this url",
+		},
+		cli.StringFlag{
+			Name:  "metrics-job",
+			Usage: "the job name to push metrics to the Pushgateway as",
+			Value: "stacker",
+		},
+		cli.StringFlag{
+			Name:   "trace-endpoint",
+			Usage:  "export spans of the build's phases to this OTLP/HTTP collector, e.g. http://localhost:4318",
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+		},
 		cli.StringFlag{
 			Name:  "on-run-failure",
 			Usage: "command to run inside container if run fails (useful for inspection)",
 		},
+		cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "if run fails, attach the terminal to the --on-run-failure command (default: a shell) in the failed container",
+		},
 	},
 }
 
-func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
-	newName := strings.Replace(newPath.Digest.String(), ":", "_", 1) + ".mtree"
-
-	infos, err := ioutil.ReadDir(rootPath)
+// jsonEvents sets up a stream of build events on stdout. Everything else that
+// would have gone to stdout (e.g. the output of run sections) is sent to
+// stderr instead, so that consumers only see events there.
+func jsonEvents() (*stacker.EventWriter, error) {
+	fd, err := unix.Dup(1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, fi := range infos {
-		if !strings.HasSuffix(fi.Name(), ".mtree") {
-			continue
-		}
-
-		return os.Rename(path.Join(rootPath, fi.Name()), path.Join(rootPath, newName))
+	if err := unix.Dup3(2, 1, 0); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return stacker.NewEventWriter(os.NewFile(uintptr(fd), "events")), nil
 }
 
 func doBuild(ctx *cli.Context) error {
-	if ctx.Bool("no-cache") {
-		os.RemoveAll(config.StackerDir)
-	}
-
-	file := ctx.String("f")
-	sf, err := stacker.NewStackerfile(file, ctx.StringSlice("substitute"))
-	if err != nil {
-		return err
-	}
-
-	s, err := stacker.NewStorage(config)
-	if err != nil {
-		return err
-	}
-	if !ctx.Bool("leave-unladen") {
-		defer s.Detach()
-	}
-
-	order, err := sf.DependencyOrder()
-	if err != nil {
-		return err
-	}
+	return build(ctx, stacker.BuildOpts{
+		StackerFiles: ctx.StringSlice("f"),
+		BuildContext: ctx.String("build-context"),
+	})
+}
 
-	var oci *umoci.Layout
-	if _, statErr := os.Stat(config.OCIDir); statErr != nil {
-		oci, err = umoci.CreateLayout(config.OCIDir)
-	} else {
-		oci, err = umoci.OpenLayout(config.OCIDir)
-	}
-	if err != nil {
-		return err
+// build builds with the options given by the build flags in ctx, on top of
+// the ones in opts about which stackerfiles to build.
+func build(ctx *cli.Context, opts stacker.BuildOpts) error {
+	opts = stacker.BuildOpts{
+		StackerFiles:  opts.StackerFiles,
+		BuildContext:  opts.BuildContext,
+		Substitutions: fileConfig.MergeSubstitutions(ctx.StringSlice("substitute")),
+		Template:      ctx.Bool("template"),
+
+		ImportsRelativeToStackerfile: opts.ImportsRelativeToStackerfile,
+
+		NoCache:            ctx.Bool("no-cache"),
+		NoAtomic:           ctx.Bool("no-atomic"),
+		Resume:             ctx.Bool("resume"),
+		CheckBaseUpdates:   ctx.Bool("check-base-updates"),
+		LeaveUnladen:       ctx.Bool("leave-unladen"),
+		Lockfile:           ctx.String("lockfile"),
+		Update:             ctx.Bool("update"),
+		CompressionLevel:   ctx.Int("compression-level"),
+		SBOMDir:            ctx.String("sbom-dir"),
+		PackageManifest:    ctx.Bool("package-manifest"),
+		PackageManifestDir: ctx.String("package-manifest-dir"),
+		Provenance:         ctx.Bool("provenance"),
+		Version:            version,
+		PrebuildHooks:      ctx.StringSlice("prebuild-hook"),
+		PostbuildHooks:     ctx.StringSlice("postbuild-hook"),
+		OnRunFailure:       ctx.String("on-run-failure"),
+		Interactive:        ctx.Bool("interactive"),
 	}
-	defer oci.Close()
 
-	buildCache, err := stacker.OpenCache(config.StackerDir, oci)
-	if err != nil {
-		return err
+	if ctx.Bool("ssh") {
+		opts.SSHAuthSock = os.Getenv("SSH_AUTH_SOCK")
+		if opts.SSHAuthSock == "" {
+			return fmt.Errorf("--ssh needs an ssh agent, but SSH_AUTH_SOCK isn't set")
+		}
 	}
 
-	defer s.Delete(".working")
-	for _, name := range order {
-		l := sf[name]
-
-		fmt.Printf("building image %s...\n", name)
-
-		// We need to run the imports first since we now compare
-		// against imports for caching layers. Since we don't do
-		// network copies if the files are present and we use rsync to
-		// copy things across, hopefully this isn't too expensive.
-		fmt.Println("importing files...")
-		imports, err := l.ParseImport()
+	if ctx.Bool("dry-run") {
+		plan, err := stacker.NewBuilder(config).Plan(opts)
 		if err != nil {
 			return err
 		}
 
-		if err := stacker.Import(config, name, imports); err != nil {
-			return err
-		}
-
-		importDir := path.Join(config.StackerDir, "imports", name)
-		cachedDesc, ok := buildCache.Lookup(l, importDir)
-		if ok {
-			fmt.Printf("found cached layer %s\n", name)
-			err = oci.UpdateReference(name, cachedDesc)
-			if err != nil {
-				return err
+		for _, entry := range plan {
+			if entry.Rebuild {
+				fmt.Printf("%s: rebuild, because %s\n", entry.Layer, entry.Reason)
+			} else {
+				fmt.Printf("%s: cached\n", entry.Layer)
 			}
-			continue
 		}
 
-		s.Delete(".working")
-		if l.From.Type == stacker.BuiltType {
-			if err := s.Restore(l.From.Tag, ".working"); err != nil {
-				return err
-			}
-		} else {
-			if err := s.Create(".working"); err != nil {
-				return err
-			}
-
-			os := stacker.BaseLayerOpts{
-				Config: config,
-				Name:   name,
-				Target: ".working",
-				Layer:  l,
-				Cache:  buildCache,
-				OCI:    oci,
-			}
-
-			err := stacker.GetBaseLayer(os)
-			if err != nil {
-				return err
-			}
-		}
+		return nil
+	}
 
-		fmt.Println("running commands...")
-		if err := stacker.Run(config, name, l, ctx.String("on-run-failure")); err != nil {
+	var events *stacker.EventWriter
+	switch ctx.String("progress") {
+	case "text":
+	case "json":
+		var err error
+		events, err = jsonEvents()
+		if err != nil {
 			return err
 		}
+	default:
+		return fmt.Errorf("unknown progress format %s", ctx.String("progress"))
+	}
 
-		// This is a build only layer, meaning we don't need to include
-		// it in the final image, as outputs from it are going to be
-		// imported into future images. Let's just snapshot it and add
-		// a bogus entry to our cache.
-		if l.BuildOnly {
-			s.Delete(name)
-			if err := s.Snapshot(".working", name); err != nil {
-				return err
-			}
+	summary := &stacker.BuildSummary{}
+	metrics := stacker.NewBuildMetrics()
+	opts.Progress = func(ev stacker.BuildEvent) {
+		summary.Record(ev)
+		metrics.Record(ev)
+		events.Emit(ev)
+	}
 
-			fmt.Println("build only layer, skipping OCI diff generation")
-			if err := buildCache.Put(l, importDir, ispec.Descriptor{}); err != nil {
-				return err
-			}
-			continue
+	var err error
+	if ctx.String("timestamp") != "" {
+		opts.Timestamp, err = stacker.ParseTimestamp(ctx.String("timestamp"))
+		if err != nil {
+			return err
 		}
+	}
 
-		fmt.Println("generating layer...")
-		args := []string{
-			"umoci",
-			"repack",
-			"--refresh-bundle",
-			"--image",
-			fmt.Sprintf("%s:%s", config.OCIDir, name),
-			path.Join(config.RootFSDir, ".working")}
-		err = stacker.MaybeRunInUserns(args, "layer generation failed")
+	if ctx.String("sign-key") != "" {
+		opts.Signer, err = stacker.LoadSigningKey(ctx.String("sign-key"))
 		if err != nil {
 			return err
 		}
+	}
 
-		mutator, err := oci.Mutator(name)
+	if ctx.String("sbom") != "" {
+		opts.SBOMFormat, err = stacker.ParseSBOMFormat(ctx.String("sbom"))
 		if err != nil {
-			return errors.Wrapf(err, "mutator failed")
+			return err
 		}
+	}
 
-		imageConfig, err := mutator.Config(context.Background())
+	if ctx.String("scan") != "" {
+		opts.Scan.Scanner, err = stacker.ParseScanner(ctx.String("scan"))
 		if err != nil {
 			return err
 		}
 
-		pathSet := false
-		for k, v := range l.Environment {
-			if k == "PATH" {
-				pathSet = true
-			}
-			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("%s=%s", k, v))
+		opts.Scan.FailOn, err = stacker.ParseSeverity(ctx.String("scan-fail-on"))
+		if err != nil {
+			return err
 		}
 
-		if !pathSet {
-			for _, s := range imageConfig.Env {
-				if strings.HasPrefix(s, "PATH=") {
-					pathSet = true
-					break
-				}
-			}
+		if ctx.String("scan-server") != "" && opts.Scan.Scanner != stacker.TrivyScanner {
+			return fmt.Errorf("--scan-server only works with trivy")
 		}
 
-		// if the user didn't specify a path, let's set a sane one
-		if !pathSet {
-			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("PATH=%s", stacker.ReasonableDefaultPath))
-		}
+		opts.Scan.Server = ctx.String("scan-server")
+		opts.Scan.OutDir = ctx.String("scan-dir")
+	}
 
-		if l.Cmd != nil {
-			imageConfig.Cmd, err = l.ParseCmd()
-			if err != nil {
-				return err
-			}
+	opts.SizeWarn = ctx.Bool("size-warn")
+	if ctx.String("large-file-warning") != "0" {
+		opts.LargeFileSize, err = units.RAMInBytes(ctx.String("large-file-warning"))
+		if err != nil {
+			return fmt.Errorf("invalid --large-file-warning: %v", err)
 		}
+	}
 
-		if l.Entrypoint != nil {
-			imageConfig.Entrypoint, err = l.ParseEntrypoint()
-			if err != nil {
-				return err
-			}
-		}
+	opts.Compression, err = stacker.ParseCompression(ctx.String("layer-compression"))
+	if err != nil {
+		return err
+	}
 
-		if l.FullCommand != nil {
-			imageConfig.Cmd = nil
-			imageConfig.Entrypoint, err = l.ParseFullCommand()
-			if err != nil {
-				return err
-			}
-		}
+	if ctx.Bool("watch") {
+		return watchBuild(opts)
+	}
 
-		if imageConfig.Volumes == nil {
-			imageConfig.Volumes = map[string]struct{}{}
-		}
+	if ctx.String("trace-endpoint") != "" {
+		opts.Tracer = stacker.NewTracer(ctx.String("trace-endpoint"))
+		log.Infof("tracing build as trace %s", opts.Tracer.TraceID())
+	}
 
-		for _, v := range l.Volumes {
-			imageConfig.Volumes[v] = struct{}{}
-		}
+	buildCtx, stop := interruptible()
+	buildErr := stacker.NewBuilder(config).Build(buildCtx, opts)
+	stop()
 
-		if imageConfig.Labels == nil {
-			imageConfig.Labels = map[string]string{}
-		}
+	// Traces and metrics are best effort; not being able to send them
+	// doesn't fail the build.
+	if err := opts.Tracer.Export(config); err != nil {
+		log.Warnf("couldn't export traces: %s", err)
+	}
 
-		for k, v := range l.Labels {
-			imageConfig.Labels[k] = v
+	if ctx.String("statsd") != "" {
+		if err := metrics.PushStatsd(ctx.String("statsd")); err != nil {
+			log.Warnf("couldn't send metrics to statsd: %s", err)
 		}
+	}
 
-		if l.WorkingDir != "" {
-			imageConfig.WorkingDir = l.WorkingDir
+	if ctx.String("pushgateway") != "" {
+		if err := metrics.PushGateway(config, ctx.String("pushgateway"), ctx.String("metrics-job")); err != nil {
+			log.Warnf("couldn't push metrics: %s", err)
 		}
+	}
+
+	// With --progress=json, stdout is the event stream and the original
+	// stdout now points at stderr, so this doesn't get mixed in with it.
+	if len(summary.Layers) > 0 {
+		fmt.Println()
+		summary.WriteTable(os.Stdout)
+	}
 
-		meta, err := mutator.Meta(context.Background())
+	if ctx.String("summary-file") != "" {
+		f, err := os.Create(ctx.String("summary-file"))
 		if err != nil {
 			return err
 		}
+		defer f.Close()
 
-		meta.Created = time.Now()
-		meta.Architecture = runtime.GOARCH
-		meta.OS = runtime.GOOS
-
-		annotations, err := mutator.Annotations(context.Background())
-		if err != nil {
+		if err := summary.WriteJSON(f); err != nil {
 			return err
 		}
+	}
 
-		history := ispec.History{
-			EmptyLayer: true, // this is only the history for imageConfig edit
-			Created:    &meta.Created,
-			CreatedBy:  "stacker build",
+	if ctx.String("result-file") != "" {
+		if buildErr != nil {
+			// Don't leave a previous build's results around to be
+			// mistaken for this one's.
+			os.Remove(ctx.String("result-file"))
+			return buildErr
 		}
 
-		err = mutator.Set(context.Background(), imageConfig, meta, annotations, history)
-		if err != nil {
+		if err := writeBuildResult(ctx.String("result-file"), summary); err != nil {
 			return err
 		}
+	}
 
-		newPath, err := mutator.Commit(context.Background())
-		if err != nil {
-			return err
-		}
+	return buildErr
+}
 
-		err = oci.UpdateReference(name, newPath.Root())
-		if err != nil {
-			return err
+func writeBuildResult(p string, summary *stacker.BuildSummary) error {
+	tags := []string{}
+	for _, l := range summary.Layers {
+		// build_only layers don't produce an image.
+		if l.Digest != "" {
+			tags = append(tags, l.Layer)
 		}
+	}
 
-		// Now, we need to set the umoci data on the fs to tell it that
-		// it has a layer that corresponds to this fs.
-		bundlePath := path.Join(config.RootFSDir, ".working")
-		err = updateBundleMtree(bundlePath, newPath.Descriptor())
-		if err != nil {
-			return err
-		}
+	result, err := stacker.GetBuildResult(config.OCIDir, tags)
+	if err != nil {
+		return err
+	}
 
-		umociMeta := umoci.UmociMeta{Version: umoci.UmociMetaVersion, From: newPath}
-		err = umoci.WriteBundleMeta(bundlePath, umociMeta)
-		if err != nil {
-			return err
-		}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		// Delete the old snapshot if it existed; we just did a new build.
-		s.Delete(name)
-		if err := s.Snapshot(".working", name); err != nil {
-			return err
-		}
+	return result.WriteJSON(f)
+}
 
-		fmt.Printf("filesystem %s built successfully\n", name)
+// interruptible returns a context that is cancelled on SIGINT or SIGTERM, so
+// that a build stops its container and cleans up its storage and OCI layout
+// rather than leaving them half done; a second signal exits immediately. The
+// returned function stops handling signals.
+func interruptible() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
 
-		desc, err := oci.LookupManifestDescriptor(name)
-		if err != nil {
-			return err
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-sigs; !ok {
+			return
 		}
+		log.Infof("interrupted, cleaning up (interrupt again to exit immediately)")
+		cancel()
 
-		if err := buildCache.Put(l, importDir, desc); err != nil {
-			return err
+		if _, ok := <-sigs; ok {
+			os.Exit(stacker.InterruptedError.ExitCode())
 		}
-	}
+	}()
 
-	return nil
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(sigs)
+		cancel()
+	}
 }
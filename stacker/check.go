@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var checkCmd = cli.Command{
+	Name:   "check",
+	Usage:  "checks that the kernel and environment have everything stacker needs",
+	Action: doCheck,
+}
+
+func doCheck(ctx *cli.Context) error {
+	failed := 0
+	for _, r := range stacker.Preflight(config) {
+		status := "ok"
+		if r.Err != nil {
+			status = "FAIL"
+			if r.Optional {
+				status = "warn"
+			} else {
+				failed++
+			}
+		}
+
+		fmt.Printf("[%4s] %s\n", status, r.Name)
+		if r.Err != nil {
+			fmt.Printf("       %v\n", r.Err)
+			if r.Remedy != "" {
+				fmt.Printf("       fix: %s\n", r.Remedy)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+
+	return nil
+}
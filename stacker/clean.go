@@ -6,55 +6,109 @@ import (
 	"path"
 	"syscall"
 
+	"github.com/anuvu/stacker"
 	"github.com/urfave/cli"
 )
 
 var cleanCmd = cli.Command{
 	Name:   "clean",
 	Usage:  "cleans up after a `stacker build`",
-	Action: doClean,
+	Action: withWorkspaceLock(doClean),
 	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "cache",
+			Usage: "clean the build cache and logs",
+		},
+		cli.BoolFlag{
+			Name:  "oci",
+			Usage: "clean the OCI layout",
+		},
+		cli.BoolFlag{
+			Name:  "roots",
+			Usage: "clean the rootfs snapshots (and the build cache, which refers to them)",
+		},
 		cli.BoolFlag{
 			Name:  "all",
-			Usage: "clean imports, not just build products",
+			Usage: "clean everything, including imports and downloaded base images",
 		},
 	},
 }
 
+// cleanTargets are what clean removes.
+type cleanTargets struct {
+	// cache is the build cache and the run logs.
+	cache bool
+	oci   bool
+	// roots is the roots dir, and the btrfs loop file backing it.
+	roots bool
+	// all is the whole stacker dir, and the above.
+	all bool
+}
+
+// defaultCleanTargets are the build products, but not the imports or base
+// images, which are expensive to download again.
+var defaultCleanTargets = cleanTargets{cache: true, oci: true, roots: true}
+
 func doClean(ctx *cli.Context) error {
+	return clean(newCleanTargets(ctx.Bool("cache"), ctx.Bool("oci"), ctx.Bool("roots"), ctx.Bool("all")))
+}
+
+// newCleanTargets returns the targets for clean's flags: all of them with
+// all, the default ones with none.
+func newCleanTargets(cache bool, oci bool, roots bool, all bool) cleanTargets {
+	if all {
+		return cleanTargets{cache: true, oci: true, roots: true, all: true}
+	}
+
+	targets := cleanTargets{cache: cache, oci: oci, roots: roots}
+	if targets == (cleanTargets{}) {
+		return defaultCleanTargets
+	}
+
+	return targets
+}
+
+// clean removes the targets.
+func clean(targets cleanTargets) error {
+	// Cached layers that aren't in the OCI layout are noticed and dropped
+	// when the cache is opened, but ones whose snapshots are gone aren't.
+	if targets.roots {
+		targets.cache = true
+	}
+
 	// Explicitly don't check errors. We want to do what we can to just
 	// clean everything up.
-	syscall.Unmount(config.RootFSDir, syscall.MNT_DETACH)
-	os.RemoveAll(config.RootFSDir)
-	os.RemoveAll(config.OCIDir)
+	if targets.oci || targets.all {
+		stacker.DiscardUnfinishedBuild(config)
+	}
 
-	fail := false
+	if targets.roots {
+		syscall.Unmount(config.RootFSDir, syscall.MNT_DETACH)
+		os.RemoveAll(config.RootFSDir)
+	}
 
-	if !ctx.Bool("all") {
-		if err := os.RemoveAll(path.Join(config.StackerDir, "logs")); err != nil {
-			if !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "error deleting logs dir: %v", err)
-				fail = true
-			}
-		}
-		if err := os.Remove(path.Join(config.StackerDir, "build.cache")); err != nil {
-			if !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "error deleting logs dir: %v", err)
-				fail = true
-			}
-		}
-		if err := os.Remove(path.Join(config.StackerDir, "btrfs.loop")); err != nil {
-			if !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "error deleting btrfs loop: %v", err)
-				fail = true
-			}
+	if targets.oci {
+		os.RemoveAll(config.OCIDir)
+	}
+
+	fail := false
+	remove := func(p string, what string) {
+		if err := os.RemoveAll(p); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error deleting %s: %v\n", what, err)
+			fail = true
 		}
+	}
+
+	if targets.all {
+		remove(config.StackerDir, "stacker dir")
 	} else {
-		if err := os.RemoveAll(config.StackerDir); err != nil {
-			if !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "error deleting stacker dir: %v", err)
-				fail = true
-			}
+		if targets.cache {
+			remove(path.Join(config.StackerDir, "logs"), "logs dir")
+			remove(path.Join(config.StackerDir, "build.cache"), "build cache")
+		}
+
+		if targets.roots {
+			remove(path.Join(config.StackerDir, "btrfs.loop"), "btrfs loop")
 		}
 	}
 
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/openSUSE/umoci"
+	"github.com/urfave/cli"
+)
+
+// The scripts all ask stacker itself what to complete, via urfave/cli's
+// --generate-bash-completion flag, so that they stay in sync with the
+// commands and can complete target names.
+const bashCompletion = `_stacker_complete() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local opts
+    opts=$("${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:$((COMP_CWORD-1))}" --generate-bash-completion 2>/dev/null)
+    COMPREPLY=($(compgen -W "${opts}" -- "${cur}"))
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *: ]]; then
+        compopt -o nospace
+    fi
+}
+
+complete -o default -F _stacker_complete stacker
+`
+
+const zshCompletion = `#compdef stacker
+
+_stacker() {
+    local -a opts
+    opts=("${(@f)$(${words[1]} ${words[2,CURRENT-1]} --generate-bash-completion 2>/dev/null)}")
+    _describe 'stacker' opts
+}
+
+compdef _stacker stacker
+`
+
+const fishCompletion = `function __stacker_complete
+    set -l args (commandline -opc)
+    $args[1] $args[2..-1] --generate-bash-completion 2>/dev/null
+end
+
+complete -c stacker -f -a '(__stacker_complete)'
+`
+
+var completionCmd = cli.Command{
+	Name:      "completion",
+	Usage:     "prints a shell completion script",
+	ArgsUsage: "bash|zsh|fish",
+	Action:    doCompletion,
+	BashComplete: func(ctx *cli.Context) {
+		for _, shell := range []string{"bash", "zsh", "fish"} {
+			fmt.Println(shell)
+		}
+	},
+}
+
+func doCompletion(ctx *cli.Context) error {
+	switch ctx.Args().First() {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	default:
+		return fmt.Errorf("usage: stacker completion bash|zsh|fish")
+	}
+
+	return nil
+}
+
+// targetNames returns the names of the layers in ./stacker.yaml and the
+// images in the OCI layout, for completing commands' arguments. Since it's
+// only for completion, anything that goes wrong just means fewer names.
+func targetNames() []string {
+	names := map[string]bool{}
+
+	if sf, err := stacker.NewStackerfile("stacker.yaml", nil); err == nil {
+		for name := range sf {
+			names[name] = true
+		}
+	}
+
+	if oci, err := umoci.OpenLayout(config.OCIDir); err == nil {
+		tags, err := oci.ListTags()
+		if err == nil {
+			for _, tag := range tags {
+				if !stacker.IsArtifactTag(tag) {
+					names[tag] = true
+				}
+			}
+		}
+		oci.Close()
+	}
+
+	result := []string{}
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func completeTargets(ctx *cli.Context) {
+	for _, name := range targetNames() {
+		fmt.Println(name)
+	}
+}
+
+// completeSnapshots completes the <layer>: part of grab's argument, from the
+// snapshots in the roots dir.
+func completeSnapshots(ctx *cli.Context) {
+	infos, err := ioutil.ReadDir(config.RootFSDir)
+	if err != nil {
+		return
+	}
+
+	for _, fi := range infos {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			fmt.Printf("%s:\n", fi.Name())
+		}
+	}
+}
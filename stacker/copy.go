@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var copyCmd = cli.Command{
+	Name:      "copy",
+	Usage:     "copies an image between OCI layouts and registries, keeping its digest",
+	ArgsUsage: "<oci:dir:tag|docker://image> <oci:dir:tag|docker://image>",
+	Action:    doCopy,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Usage: "the number of blobs to copy at once",
+			Value: 4,
+		},
+	},
+}
+
+func doCopy(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: stacker copy <source> <destination>")
+	}
+
+	return stacker.CopyImage(config, ctx.Args().Get(0), ctx.Args().Get(1), ctx.Int("jobs"))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anuvu/stacker"
+	"github.com/docker/go-units"
+	"github.com/urfave/cli"
+)
+
+var duCmd = cli.Command{
+	Name:   "du",
+	Usage:  "reports the disk space used by each target's imports, snapshot, and image",
+	Action: doDu,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the usage as json",
+		},
+	},
+}
+
+func doDu(ctx *cli.Context) error {
+	usage, err := stacker.GetUsage(config)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(usage)
+	}
+
+	size := func(n int64) string {
+		return units.HumanSize(float64(n))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tIMPORTS\tSNAPSHOT\tOCI")
+	for _, t := range usage.Targets {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.Name, size(t.Imports), size(t.Snapshot), size(t.OCI))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nbase images: %s\n", size(usage.LayerBases))
+	fmt.Printf("%s: %s\n", config.StackerDir, size(usage.StackerDir))
+	fmt.Printf("%s: %s\n", config.OCIDir, size(usage.OCIDir))
+	fmt.Printf("%s: %s\n", config.RootFSDir, size(usage.RootFSDir))
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var exportCmd = cli.Command{
+	Name:         "export",
+	Usage:        "copies a built image out of the OCI layout, e.g. to a docker-archive tarball",
+	ArgsUsage:    "<tag> <destination>",
+	Action:       doExport,
+	BashComplete: completeTargets,
+}
+
+func doExport(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: stacker export <tag> <destination>")
+	}
+
+	return stacker.Export(config, ctx.Args().Get(0), ctx.Args().Get(1))
+}
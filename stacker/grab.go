@@ -9,9 +9,10 @@ import (
 )
 
 var grabCmd = cli.Command{
-	Name:   "grab",
-	Usage:  "grabs a file from the layer's filesystem",
-	Action: doGrab,
+	Name:         "grab",
+	Usage:        "grabs a file from the layer's filesystem",
+	Action:       withWorkspaceLock(doGrab),
+	BashComplete: completeSnapshots,
 }
 
 func doGrab(ctx *cli.Context) error {
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/anuvu/stacker"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/multi"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var grpcServeCmd = cli.Command{
+	Name:   "grpc-serve",
+	Usage:  "serves the gRPC build API described in stacker.proto",
+	Action: withWorkspaceLock(doGRPCServe),
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "the unix socket to listen on, accessible only to the user running stacker",
+			Value: "stacker-grpc.sock",
+		},
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "a TCP address to listen on instead, e.g. :7070; requires --tls-cert, --tls-key, and --tls-client-ca or --token-file",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "the server's TLS certificate, for --listen",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "the server's TLS key, for --listen",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-ca",
+			Usage: "only accept clients with a certificate signed by this CA bundle, for --listen",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "only accept clients that send the token in this file, as \"authorization: Bearer <token>\" metadata",
+		},
+	},
+}
+
+// The messages of stacker.proto are small enough that we encode them by
+// hand, rather than generating code for them.
+
+type wireMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+type grpcBuildRequest struct {
+	Stackerfile   string
+	Substitutions []string
+	Context       []byte
+}
+
+func (r *grpcBuildRequest) marshal() []byte {
+	b := []byte{}
+	if r.Stackerfile != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, r.Stackerfile)
+	}
+
+	for _, s := range r.Substitutions {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+
+	if len(r.Context) > 0 {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Context)
+	}
+
+	return b
+}
+
+func (r *grpcBuildRequest) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType || num < 1 || num > 3 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			r.Stackerfile = string(v)
+		case 2:
+			r.Substitutions = append(r.Substitutions, string(v))
+		case 3:
+			r.Context = append([]byte{}, v...)
+		}
+	}
+
+	return nil
+}
+
+type grpcBuildStatus struct {
+	Event        string
+	Layer        string
+	Digest       string
+	Error        string
+	Log          string
+	Level        string
+	TimeUnixNano int64
+}
+
+func (s *grpcBuildStatus) marshal() []byte {
+	b := []byte{}
+	for i, v := range []string{s.Event, s.Layer, s.Digest, s.Error, s.Log, s.Level} {
+		if v == "" {
+			continue
+		}
+
+		b = protowire.AppendTag(b, protowire.Number(i+1), protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+
+	if s.TimeUnixNano != 0 {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.TimeUnixNano))
+	}
+
+	return b
+}
+
+func (s *grpcBuildStatus) unmarshal(b []byte) error {
+	fields := []*string{&s.Event, &s.Layer, &s.Digest, &s.Error, &s.Log, &s.Level}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.BytesType && num >= 1 && int(num) <= len(fields):
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*fields[num-1] = v
+			b = b[n:]
+		case typ == protowire.VarintType && num == 7:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			s.TimeUnixNano = int64(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+
+	return nil
+}
+
+// wireCodec is the protobuf wire format codec for our hand written
+// messages.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("can't unmarshal %T", v)
+	}
+
+	return m.unmarshal(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+// grpcServer runs one build at a time, since they share the storage and OCI
+// layout.
+type grpcServer struct {
+	mu sync.Mutex
+}
+
+var builderServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stacker.v1.Builder",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Build",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*grpcServer).build(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "stacker.proto",
+}
+
+// receiveContext reads the build requests from stream, writing the context
+// chunks to the file f, and returns the first request.
+func receiveContext(stream grpc.ServerStream, f io.Writer) (*grpcBuildRequest, error) {
+	var first *grpcBuildRequest
+	for {
+		req := &grpcBuildRequest{}
+		err := stream.RecvMsg(req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if first == nil {
+			first = req
+		}
+
+		if _, err := f.Write(req.Context); err != nil {
+			return nil, err
+		}
+	}
+
+	if first == nil || first.Stackerfile == "" {
+		return nil, fmt.Errorf("no stackerfile in build request")
+	}
+
+	return first, nil
+}
+
+func (s *grpcServer) build(stream grpc.ServerStream) error {
+	contextsDir := path.Join(config.StackerDir, "contexts")
+	if err := os.MkdirAll(contextsDir, 0755); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(contextsDir, "build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tarball, err := os.Create(path.Join(dir, "context.tar"))
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+
+	req, err := receiveContext(stream, tarball)
+	if err != nil {
+		return err
+	}
+
+	contextDir := path.Join(dir, "context")
+	if err := os.MkdirAll(contextDir, 0755); err != nil {
+		return err
+	}
+
+	output, err := exec.Command("tar", "-xf", tarball.Name(), "-C", contextDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("couldn't extract build context: %s: %s", err, string(output))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Log lines may come from other goroutines (e.g. progress reports),
+	// and the stream can only be sent to from one at a time.
+	var sendLock sync.Mutex
+	send := func(status *grpcBuildStatus) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		return stream.SendMsg(status)
+	}
+
+	streamLogs := log.HandlerFunc(func(e *log.Entry) error {
+		layer, _ := e.Fields.Get("layer").(string)
+		return send(&grpcBuildStatus{
+			Log:          e.Message,
+			Level:        e.Level.String(),
+			Layer:        layer,
+			TimeUnixNano: e.Timestamp.UnixNano(),
+		})
+	})
+	stacker.SetLogger(&log.Logger{Handler: multi.New(logger.Handler, streamLogs), Level: logger.Level})
+	defer stacker.SetLogger(logger)
+
+	// Relative imports are relative to the current directory, which
+	// should be the context. Since builds are serialized, we can just
+	// change it for the duration of the build.
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(contextDir); err != nil {
+		return err
+	}
+	defer os.Chdir(cwd)
+
+	opts := stacker.BuildOpts{
+		StackerFiles:  []string{path.Join(contextDir, req.Stackerfile)},
+		Substitutions: req.Substitutions,
+		Version:       version,
+		LeaveUnladen:  true,
+		Progress: func(ev stacker.BuildEvent) {
+			send(&grpcBuildStatus{
+				Event:        ev.Event,
+				Layer:        ev.Layer,
+				Digest:       ev.Digest,
+				Error:        ev.Error,
+				TimeUnixNano: ev.Time.UnixNano(),
+			})
+		},
+	}
+
+	return stacker.NewBuilder(config).Build(stream.Context(), opts)
+}
+
+// tokenInterceptor rejects streams whose authorization metadata isn't the
+// bearer token.
+func tokenInterceptor(token string) grpc.StreamServerInterceptor {
+	expected := []byte("Bearer " + token)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		for _, auth := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(auth), expected) == 1 {
+				return handler(srv, stream)
+			}
+		}
+
+		return status.Error(codes.Unauthenticated, "bad or missing token")
+	}
+}
+
+// grpcServerOptions are the options for serving on TCP: TLS always, since
+// anyone who can start a build can run commands as stacker, and clients
+// authenticated by certificate, token, or both.
+func grpcServerOptions(ctx *cli.Context) ([]grpc.ServerOption, error) {
+	if ctx.String("tls-cert") == "" || ctx.String("tls-key") == "" {
+		return nil, fmt.Errorf("--listen requires --tls-cert and --tls-key")
+	}
+
+	if ctx.String("tls-client-ca") == "" && ctx.String("token-file") == "" {
+		return nil, fmt.Errorf("--listen requires --tls-client-ca or --token-file to authenticate clients")
+	}
+
+	cert, err := tls.LoadX509KeyPair(ctx.String("tls-cert"), ctx.String("tls-key"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if ctx.String("tls-client-ca") != "" {
+		content, err := ioutil.ReadFile(ctx.String("tls-client-ca"))
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", ctx.String("tls-client-ca"))
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	opts := []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
+	if ctx.String("token-file") != "" {
+		content, err := ioutil.ReadFile(ctx.String("token-file"))
+		if err != nil {
+			return nil, err
+		}
+
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return nil, fmt.Errorf("%s is empty", ctx.String("token-file"))
+		}
+
+		opts = append(opts, grpc.StreamInterceptor(tokenInterceptor(token)))
+	}
+
+	return opts, nil
+}
+
+// listenUnix listens on socket, which only the current user can connect to.
+func listenUnix(socket string) (net.Listener, error) {
+	// Clean up a socket left behind by a previous server that died.
+	if _, err := net.Dial("unix", socket); err != nil {
+		os.Remove(socket)
+	}
+
+	// Create it with the right mode, rather than chmod'ing it after
+	// the fact, when someone may already have connected.
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", socket)
+	syscall.Umask(old)
+	return l, err
+}
+
+func doGRPCServe(ctx *cli.Context) error {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(wireCodec{})}
+
+	var l net.Listener
+	var err error
+	if ctx.String("listen") != "" {
+		tcpOpts, err := grpcServerOptions(ctx)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tcpOpts...)
+
+		l, err = net.Listen("tcp", ctx.String("listen"))
+		if err != nil {
+			return err
+		}
+	} else {
+		l, err = listenUnix(ctx.String("socket"))
+		if err != nil {
+			return err
+		}
+	}
+
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&builderServiceDesc, &grpcServer{})
+
+	log.Infof("serving gRPC on %s", l.Addr())
+	return srv.Serve(l)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var initCmd = cli.Command{
+	Name:   "init",
+	Usage:  "generates a starter stacker.yaml in the current directory",
+	Action: doInit,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "the base image: e.g. ubuntu:20.04, a tarball, oci:<layout>:<tag>, or scratch",
+			Value: "ubuntu:latest",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the name of the layer (default: the name of the current directory)",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "overwrite existing files",
+		},
+	},
+}
+
+func doInit(ctx *cli.Context) error {
+	name := ctx.String("name")
+	if name == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		name = filepath.Base(wd)
+	}
+
+	content, err := stacker.GenerateStackerfile(stacker.InitOpts{Name: name, From: ctx.String("from")})
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"stacker.yaml", content},
+		{".stackerignore", stacker.DefaultStackerignore},
+	}
+
+	if !ctx.Bool("force") {
+		for _, f := range files {
+			if _, err := os.Stat(f.name); err == nil {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", f.name)
+			}
+		}
+	}
+
+	for _, f := range files {
+		if err := ioutil.WriteFile(f.name, []byte(f.content), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s\n", f.name)
+	}
+
+	return nil
+}
@@ -3,25 +3,57 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/anuvu/stacker"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci"
 	"github.com/urfave/cli"
 )
 
 var inspectCmd = cli.Command{
-	Name:   "inspect",
-	Usage:  "print the json representation of an OCI image",
-	Action: doInspect,
-	Flags:  []cli.Flag{},
+	Name:         "inspect",
+	Usage:        "print the json representation of an OCI image, or of one in a registry (docker://...)",
+	Action:       doInspect,
+	BashComplete: completeTargets,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "inspect just this layer of the image, given as its index or (a prefix of) its digest",
+		},
+		cli.BoolFlag{
+			Name:  "files",
+			Usage: "with --layer, list the files in the layer",
+		},
+	},
 }
 
 func doInspect(ctx *cli.Context) error {
+	arg := ctx.Args().Get(0)
+	if strings.HasPrefix(arg, "docker://") {
+		if ctx.String("layer") != "" || ctx.Bool("files") {
+			return fmt.Errorf("--layer and --files only work for images in the OCI layout")
+		}
+		return renderRemote(arg)
+	}
+
 	oci, err := umoci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return err
 	}
 
-	arg := ctx.Args().Get(0)
+	if ctx.String("layer") != "" {
+		if arg == "" {
+			return fmt.Errorf("--layer needs an image to look in")
+		}
+		return renderLayer(oci, arg, ctx.String("layer"), ctx.Bool("files"))
+	}
+
+	if ctx.Bool("files") {
+		return fmt.Errorf("--files needs a --layer")
+	}
+
 	if arg != "" {
 		return renderManifest(oci, arg)
 	}
@@ -32,6 +64,10 @@ func doInspect(ctx *cli.Context) error {
 	}
 
 	for _, t := range tags {
+		if stacker.IsArtifactTag(t) {
+			continue
+		}
+
 		err = renderManifest(oci, t)
 		if err != nil {
 			return err
@@ -72,3 +108,79 @@ func renderManifest(oci *umoci.Layout, name string) error {
 	fmt.Println(string(pretty))
 	return nil
 }
+
+func renderLayer(oci *umoci.Layout, name string, layer string, files bool) error {
+	desc, err := stacker.FindLayer(oci, name, layer)
+	if err != nil {
+		return err
+	}
+
+	if !files {
+		pretty, err := json.MarshalIndent(desc, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(pretty))
+		return nil
+	}
+
+	return stacker.ListLayerFiles(config.OCIDir, desc, func(f stacker.LayerFile) error {
+		link := ""
+		if f.Linkname != "" {
+			link = " -> " + f.Linkname
+		}
+
+		fmt.Printf("%s %d/%d %10d %s%s\n", f.Mode, f.Uid, f.Gid, f.Size, f.Path, link)
+		return nil
+	})
+}
+
+func renderRemote(url string) error {
+	image, err := stacker.InspectRemote(config, url)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", url)
+	fmt.Printf("\tdigest: %s\n", image.Digest)
+
+	if len(image.Platforms) > 0 {
+		fmt.Printf("Platforms:\n")
+		for _, p := range image.Platforms {
+			platform := fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+			if p.Variant != "" {
+				platform += "/" + p.Variant
+			}
+			fmt.Printf("  %s: %s\n", platform, p.Digest)
+		}
+	}
+
+	total := int64(0)
+	fmt.Printf("Layers:\n")
+	for i, l := range image.Layers {
+		fmt.Printf("  layer %d: %s (%s)\n", i, l.Digest, units.HumanSize(float64(l.Size)))
+		total += l.Size
+	}
+	fmt.Printf("  total: %s\n", units.HumanSize(float64(total)))
+
+	if len(image.Config.Config.Labels) > 0 {
+		fmt.Printf("Labels:\n")
+		keys := []string{}
+		for k := range image.Config.Config.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Printf("  %s: %s\n", k, image.Config.Config.Labels[k])
+		}
+	}
+
+	fmt.Printf("Image config:\n")
+	pretty, err := json.MarshalIndent(image.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(pretty))
+	return nil
+}
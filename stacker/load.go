@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var loadCmd = cli.Command{
+	Name:         "load",
+	Usage:        "copies built images into a local container engine's image store",
+	ArgsUsage:    "<tag>...",
+	Action:       withWorkspaceLock(doLoad),
+	BashComplete: completeTargets,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "the container engine to load into: containerd, podman, or docker",
+		},
+		cli.StringFlag{
+			Name:  "namespace",
+			Usage: "the containerd namespace to load into",
+			Value: "default",
+		},
+	},
+}
+
+func doLoad(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 {
+		return fmt.Errorf("usage: stacker load --to <engine> <tag>...")
+	}
+
+	if ctx.String("to") == "" {
+		return fmt.Errorf("--to is required")
+	}
+
+	for _, tag := range ctx.Args() {
+		if err := stacker.Load(config, tag, ctx.String("to"), ctx.String("namespace")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,16 +2,31 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/anuvu/stacker"
+	"github.com/apex/log"
+	clihandler "github.com/apex/log/handlers/cli"
+	jsonhandler "github.com/apex/log/handlers/json"
+	"github.com/docker/go-units"
 	"github.com/urfave/cli"
 )
 
 var (
 	config  stacker.StackerConfig
+	logger  *log.Logger
 	version = ""
+
+	// waitForLock is whether commands wait for the workspace lock.
+	waitForLock bool
+
+	// fileConfig is what was in the config files; what it has that isn't
+	// part of config (i.e. substitutions) is applied by the commands.
+	fileConfig stacker.ConfigFile
 )
 
 func main() {
@@ -19,53 +34,333 @@ func main() {
 	app.Name = "stacker"
 	app.Usage = "stacker builds OCI images"
 	app.Version = version
+	app.EnableBashCompletion = true
 	app.Commands = []cli.Command{
 		buildCmd,
+		recursiveBuildCmd,
+		prefetchCmd,
 		unladeCmd,
 		cleanCmd,
 		inspectCmd,
 		grabCmd,
+		validateCmd,
+		serveCmd,
+		grpcServeCmd,
+		exportCmd,
+		copyCmd,
+		verifyCmd,
+		recompressCmd,
+		loadCmd,
+		duCmd,
+		checkCmd,
+		completionCmd,
+		initCmd,
+		binfmtCmd,
+		snapshotCmd,
+		internalRepackCmd,
 	}
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "stacker-dir",
-			Usage: "set the directory for stacker's cache",
-			Value: ".stacker",
+			Name:   "stacker-dir",
+			EnvVar: "STACKER_DIR",
+			Usage:  "set the directory for stacker's cache",
+			Value:  ".stacker",
+		},
+		cli.StringFlag{
+			Name:   "oci-dir",
+			EnvVar: "STACKER_OCI_DIR",
+			Usage:  "set the directory for OCI output",
+			Value:  "oci",
+		},
+		cli.StringFlag{
+			Name:   "roots-dir",
+			EnvVar: "STACKER_ROOTS_DIR",
+			Usage:  "set the directory for the rootfs output",
+			Value:  "roots",
+		},
+		cli.StringFlag{
+			Name:   "storage-type",
+			EnvVar: "STACKER_STORAGE_TYPE",
+			Usage:  "the storage driver to use for root filesystems",
+			Value:  "btrfs",
+		},
+		cli.BoolFlag{
+			Name:   "rootless",
+			EnvVar: "STACKER_ROOTLESS",
+			Usage:  "build as an unprivileged user, using the dir storage driver unless --storage-type is given",
+		},
+		cli.StringSliceFlag{
+			Name:   "uid-map",
+			EnvVar: "STACKER_UID_MAP",
+			Usage:  "a nsid:hostid:range uid mapping for the user namespace (may be given more than once)",
+		},
+		cli.StringSliceFlag{
+			Name:   "gid-map",
+			EnvVar: "STACKER_GID_MAP",
+			Usage:  "a nsid:hostid:range gid mapping for the user namespace (default: the same as --uid-map)",
+		},
+		cli.StringFlag{
+			Name:   "ca-cert",
+			EnvVar: "STACKER_CA_CERT",
+			Usage:  "a PEM bundle of additional CAs to trust for downloads and registries",
+		},
+		cli.StringSliceFlag{
+			Name:   "insecure-registry",
+			EnvVar: "STACKER_INSECURE_REGISTRY",
+			Usage:  "a host whose TLS certificate shouldn't be verified (may be given more than once)",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			EnvVar: "STACKER_LOG_LEVEL",
+			Usage:  "the minimum level to log: debug, info, warn, or error",
+			Value:  "info",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "STACKER_LOG_FORMAT",
+			Usage:  "the format of log lines: text or json",
+			Value:  "text",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			EnvVar: "STACKER_LOG_FILE",
+			Usage:  "log to this file (appending) instead of stderr",
+		},
+		cli.StringFlag{
+			Name:   "username",
+			EnvVar: "STACKER_USERNAME",
+			Usage:  "the username for registries, instead of the ones in the docker config",
+		},
+		cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "read the password for --username from stdin",
+		},
+		cli.StringFlag{
+			Name:   "network",
+			EnvVar: "STACKER_NETWORK",
+			Usage:  "the network for run sections of layers that don't set one: host, none, or bridge",
+			Value:  "host",
+		},
+		cli.StringFlag{
+			Name:   "max-cache-size",
+			EnvVar: "STACKER_MAX_CACHE_SIZE",
+			Usage:  "evict the least recently used imports and base images when they use more than this (e.g. 20G)",
+		},
+		cli.StringFlag{
+			Name:   "download-rate-limit",
+			EnvVar: "STACKER_DOWNLOAD_RATE_LIMIT",
+			Usage:  "the most bytes per second that downloads of imports may use, all together (e.g. 5M)",
 		},
 		cli.StringFlag{
-			Name:  "oci-dir",
-			Usage: "set the directory for OCI output",
-			Value: "oci",
+			Name:   "import-cas",
+			EnvVar: "STACKER_IMPORT_CAS",
+			Usage:  "the store that downloaded imports are shared through by all projects (\"\" to not use one)",
+			Value:  stacker.DefaultImportCAS(),
 		},
 		cli.StringFlag{
-			Name:  "roots-dir",
-			Usage: "set the directory for the rootfs output",
-			Value: "roots",
+			Name:   "runtime",
+			EnvVar: "STACKER_RUNTIME",
+			Usage:  "the runtime for run sections: lxc, or an OCI runtime like runc or crun",
+			Value:  "lxc",
+		},
+		cli.StringSliceFlag{
+			Name:   "runtime-arg",
+			EnvVar: "STACKER_RUNTIME_ARG",
+			Usage:  "an argument to pass to the OCI runtime before its run command (may be given more than once)",
+		},
+		cli.StringSliceFlag{
+			Name:   "dns",
+			EnvVar: "STACKER_DNS",
+			Usage:  "a DNS server for run sections of layers that don't set any (may be given more than once)",
+		},
+		cli.StringFlag{
+			Name:   "arch",
+			EnvVar: "STACKER_ARCH",
+			Usage:  "the architecture to build images for, e.g. arm64 (default: the host's); foreign ones are run under qemu",
+		},
+		cli.BoolFlag{
+			Name:   "wait-for-lock",
+			EnvVar: "STACKER_WAIT_FOR_LOCK",
+			Usage:  "wait for other stackers using the same directories to finish, instead of failing",
+		},
+		cli.StringSliceFlag{
+			Name:   "add-host",
+			EnvVar: "STACKER_ADD_HOST",
+			Usage:  "a host:ip entry to add to /etc/hosts during run sections (may be given more than once)",
 		},
 	}
 
-	app.Before = func(ctx *cli.Context) error {
+	before := func(ctx *cli.Context) error {
+		if err := setupLogging(ctx); err != nil {
+			return err
+		}
+
 		var err error
-		config.StackerDir, err = filepath.Abs(ctx.String("stacker-dir"))
+		fileConfig, err = stacker.LoadConfigFiles(stacker.ConfigFilePaths())
 		if err != nil {
 			return err
 		}
 
-		config.OCIDir, err = filepath.Abs(ctx.String("oci-dir"))
+		waitForLock = ctx.Bool("wait-for-lock")
+
+		config.StackerDir, err = filepath.Abs(fromFile(ctx, "stacker-dir", fileConfig.StackerDir))
 		if err != nil {
 			return err
 		}
-		config.RootFSDir, err = filepath.Abs(ctx.String("roots-dir"))
+
+		config.OCIDir, err = filepath.Abs(fromFile(ctx, "oci-dir", fileConfig.OCIDir))
 		if err != nil {
 			return err
 		}
+		config.RootFSDir, err = filepath.Abs(fromFile(ctx, "roots-dir", fileConfig.RootFSDir))
+		if err != nil {
+			return err
+		}
+
+		if len(ctx.StringSlice("uid-map")) > 0 {
+			stacker.IdmapSet, err = stacker.NewIdmapSet(ctx.StringSlice("uid-map"), ctx.StringSlice("gid-map"))
+			if err != nil {
+				return err
+			}
+		} else if len(ctx.StringSlice("gid-map")) > 0 {
+			return fmt.Errorf("--gid-map requires --uid-map")
+		}
+
+		config.StorageType = fromFile(ctx, "storage-type", fileConfig.StorageType)
+		if ctx.Bool("rootless") {
+			if !ctx.IsSet("storage-type") && fileConfig.StorageType == "" {
+				config.StorageType = "dir"
+			}
+
+			if err := stacker.CheckRootless(); err != nil {
+				return err
+			}
+		}
+
+		if ctx.String("ca-cert") != "" {
+			config.CACert, err = filepath.Abs(ctx.String("ca-cert"))
+			if err != nil {
+				return err
+			}
+		}
+
+		config.InsecureRegistries = ctx.StringSlice("insecure-registry")
+
+		if ctx.String("max-cache-size") != "" {
+			config.MaxCacheSize, err = units.RAMInBytes(ctx.String("max-cache-size"))
+			if err != nil {
+				return fmt.Errorf("invalid --max-cache-size: %v", err)
+			}
+		}
+
+		if ctx.String("download-rate-limit") != "" {
+			config.DownloadRateLimit, err = units.RAMInBytes(ctx.String("download-rate-limit"))
+			if err != nil {
+				return fmt.Errorf("invalid --download-rate-limit: %v", err)
+			}
+		}
+
+		config.ImportCAS = ctx.String("import-cas")
+		config.Arch = ctx.String("arch")
+		config.ImportMirrors = fileConfig.ImportMirrors
+
+		config.Runtime = ctx.String("runtime")
+		config.RuntimeArgs = ctx.StringSlice("runtime-arg")
+
+		config.Network = ctx.String("network")
+		config.DNS = ctx.StringSlice("dns")
+		config.ExtraHosts = ctx.StringSlice("add-host")
+		if err := stacker.ValidateNetwork(config.Network, config.DNS, config.ExtraHosts); err != nil {
+			return err
+		}
+
+		config.RegistryUsername = ctx.String("username")
+		if !ctx.IsSet("username") && fileConfig.Username != "" {
+			config.RegistryUsername = fileConfig.Username
+			config.RegistryPassword = fileConfig.Password
+		}
+
+		if ctx.Bool("password-stdin") {
+			if config.RegistryUsername == "" {
+				return fmt.Errorf("--password-stdin requires --username")
+			}
+
+			password, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+
+			config.RegistryPassword = strings.TrimRight(string(password), "\r\n")
+			stacker.SetStdinUsed("--password-stdin")
+		}
 
 		return nil
 	}
 
+	// Anything wrong with the global flags or config files is the user's
+	// to fix, unless it's already known to be something else.
+	app.Before = func(ctx *cli.Context) error {
+		return stacker.WithKind(stacker.UserError, before(ctx))
+	}
+
 	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		log.Errorf("%v", err)
+		os.Exit(stacker.KindOf(err).ExitCode())
+	}
+}
+
+// fromFile returns the global flag's value, or the config files' value if
+// the flag isn't set. Flags given on the command line and their environment
+// variables (which urfave/cli counts as setting them) win over the config
+// files, which win over the flags' defaults.
+func fromFile(ctx *cli.Context, flag string, value string) string {
+	if value != "" && !ctx.IsSet(flag) {
+		return value
+	}
+	return ctx.String(flag)
+}
+
+func setupLogging(ctx *cli.Context) error {
+	level, err := log.ParseLevel(ctx.String("log-level"))
+	if err != nil {
+		return fmt.Errorf("invalid log level %s", ctx.String("log-level"))
+	}
+
+	var w io.Writer = os.Stderr
+	if ctx.String("log-file") != "" {
+		f, err := os.OpenFile(ctx.String("log-file"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	var handler log.Handler
+	switch ctx.String("log-format") {
+	case "text":
+		handler = clihandler.New(w)
+	case "json":
+		handler = jsonhandler.New(w)
+	default:
+		return fmt.Errorf("invalid log format %s", ctx.String("log-format"))
+	}
+
+	logger = &log.Logger{Handler: handler, Level: level}
+	stacker.SetLogger(logger)
+	return nil
+}
+
+// withWorkspaceLock wraps the action of a command that changes the stacker
+// dir, OCI layout or roots dir so that it holds the workspace lock.
+func withWorkspaceLock(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		lock, err := stacker.LockWorkspace(config, waitForLock)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		return action(ctx)
 	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestFromFilePrecedence(t *testing.T) {
+	run := func(env string, args ...string) string {
+		os.Unsetenv("STACKER_TEST_OCI_DIR")
+		if env != "" {
+			os.Setenv("STACKER_TEST_OCI_DIR", env)
+			defer os.Unsetenv("STACKER_TEST_OCI_DIR")
+		}
+
+		result := ""
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{
+			cli.StringFlag{
+				Name:   "oci-dir",
+				Value:  "oci",
+				EnvVar: "STACKER_TEST_OCI_DIR",
+			},
+		}
+		app.Action = func(ctx *cli.Context) error {
+			result = fromFile(ctx, "oci-dir", "file")
+			return nil
+		}
+
+		if err := app.Run(append([]string{"stacker"}, args...)); err != nil {
+			t.Fatalf("%s", err)
+		}
+		return result
+	}
+
+	for _, c := range []struct {
+		env      string
+		args     []string
+		expected string
+	}{
+		{"", nil, "file"},
+		{"env", nil, "env"},
+		{"env", []string{"--oci-dir", "flag"}, "flag"},
+		{"", []string{"--oci-dir", "flag"}, "flag"},
+	} {
+		if result := run(c.env, c.args...); result != c.expected {
+			t.Fatalf("env %q args %v: expected %s, got %s", c.env, c.args, c.expected, result)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var prefetchCmd = cli.Command{
+	Name:   "prefetch",
+	Usage:  "downloads the imports and base images of a stacker yaml file into the cache without building it",
+	Action: withWorkspaceLock(doPrefetch),
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile(s), - for stdin, or an http(s) url; may be given more than once (default: stacker.yaml)",
+		},
+		cli.StringFlag{
+			Name:  "build-context",
+			Usage: "the directory relative imports are relative to, and that hooks and import_cmd run in",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.BoolFlag{
+			Name:  "template",
+			Usage: "process stackerfiles as go templates before parsing them",
+		},
+		cli.StringFlag{
+			Name:  "lockfile",
+			Usage: "the lockfile pinning base and import digests (default: stacker.lock next to the first stackerfile)",
+		},
+		cli.BoolFlag{
+			Name:  "update",
+			Usage: "re-resolve the digests in the lockfile instead of using the locked ones",
+		},
+	},
+}
+
+func doPrefetch(ctx *cli.Context) error {
+	return stacker.NewBuilder(config).Prefetch(stacker.BuildOpts{
+		StackerFiles:  ctx.StringSlice("f"),
+		BuildContext:  ctx.String("build-context"),
+		Substitutions: fileConfig.MergeSubstitutions(ctx.StringSlice("substitute")),
+		Template:      ctx.Bool("template"),
+		Lockfile:      ctx.String("lockfile"),
+		Update:        ctx.Bool("update"),
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/openSUSE/umoci"
+	"github.com/urfave/cli"
+)
+
+var recompressCmd = cli.Command{
+	Name:         "recompress",
+	Usage:        "rewrites the layers of built images with a different compression, without rebuilding them",
+	ArgsUsage:    "<tag>...",
+	Action:       withWorkspaceLock(doRecompress),
+	BashComplete: completeTargets,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "the compression to use: gzip, zstd, estargz, or none",
+		},
+		cli.IntFlag{
+			Name:  "level",
+			Usage: "the compression level (default: the compression's default)",
+		},
+	},
+}
+
+func doRecompress(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 || ctx.String("to") == "" {
+		return fmt.Errorf("usage: stacker recompress --to <compression> <tag>...")
+	}
+
+	compression, err := stacker.ParseCompression(ctx.String("to"))
+	if err != nil {
+		return err
+	}
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	for _, name := range ctx.Args() {
+		old, err := oci.LookupManifestDescriptor(name)
+		if err != nil {
+			return err
+		}
+
+		desc, err := stacker.RecompressLayers(config.OCIDir, oci, name, compression, ctx.Int("level"), true)
+		if err != nil {
+			return err
+		}
+
+		err = stacker.ReplaceCachedManifest(config.StackerDir, old, desc)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: %s\n", name, desc.Digest)
+	}
+
+	return nil
+}
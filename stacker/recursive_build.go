@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var recursiveBuildCmd = cli.Command{
+	Name:   "recursive-build",
+	Usage:  "finds stacker yaml files under a directory and builds them all together",
+	Action: withWorkspaceLock(doRecursiveBuild),
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "search-dir",
+			Usage: "the directory to search for stackerfiles in",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "stacker-file-name",
+			Usage: "the name of the stackerfiles to look for",
+			Value: "stacker.yaml",
+		},
+	}, recursiveBuildFlags()...),
+}
+
+// recursiveBuildFlags is build's flags, without the ones that pick what to
+// build: recursive-build finds the stackerfiles itself, and each one's imports
+// are relative to it.
+func recursiveBuildFlags() []cli.Flag {
+	flags := []cli.Flag{}
+	for _, f := range buildCmd.Flags {
+		switch strings.Split(f.GetName(), ",")[0] {
+		case "stacker-file", "build-context":
+			continue
+		}
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+func doRecursiveBuild(ctx *cli.Context) error {
+	searchDir := ctx.String("search-dir")
+	skip := []string{config.StackerDir, config.OCIDir, config.RootFSDir}
+
+	files, err := stacker.FindStackerfiles(searchDir, ctx.String("stacker-file-name"), skip)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no %s files found in %s", ctx.String("stacker-file-name"), searchDir)
+	}
+
+	// The default would put the lockfile next to whichever stackerfile
+	// happened to sort first; pin everything in one at the top instead.
+	if !ctx.IsSet("lockfile") {
+		ctx.Set("lockfile", path.Join(searchDir, "stacker.lock"))
+	}
+
+	return build(ctx, stacker.BuildOpts{
+		StackerFiles:                 files,
+		ImportsRelativeToStackerfile: true,
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+// internalRepackCmd is how stacker repacks layers inside a user namespace
+// when it is run unprivileged; see stacker.RepackLayer.
+var internalRepackCmd = cli.Command{
+	Name:      "internal-repack",
+	Hidden:    true,
+	ArgsUsage: "<oci dir> <tag> <bundle>",
+	Action:    doInternalRepack,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "the RFC3339 history timestamp of the layer",
+		},
+		cli.StringFlag{
+			Name:  "touched-since",
+			Usage: "only re-hash files changed since this RFC3339 time",
+		},
+	},
+}
+
+func parseTimeFlag(ctx *cli.Context, name string) (time.Time, error) {
+	if ctx.String(name) == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, ctx.String(name))
+}
+
+func doInternalRepack(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 3 {
+		return fmt.Errorf("usage: stacker internal-repack <oci dir> <tag> <bundle>")
+	}
+
+	created, err := parseTimeFlag(ctx, "created")
+	if err != nil {
+		return err
+	}
+
+	touchedSince, err := parseTimeFlag(ctx, "touched-since")
+	if err != nil {
+		return err
+	}
+
+	return stacker.Repack(args[0], args[1], args[2], created, touchedSince)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/anuvu/stacker"
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+var serveCmd = cli.Command{
+	Name:   "serve",
+	Usage:  "serves a REST API for building and inspecting images over a unix socket",
+	Action: withWorkspaceLock(doServe),
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "the unix socket to listen on",
+			Value: "stacker.sock",
+		},
+	},
+}
+
+// buildRequest is the body of a POST /build.
+type buildRequest struct {
+	StackerFiles  []string `json:"stacker_files"`
+	Substitutions []string `json:"substitutions"`
+	Template      bool     `json:"template"`
+	NoCache       bool     `json:"no_cache"`
+	Lockfile      string   `json:"lockfile"`
+	Update        bool     `json:"update"`
+	OnRunFailure  string   `json:"on_run_failure"`
+}
+
+type imageSummary struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+type imageDetail struct {
+	Manifest ispec.Manifest `json:"manifest"`
+	Config   ispec.Image    `json:"config"`
+}
+
+// server serializes the requests that use the storage or layout, which
+// stays attached between builds.
+type server struct {
+	mu sync.Mutex
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleBuild builds the requested stackerfiles, streaming the build events
+// back as JSON lines. Since the response has started by the time the build
+// can fail, failures are reported as a build_failed event rather than with
+// the status code.
+func (s *server) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+		return
+	}
+
+	req := buildRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	events := stacker.NewEventWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	opts := stacker.BuildOpts{
+		StackerFiles:  req.StackerFiles,
+		Substitutions: req.Substitutions,
+		Template:      req.Template,
+		NoCache:       req.NoCache,
+		Lockfile:      req.Lockfile,
+		Update:        req.Update,
+		OnRunFailure:  req.OnRunFailure,
+		Version:       version,
+		// Keep the storage attached, so the next build doesn't
+		// have to set it up again.
+		LeaveUnladen: true,
+		Progress: func(ev stacker.BuildEvent) {
+			events.Emit(ev)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		},
+	}
+
+	// The build stops at the next layer if the client goes away.
+	err := stacker.NewBuilder(config).Build(r.Context(), opts)
+	if err != nil {
+		log.Errorf("build failed: %s", err)
+	}
+}
+
+func (s *server) handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	defer oci.Close()
+
+	name := strings.TrimPrefix(r.URL.Path, "/images/")
+	if r.URL.Path != "/images" && name != "" {
+		man, err := oci.LookupManifest(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		imageConfig, err := oci.LookupConfig(man.Config)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, imageDetail{Manifest: man, Config: imageConfig})
+		return
+	}
+
+	tags, err := oci.ListTags()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	images := []imageSummary{}
+	for _, t := range tags {
+		if stacker.IsArtifactTag(t) {
+			continue
+		}
+
+		desc, err := oci.LookupManifestDescriptor(t)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		images = append(images, imageSummary{Name: t, Digest: desc.Digest.String()})
+	}
+
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (s *server) handleClean(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	targets := newCleanTargets(query.Get("cache") == "true", query.Get("oci") == "true", query.Get("roots") == "true", query.Get("all") == "true")
+
+	if err := clean(targets); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func doServe(ctx *cli.Context) error {
+	socket := ctx.String("socket")
+	l, err := listenUnix(socket)
+	if err != nil {
+		return err
+	}
+
+	s := &server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", s.handleBuild)
+	mux.HandleFunc("/images", s.handleImages)
+	mux.HandleFunc("/images/", s.handleImages)
+	mux.HandleFunc("/clean", s.handleClean)
+	srv := &http.Server{Handler: mux}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Infof("shutting down")
+		srv.Shutdown(context.Background())
+	}()
+
+	log.Infof("listening on %s", socket)
+	err = srv.Serve(l)
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	// Builds leave the storage attached; now that we're done, detach it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if storage, err := stacker.NewStorage(config); err == nil {
+		storage.Detach()
+	}
+
+	return nil
+}
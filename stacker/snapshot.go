@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/anuvu/stacker"
+	"github.com/apex/log"
+	"github.com/urfave/cli"
+)
+
+var snapshotCmd = cli.Command{
+	Name:  "snapshot",
+	Usage: "moves the rootfs snapshots of built layers between machines",
+	Subcommands: []cli.Command{
+		{
+			Name:      "send",
+			Usage:     "writes a layer's snapshot and build cache entry to a file or stdout",
+			ArgsUsage: "<name>",
+			Action:    withWorkspaceLock(doSnapshotSend),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "the file to write to (default: stdout)",
+				},
+			},
+		},
+		{
+			Name:   "receive",
+			Usage:  "creates a snapshot, and its build cache entry, from what send wrote",
+			Action: withWorkspaceLock(doSnapshotReceive),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "the file to read from (default: stdin)",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "replace an existing snapshot with the same name",
+				},
+			},
+		},
+	},
+}
+
+func doSnapshotSend(ctx *cli.Context) error {
+	name := ctx.Args().Get(0)
+	if name == "" {
+		return fmt.Errorf("which snapshot?")
+	}
+
+	var w io.Writer = os.Stdout
+	if ctx.String("output") != "" {
+		f, err := os.Create(ctx.String("output"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return stacker.SendSnapshot(config, name, w)
+}
+
+func doSnapshotReceive(ctx *cli.Context) error {
+	var r io.Reader = os.Stdin
+	if ctx.String("input") != "" {
+		f, err := os.Open(ctx.String("input"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	name, err := stacker.ReceiveSnapshot(config, r, ctx.Bool("force"))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("received %s", name)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"path"
 
 	"github.com/anuvu/stacker"
+	"github.com/apex/log"
 	"github.com/openSUSE/umoci"
 	"github.com/urfave/cli"
 )
@@ -14,7 +15,7 @@ var unladeCmd = cli.Command{
 	Name:    "unlade",
 	Usage:   "unpacks an OCI image to a directory",
 	Aliases: []string{"unpack"},
-	Action:  doUnlade,
+	Action:  withWorkspaceLock(doUnlade),
 	Flags:   []cli.Flag{},
 }
 
@@ -39,16 +40,19 @@ func doUnlade(ctx *cli.Context) error {
 		return err
 	}
 
-	fmt.Printf("Unpacking all layers from %s into %s\n", config.OCIDir, config.RootFSDir)
+	log.Infof("Unpacking all layers from %s into %s", config.OCIDir, config.RootFSDir)
 	// TODO: this should be a lot better, we should use btrfs to do
 	// manifest-by-manifest extracting. But that's more work, so let's do
 	// this for now.
 	for idx, tag := range tags {
+		if stacker.IsArtifactTag(tag) {
+			continue
+		}
+
 		err = s.Create(tag)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%d/%d: unpacking %s", idx+1, len(tags), tag)
 		args := []string{
 			"umoci",
 			"unpack",
@@ -56,11 +60,12 @@ func doUnlade(ctx *cli.Context) error {
 			fmt.Sprintf("%s:%s", config.OCIDir, tag),
 			path.Join(config.RootFSDir, tag),
 		}
-		err = stacker.MaybeRunInUserns(args, "unpack failed")
+		err = stacker.RunWithProgress(fmt.Sprintf("%d/%d: unpacking %s", idx+1, len(tags), tag), func() error {
+			return stacker.MaybeRunInUserns(args, "unpack failed")
+		})
 		if err != nil {
 			return err
 		}
-		fmt.Printf(" - done.\n")
 	}
 
 	return nil
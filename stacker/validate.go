@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var validateCmd = cli.Command{
+	Name:   "validate",
+	Usage:  "checks a stacker yaml file for errors without building it",
+	Action: doValidate,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile(s), - for stdin, or an http(s) url; may be given more than once (default: stacker.yaml)",
+		},
+		cli.StringFlag{
+			Name:  "build-context",
+			Usage: "the directory relative imports are relative to, and that hooks and import_cmd run in",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.BoolFlag{
+			Name:  "template",
+			Usage: "process stackerfiles as go templates before parsing them",
+		},
+	},
+}
+
+func doValidate(ctx *cli.Context) error {
+	files := ctx.StringSlice("f")
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	opts := stacker.ParseOpts{
+		Substitutions: fileConfig.MergeSubstitutions(ctx.StringSlice("substitute")),
+		Template:      ctx.Bool("template"),
+		BuildContext:  ctx.String("build-context"),
+		Config:        config,
+	}
+
+	sf, err := stacker.NewStackerfiles(files, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := sf.Validate(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: ok\n", strings.Join(files, ", "))
+	return nil
+}
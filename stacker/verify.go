@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/openSUSE/umoci"
+	"github.com/urfave/cli"
+)
+
+var verifyCmd = cli.Command{
+	Name:         "verify",
+	Usage:        "checks the blobs of images in the OCI layout for corruption",
+	ArgsUsage:    "[tag...]",
+	Action:       doVerify,
+	BashComplete: completeTargets,
+}
+
+func doVerify(ctx *cli.Context) error {
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	problems, err := stacker.VerifyLayout(config.OCIDir, oci, ctx.Args())
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %s", len(problems), config.OCIDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/anuvu/stacker"
+	"github.com/apex/log"
+)
+
+// watchedPaths returns the local files that the build of opts depends on:
+// the stackerfiles and local imports.
+func watchedPaths(opts stacker.BuildOpts) []string {
+	files := opts.StackerFiles
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	// Stackerfiles from stdin or urls can't be watched.
+	paths := []string{}
+	for _, f := range files {
+		if stacker.IsLocalStackerfile(f) {
+			paths = append(paths, f)
+		}
+	}
+
+	parseOpts := stacker.ParseOpts{
+		Substitutions: opts.Substitutions,
+		Template:      opts.Template,
+		BuildContext:  opts.BuildContext,
+		Config:        config,
+	}
+	sf, err := stacker.NewStackerfiles(files, parseOpts)
+	if err != nil {
+		// We'll pick up the fix to the stackerfiles themselves.
+		return paths
+	}
+
+	for _, l := range sf {
+		if stacker.IsLocalStackerfile(l.Source()) {
+			paths = append(paths, l.Source())
+		}
+
+		imports, err := l.ParseImport()
+		if err != nil {
+			continue
+		}
+
+		for _, imp := range imports {
+			u, err := url.Parse(imp)
+			if err == nil && u.Scheme == "" {
+				paths = append(paths, imp)
+			}
+		}
+	}
+
+	return paths
+}
+
+// snapshotPaths returns a summary of the state of everything under paths,
+// which changes when any of them do.
+func snapshotPaths(paths []string) map[string]string {
+	snapshot := map[string]string{}
+	for _, p := range paths {
+		filepath.Walk(p, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				snapshot[p] = "missing"
+				return nil
+			}
+
+			snapshot[p] = fmt.Sprintf("%s %d %s", info.ModTime(), info.Size(), info.Mode())
+			return nil
+		})
+	}
+
+	return snapshot
+}
+
+func snapshotsDiffer(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return true
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchBuild builds, and then rebuilds whenever a stackerfile or local
+// import changes, until interrupted. The cache means that only layers whose
+// inputs changed (and the ones that depend on them) are actually rebuilt.
+func watchBuild(opts stacker.BuildOpts) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Infof("stopping watch")
+		cancel()
+	}()
+
+	// Keep the storage attached between builds, and detach it when we're
+	// done.
+	leaveUnladen := opts.LeaveUnladen
+	opts.LeaveUnladen = true
+	defer func() {
+		if leaveUnladen {
+			return
+		}
+
+		if s, err := stacker.NewStorage(config); err == nil {
+			s.Detach()
+		}
+	}()
+
+	builder := stacker.NewBuilder(config)
+	for {
+		snapshot := snapshotPaths(watchedPaths(opts))
+
+		if err := builder.Build(ctx, opts); err != nil {
+			log.Errorf("build failed: %s", err)
+		}
+
+		// Only clear the cache on the first build.
+		opts.NoCache = false
+
+		log.Infof("watching for changes...")
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+
+			if snapshotsDiffer(snapshot, snapshotPaths(watchedPaths(opts))) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// StdinStackerfile is the name that means "read the stackerfile from stdin".
+const StdinStackerfile = "-"
+
+var (
+	stdinStackerfile     []byte
+	stdinStackerfileErr  error
+	stdinStackerfileOnce sync.Once
+
+	// stdinUsedFor is what stdin was already read for, if anything.
+	stdinUsedFor string
+)
+
+// SetStdinUsed records that stdin was already read for what (e.g.
+// "--password-stdin"), so that reading a stackerfile from it fails rather
+// than getting an empty one.
+func SetStdinUsed(what string) {
+	stdinUsedFor = what
+}
+
+// isRemoteStackerfile returns true for stackerfiles given as urls. Only https
+// ones can actually be read; since stackerfiles can run commands on the host,
+// readStackerfile refuses to fetch them over plain http.
+func isRemoteStackerfile(stackerfile string) bool {
+	u, err := url.Parse(stackerfile)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// IsLocalStackerfile returns false if stackerfile is read from stdin or
+// fetched from a url rather than being a path on the local filesystem.
+func IsLocalStackerfile(stackerfile string) bool {
+	return stackerfile != StdinStackerfile && !isRemoteStackerfile(stackerfile)
+}
+
+// readStackerfile reads a stackerfile from a path, a url, or stdin. Since
+// stdin can only be read once and stackerfiles are parsed more than once
+// (e.g. by --watch), its content is remembered.
+func readStackerfile(stackerfile string, c StackerConfig) ([]byte, error) {
+	if stackerfile == StdinStackerfile {
+		if stdinUsedFor != "" {
+			return nil, WithKind(UserError, fmt.Errorf("can't read the stackerfile from stdin, it was already used for %s", stdinUsedFor))
+		}
+
+		stdinStackerfileOnce.Do(func() {
+			stdinStackerfile, stdinStackerfileErr = ioutil.ReadAll(os.Stdin)
+		})
+		return stdinStackerfile, stdinStackerfileErr
+	}
+
+	if !isRemoteStackerfile(stackerfile) {
+		return ioutil.ReadFile(stackerfile)
+	}
+
+	if u, _ := url.Parse(stackerfile); u.Scheme != "https" {
+		return nil, WithKind(UserError, fmt.Errorf("won't fetch %s over plain http, use https", stackerfile))
+	}
+
+	client, err := httpClient(c, stackerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(stackerfile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't fetch %s", stackerfile)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("couldn't fetch %s: %s", stackerfile, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// resolveInclude returns where the include of the stackerfile is: relative
+// includes are relative to the stackerfile's url or directory, or for a
+// stackerfile from stdin, to the build context.
+func resolveInclude(stackerfile string, include string, buildContext string) (string, error) {
+	if !IsLocalStackerfile(include) || filepath.IsAbs(include) {
+		return include, nil
+	}
+
+	if isRemoteStackerfile(stackerfile) {
+		base, err := url.Parse(stackerfile)
+		if err != nil {
+			return "", err
+		}
+
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", err
+		}
+
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	if stackerfile == StdinStackerfile {
+		return filepath.Join(buildContext, include), nil
+	}
+
+	return filepath.Join(filepath.Dir(stackerfile), include), nil
+}
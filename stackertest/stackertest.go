@@ -0,0 +1,249 @@
+// Package stackertest helps write Go tests for stackerfiles: it builds them in
+// a throwaway workspace and checks the images they produce. A test looks like:
+//
+//	func TestMyImage(t *testing.T) {
+//		w := stackertest.New(t)
+//		defer w.Cleanup()
+//
+//		w.WriteFile("hello.sh", "#!/bin/sh\necho hello\n")
+//		w.MustBuild(`
+//	myimage:
+//	    from:
+//	        type: docker
+//	        url: docker://alpine:3.18
+//	    import:
+//	        - hello.sh
+//	    run: cp /stacker/hello.sh /usr/bin/hello
+//	    labels:
+//	        app: hello
+//	`)
+//
+//		img := w.Image("myimage")
+//		img.AssertLabel("app", "hello")
+//		img.AssertFileContains("/usr/bin/hello", "echo hello")
+//	}
+//
+// Building needs what stacker itself needs (skopeo, umoci, and root for the
+// btrfs storage), so such tests are integration tests.
+package stackertest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/anuvu/stacker"
+	"github.com/openSUSE/umoci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Workspace is a temporary directory with its own stacker dir, OCI layout and
+// roots dir, which stackerfiles can be written to and built in.
+type Workspace struct {
+	t testing.TB
+
+	// Dir is the workspace's directory; relative paths are relative to
+	// it.
+	Dir string
+
+	// Config is what builds use. As root, the storage is btrfs (on a
+	// loopback device, if the temp dir isn't on btrfs); otherwise it is
+	// the dir storage. Tests may change it before building.
+	Config stacker.StackerConfig
+}
+
+// New creates a workspace in a new temp dir. Call Cleanup when done with it.
+func New(t testing.TB) *Workspace {
+	dir, err := ioutil.TempDir("", "stackertest_")
+	if err != nil {
+		t.Fatalf("couldn't create workspace: %s", err)
+	}
+
+	w := &Workspace{
+		t:   t,
+		Dir: dir,
+		Config: stacker.StackerConfig{
+			StackerDir: path.Join(dir, ".stacker"),
+			OCIDir:     path.Join(dir, "oci"),
+			RootFSDir:  path.Join(dir, "roots"),
+		},
+	}
+
+	if os.Geteuid() != 0 {
+		w.Config.StorageType = "dir"
+	}
+
+	return w
+}
+
+// Cleanup detaches the storage and removes the workspace.
+func (w *Workspace) Cleanup() {
+	syscall.Unmount(w.Config.RootFSDir, syscall.MNT_DETACH)
+	if err := os.RemoveAll(w.Dir); err != nil {
+		w.t.Errorf("couldn't remove workspace: %s", err)
+	}
+}
+
+// Path returns the absolute path of p in the workspace.
+func (w *Workspace) Path(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+
+	return path.Join(w.Dir, p)
+}
+
+// WriteFile writes content to p in the workspace, creating its directory if
+// need be, and returns its absolute path.
+func (w *Workspace) WriteFile(p string, content string) string {
+	p = w.Path(p)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		w.t.Fatalf("couldn't create %s: %s", path.Dir(p), err)
+	}
+
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		w.t.Fatalf("couldn't write %s: %s", p, err)
+	}
+
+	return p
+}
+
+// Build builds with opts in the workspace. Relative stackerfiles, and the
+// default stacker.yaml, are in the workspace.
+func (w *Workspace) Build(opts stacker.BuildOpts) error {
+	if len(opts.StackerFiles) == 0 {
+		opts.StackerFiles = []string{"stacker.yaml"}
+	}
+
+	files := []string{}
+	for _, f := range opts.StackerFiles {
+		if f != stacker.StdinStackerfile && !strings.Contains(f, "://") {
+			f = w.Path(f)
+		}
+		files = append(files, f)
+	}
+	opts.StackerFiles = files
+
+	if opts.Lockfile == "" {
+		opts.Lockfile = w.Path("stacker.lock")
+	}
+
+	return stacker.NewBuilder(w.Config).Build(context.Background(), opts)
+}
+
+// MustBuild writes stackerfile to stacker.yaml in the workspace and builds it,
+// failing the test if the build fails.
+func (w *Workspace) MustBuild(stackerfile string) {
+	w.WriteFile("stacker.yaml", stackerfile)
+	if err := w.Build(stacker.BuildOpts{}); err != nil {
+		w.t.Fatalf("build failed: %s", err)
+	}
+}
+
+// Image is a built image, for checking.
+type Image struct {
+	w *Workspace
+
+	Name     string
+	Manifest ispec.Manifest
+	Config   ispec.Image
+}
+
+// Image returns the image tagged name in the workspace's OCI layout, failing
+// the test if there isn't one.
+func (w *Workspace) Image(name string) *Image {
+	oci, err := umoci.OpenLayout(w.Config.OCIDir)
+	if err != nil {
+		w.t.Fatalf("couldn't open OCI layout: %s", err)
+	}
+	defer oci.Close()
+
+	img := &Image{w: w, Name: name}
+	img.Manifest, err = oci.LookupManifest(name)
+	if err != nil {
+		w.t.Fatalf("no image %s: %s", name, err)
+	}
+
+	img.Config, err = oci.LookupConfig(img.Manifest.Config)
+	if err != nil {
+		w.t.Fatalf("couldn't read the config of %s: %s", name, err)
+	}
+
+	return img
+}
+
+// ReadFile returns the content of the file at p in the image's rootfs; the
+// error satisfies os.IsNotExist if there's no such file.
+func (i *Image) ReadFile(p string) ([]byte, error) {
+	oci, err := umoci.OpenLayout(i.w.Config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	return stacker.ReadImageFile(i.w.Config.OCIDir, oci, i.Name, p)
+}
+
+// AssertLabel fails the test unless the image has the label key with value.
+func (i *Image) AssertLabel(key string, value string) {
+	actual, ok := i.Config.Config.Labels[key]
+	if !ok {
+		i.w.t.Fatalf("%s has no label %s", i.Name, key)
+	}
+
+	if actual != value {
+		i.w.t.Fatalf("%s has label %s=%s, expected %s", i.Name, key, actual, value)
+	}
+}
+
+// AssertEnv fails the test unless the image's environment has key=value.
+func (i *Image) AssertEnv(key string, value string) {
+	for _, env := range i.Config.Config.Env {
+		if env == key+"="+value {
+			return
+		}
+	}
+
+	i.w.t.Fatalf("%s doesn't have %s=%s in its environment %v", i.Name, key, value, i.Config.Config.Env)
+}
+
+// AssertFile fails the test unless the image has a file at p with content.
+func (i *Image) AssertFile(p string, content string) {
+	actual, err := i.ReadFile(p)
+	if err != nil {
+		i.w.t.Fatalf("couldn't read %s from %s: %s", p, i.Name, err)
+	}
+
+	if string(actual) != content {
+		i.w.t.Fatalf("%s in %s is %q, expected %q", p, i.Name, string(actual), content)
+	}
+}
+
+// AssertFileContains fails the test unless the image has a file at p that
+// contains s.
+func (i *Image) AssertFileContains(p string, s string) {
+	actual, err := i.ReadFile(p)
+	if err != nil {
+		i.w.t.Fatalf("couldn't read %s from %s: %s", p, i.Name, err)
+	}
+
+	if !strings.Contains(string(actual), s) {
+		i.w.t.Fatalf("%s in %s doesn't contain %q", p, i.Name, s)
+	}
+}
+
+// AssertNoFile fails the test if the image has a file at p.
+func (i *Image) AssertNoFile(p string) {
+	_, err := i.ReadFile(p)
+	if err == nil {
+		i.w.t.Fatalf("%s has %s", i.Name, p)
+	}
+
+	if !os.IsNotExist(err) {
+		i.w.t.Fatalf("couldn't read %s from %s: %s", p, i.Name, err)
+	}
+}
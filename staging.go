@@ -0,0 +1,97 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// stageLayout makes a staging copy of the OCI layout in ociDir (which need
+// not exist yet) for a build to work in, so that the real layout is only
+// changed by commitLayout. Blobs are immutable, so they are hardlinked rather
+// than copied where possible. It returns the path of the staging layout, and
+// the directory to remove when done with it.
+func stageLayout(ociDir string) (string, string, error) {
+	ociDir = filepath.Clean(ociDir)
+
+	// Next to the real layout, so that it's on the same filesystem and
+	// both the hardlinks and commitLayout's renames work.
+	tmp, err := ioutil.TempDir(path.Dir(ociDir), "."+path.Base(ociDir)+"-staging-")
+	if err != nil {
+		return "", "", err
+	}
+
+	staging := path.Join(tmp, "oci")
+	if _, err := os.Stat(ociDir); os.IsNotExist(err) {
+		return staging, tmp, nil
+	}
+
+	err = filepath.Walk(ociDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(ociDir, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(staging, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(dest, info.Mode())
+		}
+
+		if path.Dir(rel) != "." && os.Link(p, dest) == nil {
+			return nil
+		}
+
+		return fileCopy(dest, p)
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", "", errors.Wrapf(err, "couldn't stage %s", ociDir)
+	}
+
+	return staging, tmp, nil
+}
+
+// commitLayout moves the blobs that are new in the staging layout into
+// ociDir, and then replaces ociDir's index.json with the staged one, so that
+// all of the build's tags show up at once.
+func commitLayout(staging string, ociDir string) error {
+	err := filepath.Walk(staging, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(ociDir, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(dest, info.Mode())
+		}
+
+		if rel == "index.json" {
+			return nil
+		}
+
+		// Blobs are content addressed, so one that is already there
+		// is the same.
+		if _, err := os.Lstat(dest); err == nil {
+			return nil
+		}
+
+		return os.Rename(p, dest)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't commit build to %s", ociDir)
+	}
+
+	return os.Rename(path.Join(staging, "index.json"), path.Join(ociDir, "index.json"))
+}
@@ -2,28 +2,115 @@ package stacker
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/apex/log"
 	"github.com/freddierice/go-losetup"
 )
 
+// Storage manages the root filesystems of the layers under
+// StackerConfig.RootFSDir. All paths are relative to RootFSDir, and each
+// rootfs is at <path>/rootfs inside it.
 type Storage interface {
 	Name() string
+
+	// Create creates a new, empty, path.
 	Create(path string) error
+
+	// Snapshot makes target a (cheap, if possible) copy of source.
 	Snapshot(source string, target string) error
+
+	// Restore makes target a writable copy of the snapshot source.
 	Restore(source string, target string) error
+
 	Delete(path string) error
+
+	// Detach releases any resources (e.g. mounts) that the storage set
+	// up.
 	Detach() error
 }
 
+// SnapshotSender is implemented by storages that can serialize snapshots, so
+// that they can be moved to another machine.
+type SnapshotSender interface {
+	// Send writes the read only snapshot name to w.
+	Send(name string, w io.Writer) error
+
+	// Receive creates the snapshot name from what Send wrote to r.
+	Receive(name string, r io.Reader) error
+}
+
+// StorageDriver sets up a Storage for the config.
+type StorageDriver func(c StackerConfig) (Storage, error)
+
+var (
+	storageDriversLock sync.RWMutex
+	storageDrivers     = map[string]StorageDriver{}
+)
+
+// RegisterStorage makes the storage driver d available as name, for use in
+// StackerConfig.StorageType.
+func RegisterStorage(name string, d StorageDriver) {
+	storageDriversLock.Lock()
+	defer storageDriversLock.Unlock()
+	storageDrivers[name] = d
+}
+
+// StorageTypes returns the names of the registered storage drivers.
+func StorageTypes() []string {
+	storageDriversLock.RLock()
+	defer storageDriversLock.RUnlock()
+
+	names := []string{}
+	for name := range storageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage sets up the storage of type c.StorageType, or btrfs if it isn't
+// set.
 func NewStorage(c StackerConfig) (Storage, error) {
+	name := c.StorageType
+	if name == "" {
+		name = "btrfs"
+	}
+
+	storageDriversLock.RLock()
+	d, ok := storageDrivers[name]
+	storageDriversLock.RUnlock()
+	if !ok {
+		return nil, WithKind(UserError, fmt.Errorf("unknown storage type %s (known types: %s)", name, strings.Join(StorageTypes(), ", ")))
+	}
+
+	// Drivers fail to set up when the host doesn't support them, e.g.
+	// there is no btrfs.
+	s, err := d(c)
+	if err != nil {
+		return nil, WithKind(EnvironmentError, err)
+	}
+
+	return s, nil
+}
+
+func init() {
+	RegisterStorage("btrfs", newBtrfs)
+}
+
+func newBtrfs(c StackerConfig) (Storage, error) {
 	fs := syscall.Statfs_t{}
 
 	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
@@ -44,6 +131,10 @@ func NewStorage(c StackerConfig) (Storage, error) {
 	}
 
 	if !isBtrfs {
+		if os.Geteuid() != 0 {
+			return nil, fmt.Errorf("%s is not on btrfs, and only root can set up a loopback btrfs; mount one there or use --rootless", c.RootFSDir)
+		}
+
 		if err := os.MkdirAll(c.StackerDir, 0755); err != nil {
 			return nil, err
 		}
@@ -103,7 +194,7 @@ func (b *btrfs) Snapshot(source string, target string) error {
 }
 
 func (b *btrfs) Restore(source string, target string) error {
-	fmt.Printf("restoring %s to %s\n", source, target)
+	log.Infof("restoring %s to %s", source, target)
 	output, err := exec.Command(
 		"btrfs",
 		"subvolume",
@@ -158,6 +249,47 @@ func (b *btrfs) Delete(source string) error {
 	return os.RemoveAll(path.Join(b.c.RootFSDir, source))
 }
 
+func (b *btrfs) Send(name string, w io.Writer) error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("btrfs", "send", path.Join(b.c.RootFSDir, name))
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs send: %s: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+func (b *btrfs) Receive(name string, r io.Reader) error {
+	// btrfs receive names the subvolume after the one that was sent, so
+	// receive it somewhere else first and then move it into place.
+	dir, err := ioutil.TempDir(b.c.RootFSDir, ".receive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("btrfs", "receive", dir)
+	cmd.Stdin = r
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs receive: %s: %s", err, stderr.String())
+	}
+
+	received, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(received) != 1 {
+		return fmt.Errorf("btrfs receive: expected one subvolume, got %d", len(received))
+	}
+
+	return os.Rename(path.Join(dir, received[0].Name()), path.Join(b.c.RootFSDir, name))
+}
+
 func (b *btrfs) Detach() error {
 	if b.needsUmount {
 		err := syscall.Unmount(b.c.RootFSDir, syscall.MNT_DETACH)
@@ -260,12 +392,3 @@ func isMounted(path string) (bool, error) {
 
 	return false, nil
 }
-
-func haveRsync() error {
-	_, err := exec.LookPath("rsync")
-	if err != nil {
-		return fmt.Errorf("rsync binary not found")
-	}
-
-	return nil
-}
@@ -0,0 +1,100 @@
+package stacker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// bracedVar matches either an escaped "$${", or a ${NAME} or ${NAME:-default}
+// substitution reference.
+var bracedVar = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+func parseSubstitutions(substitutions []string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, subst := range substitutions {
+		membs := strings.SplitN(subst, "=", 2)
+		if len(membs) != 2 {
+			return nil, fmt.Errorf("invalid substition %s", subst)
+		}
+
+		vars[membs[0]] = membs[1]
+	}
+
+	return vars, nil
+}
+
+// substitute performs the substitutions on the content of the stackerfile
+// file. ${FOO} references are replaced with the value of FOO, or an error is
+// returned if FOO isn't defined (unless it is in deferred, in which case it is
+// left for later); ${FOO:-bar} is replaced with bar if FOO is
+// not defined. $${ may be used to get a literal ${. For backwards
+// compatibility, $FOO is also replaced if FOO is defined, but is otherwise
+// left as is, since it is likely intended for the shell in a run: section.
+func substitute(file string, content string, substitutions []string, deferred map[string]bool) (string, error) {
+	vars, err := parseSubstitutions(substitutions)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		var missing string
+		lines[i] = bracedVar.ReplaceAllStringFunc(line, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+
+			membs := bracedVar.FindStringSubmatch(ref)
+			if v, ok := vars[membs[1]]; ok {
+				return v
+			}
+
+			if deferred[membs[1]] {
+				return ref
+			}
+
+			if strings.Contains(ref, ":-") {
+				return membs[2]
+			}
+
+			if missing == "" {
+				missing = membs[1]
+			}
+			return ref
+		})
+
+		if missing != "" {
+			return "", fmt.Errorf("%s:%d: undefined substitution %s", file, i+1, missing)
+		}
+	}
+
+	content = strings.Join(lines, "\n")
+
+	for _, subst := range substitutions {
+		membs := strings.SplitN(subst, "=", 2)
+		from := fmt.Sprintf("$%s", membs[0])
+		to := membs[1]
+
+		log.Debugf("substituting %s to %s", from, to)
+
+		content = strings.Replace(content, from, to, -1)
+	}
+
+	return content, nil
+}
+
+// expandVars replaces the ${NAME} and ${NAME:-default} references to the
+// variables in vars with their values, leaving any other references alone.
+func expandVars(content string, vars map[string]string) string {
+	return bracedVar.ReplaceAllStringFunc(content, func(ref string) string {
+		membs := bracedVar.FindStringSubmatch(ref)
+		if v, ok := vars[membs[1]]; ok && membs[1] != "" {
+			return v
+		}
+
+		return ref
+	})
+}
@@ -0,0 +1,101 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// LayerSummary is how long the phases of a layer's build took, and what it
+// resulted in. Times are in seconds.
+type LayerSummary struct {
+	Layer  string  `json:"layer"`
+	Cached bool    `json:"cached"`
+	Import float64 `json:"import_seconds"`
+	Run    float64 `json:"run_seconds"`
+	Repack float64 `json:"repack_seconds"`
+	Total  float64 `json:"total_seconds"`
+	Size   int64   `json:"size"`
+	Digest string  `json:"digest"`
+
+	start   time.Time
+	phase   time.Time
+	runDone time.Time
+}
+
+// BuildSummary collects the per layer summary of a build from its events;
+// pass its Record method as (or from) BuildOpts.Progress.
+type BuildSummary struct {
+	Layers []*LayerSummary `json:"layers"`
+}
+
+func (s *BuildSummary) layer(name string) *LayerSummary {
+	for _, l := range s.Layers {
+		if l.Layer == name {
+			return l
+		}
+	}
+
+	l := &LayerSummary{Layer: name}
+	s.Layers = append(s.Layers, l)
+	return l
+}
+
+// Record updates the summary with ev.
+func (s *BuildSummary) Record(ev BuildEvent) {
+	if ev.Layer == "" {
+		return
+	}
+
+	l := s.layer(ev.Layer)
+	switch ev.Event {
+	case EventImportStart:
+		l.start = ev.Time
+		l.phase = ev.Time
+	case EventImportDone:
+		l.Import = ev.Time.Sub(l.phase).Seconds()
+	case EventRunStart:
+		l.phase = ev.Time
+	case EventRunDone:
+		l.Run = ev.Time.Sub(l.phase).Seconds()
+		l.runDone = ev.Time
+	case EventRepackDone:
+		l.Repack = ev.Time.Sub(l.runDone).Seconds()
+	case EventCacheHit:
+		l.Cached = true
+		fallthrough
+	case EventLayerDone:
+		l.Digest = ev.Digest
+		l.Size = ev.Size
+		l.Total = ev.Time.Sub(l.start).Seconds()
+	}
+}
+
+// WriteTable writes the summary as a human readable table.
+func (s *BuildSummary) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tCACHED\tIMPORT\tRUN\tREPACK\tTOTAL\tSIZE\tDIGEST")
+
+	seconds := func(f float64) string {
+		return time.Duration(f * float64(time.Second)).Round(100 * time.Millisecond).String()
+	}
+
+	for _, l := range s.Layers {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Layer, l.Cached,
+			seconds(l.Import), seconds(l.Run), seconds(l.Repack), seconds(l.Total),
+			units.HumanSize(float64(l.Size)), l.Digest)
+	}
+
+	return tw.Flush()
+}
+
+// WriteJSON writes the summary as JSON.
+func (s *BuildSummary) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
@@ -0,0 +1,52 @@
+package stacker
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+var templateFuncs = template.FuncMap{
+	// seq returns the integers [0, n), so that templates can generate
+	// several nearly identical layers with range.
+	"seq": func(n int) []int {
+		ret := make([]int, n)
+		for i := range ret {
+			ret[i] = i
+		}
+		return ret
+	},
+	"split": strings.Split,
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"default": func(def string, val string) string {
+		if val == "" {
+			return def
+		}
+		return val
+	},
+}
+
+// renderTemplate renders the stackerfile content as a go text/template, with
+// the KEY=VALUE substitutions available as {{.KEY}}.
+func renderTemplate(name string, content string, substitutions []string) (string, error) {
+	vars, err := parseSubstitutions(substitutions)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(content)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't parse template")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, vars); err != nil {
+		return "", errors.Wrapf(err, "couldn't render template")
+	}
+
+	return buf.String(), nil
+}
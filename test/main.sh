@@ -20,6 +20,7 @@ function cleanup() {
     umount roots >& /dev/null || true
     rm -rf roots oci dest >& /dev/null || true
     rm link >& /dev/null || true
+    rm stacker.lock >& /dev/null || true
     if [ -z "$STACKER_KEEP" ]; then
         rm -rf .stacker >& /dev/null || true
     else
@@ -0,0 +1,257 @@
+package stacker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer records the phases of builds as OpenTelemetry spans, and exports
+// them to an OTLP/HTTP collector. A nil *Tracer records nothing, so callers
+// don't have to check whether tracing was requested.
+type Tracer struct {
+	endpoint string
+	traceID  string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewTracer returns a Tracer that exports to the OTLP/HTTP collector at
+// endpoint, e.g. http://collector:4318.
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{endpoint: endpoint, traceID: randomHex(16)}
+}
+
+// TraceID is the id of the trace all of the tracer's spans are in.
+func (t *Tracer) TraceID() string {
+	if t == nil {
+		return ""
+	}
+	return t.traceID
+}
+
+// Span is a single timed operation of a trace.
+type Span struct {
+	id       string
+	parentID string
+	name     string
+	attrs    map[string]string
+	start    time.Time
+	end      time.Time
+	err      error
+}
+
+// Start starts a span called name, as a child of parent if that isn't nil.
+func (t *Tracer) Start(parent *Span, name string, attrs map[string]string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{id: randomHex(8), name: name, attrs: attrs, start: time.Now()}
+	if parent != nil {
+		s.parentID = parent.id
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// End ends the span, marking it as failed if err isn't nil. Ending a span
+// that has already ended does nothing.
+func (s *Span) End(err error) {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// These are the parts of the OTLP/HTTP JSON encoding we need; see
+// opentelemetry-proto's trace.proto.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	result := []otlpAttribute{}
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		result = append(result, a)
+	}
+	return result
+}
+
+// request encodes the spans that have ended as an OTLP export request.
+func (t *Tracer) request() otlpRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := []otlpSpan{}
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			continue
+		}
+
+		span := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: 1}, // STATUS_CODE_OK
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()} // STATUS_CODE_ERROR
+		}
+		spans = append(spans, span)
+	}
+
+	scope := otlpScopeSpans{Spans: spans}
+	scope.Scope.Name = "github.com/anuvu/stacker"
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = otlpAttributes(map[string]string{"service.name": "stacker"})
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// Export sends the spans that have ended to the collector.
+func (t *Tracer) Export(c StackerConfig) error {
+	if t == nil {
+		return nil
+	}
+
+	content, err := json.Marshal(t.request())
+	if err != nil {
+		return err
+	}
+
+	target := t.endpoint
+	if !strings.HasSuffix(target, "/v1/traces") {
+		target = strings.TrimSuffix(target, "/") + "/v1/traces"
+	}
+
+	client, err := httpClient(c, target)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(target, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting traces to %s: %s", target, resp.Status)
+	}
+
+	return nil
+}
+
+// buildTrace keeps track of the spans of a build: one for the whole build,
+// one per layer, and one for the layer's current phase.
+type buildTrace struct {
+	tracer *Tracer
+	build  *Span
+	layer  *Span
+	phase  *Span
+}
+
+func newBuildTrace(t *Tracer) *buildTrace {
+	return &buildTrace{tracer: t, build: t.Start(nil, "build", nil)}
+}
+
+// startLayer ends the previous layer's spans and starts one for the layer
+// name.
+func (bt *buildTrace) startLayer(name string) {
+	bt.phase.End(nil)
+	bt.layer.End(nil)
+	bt.phase = nil
+	bt.layer = bt.tracer.Start(bt.build, name, map[string]string{"stacker.layer": name})
+}
+
+// startPhase ends the current phase's span and starts one for the phase
+// name of the current layer (or of the build, between layers).
+func (bt *buildTrace) startPhase(name string) {
+	bt.phase.End(nil)
+
+	parent := bt.layer
+	if parent == nil || !parent.end.IsZero() {
+		parent = bt.build
+	}
+	bt.phase = bt.tracer.Start(parent, name, nil)
+}
+
+// endLayer ends the current layer's spans, e.g. when it was a cache hit.
+func (bt *buildTrace) endLayer(cached bool) {
+	if bt.layer != nil {
+		bt.layer.attrs["stacker.cached"] = strconv.FormatBool(cached)
+	}
+	bt.phase.End(nil)
+	bt.layer.End(nil)
+}
+
+// end ends all the spans, with the build's error, if any.
+func (bt *buildTrace) end(err error) {
+	bt.phase.End(err)
+	bt.layer.End(err)
+	bt.build.End(err)
+}
@@ -0,0 +1,168 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Validate checks that the layer's directives are consistent and parseable,
+// without doing any of the work of building it.
+func (l *Layer) Validate() error {
+	if l.From == nil {
+		return fmt.Errorf("no base (from directive)")
+	}
+
+	switch l.From.Type {
+	case BuiltType:
+		if l.From.Tag == "" {
+			return fmt.Errorf("from type %s requires a tag", l.From.Type)
+		}
+	case DockerType, TarType, OCIType:
+		if l.From.Url == "" {
+			return fmt.Errorf("from type %s requires a url", l.From.Type)
+		}
+	case ScratchType:
+	default:
+		return fmt.Errorf("unknown from type: %s", l.From.Type)
+	}
+
+	if l.From.Type == ScratchType && l.Run != nil {
+		return fmt.Errorf("scratch layers have no shell to run commands with")
+	}
+
+	if l.From.Type == OCIType {
+		if _, _, err := l.From.ParseOCI(); err != nil {
+			return err
+		}
+	}
+
+	parsers := []struct {
+		name  string
+		parse func() ([]string, error)
+	}{
+		{"import", l.ParseImport},
+		{"run", l.getRun},
+		{"cmd", l.ParseCmd},
+		{"entrypoint", l.ParseEntrypoint},
+		{"full_command", l.ParseFullCommand},
+		{"layer_type", l.ParseLayerType},
+	}
+
+	for _, p := range parsers {
+		if _, err := p.parse(); err != nil {
+			return errors.Wrapf(err, "invalid %s", p.name)
+		}
+	}
+
+	if l.FullCommand != nil && (l.Cmd != nil || l.Entrypoint != nil) {
+		return fmt.Errorf("full_command replaces cmd and entrypoint, so it can't be used with them")
+	}
+
+	if l.isShellForm(l.Entrypoint) && l.Cmd != nil {
+		return fmt.Errorf("a shell form entrypoint ignores cmd, so they can't be used together")
+	}
+
+	if _, err := l.ParseHealthcheck(); err != nil {
+		return err
+	}
+
+	if _, _, err := l.ParseHooks(); err != nil {
+		return errors.Wrapf(err, "invalid hooks")
+	}
+
+	if _, err := l.ParseRunTimeout(); err != nil {
+		return err
+	}
+
+	if l.Shell != "" && !path.IsAbs(l.Shell) {
+		return fmt.Errorf("shell %s isn't an absolute path", l.Shell)
+	}
+
+	if _, err := l.ParseMaxSize(); err != nil {
+		return err
+	}
+
+	if l.RunRetries < 0 {
+		return fmt.Errorf("invalid run_retries %d", l.RunRetries)
+	}
+
+	if _, err := resourceConfigs(l.Resources, false); err != nil {
+		return errors.Wrapf(err, "invalid resources")
+	}
+
+	if err := ValidateNetwork(l.Network, l.DNS, l.ExtraHosts); err != nil {
+		return err
+	}
+
+	if len(l.GIDMap) > 0 && len(l.UIDMap) == 0 {
+		return fmt.Errorf("gid_map requires a uid_map")
+	}
+
+	if len(l.UIDMap) > 0 {
+		if _, err := NewIdmapSet(l.UIDMap, l.GIDMap); err != nil {
+			return err
+		}
+	}
+
+	if err := validateBuildCacheDirs(l.BuildCacheDirs); err != nil {
+		return err
+	}
+
+	if err := validateBuildEnv(l.BuildEnv, l.BuildEnvPassthrough); err != nil {
+		return err
+	}
+
+	if _, err := l.ParsePlatform(StackerConfig{}); err != nil {
+		return err
+	}
+
+	imports, err := l.ParseImports()
+	if err != nil {
+		return err
+	}
+
+	for _, imp := range imports {
+		if imp.Signature != "" && imp.Keyring == "" {
+			return fmt.Errorf("import %s has a signature but no keyring", imp.Path)
+		}
+
+		if imp.ChecksumsSignature != "" && (imp.Checksums == "" || imp.Keyring == "") {
+			return fmt.Errorf("import %s has a checksums_signature but no checksums or keyring", imp.Path)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks every layer in the stackerfile, and that the dependencies
+// between them can be resolved. Its errors are UserErrors.
+func (s *Stackerfile) Validate() error {
+	return WithKind(UserError, s.validate())
+}
+
+func (s *Stackerfile) validate() error {
+	names := []string{}
+	for name := range *s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		layer := (*s)[name]
+		if err := layer.Validate(); err != nil {
+			return errors.Wrapf(err, "layer %s", name)
+		}
+
+		for _, dep := range layer.Dependencies() {
+			if _, ok := (*s)[dep]; !ok {
+				return fmt.Errorf("layer %s depends on unknown layer %s", name, dep)
+			}
+		}
+	}
+
+	_, err := s.DependencyOrder()
+	return err
+}
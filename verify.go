@@ -0,0 +1,234 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/openSUSE/umoci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// VerifyProblem is something wrong with a blob of an image that
+// VerifyLayout found.
+type VerifyProblem struct {
+	Tag     string
+	What    string
+	Digest  digest.Digest
+	Problem string
+}
+
+func (p VerifyProblem) String() string {
+	if p.Digest == "" {
+		return fmt.Sprintf("%s: %s", p.Tag, p.Problem)
+	}
+	return fmt.Sprintf("%s: %s %s: %s", p.Tag, p.What, p.Digest, p.Problem)
+}
+
+// verifyBlob checks that the blob desc is in the layout, and that its size and
+// digest match. If diffID isn't empty, the blob is a layer, and the digest of
+// its uncompressed content is checked against diffID too. It returns what is
+// wrong, or "" if the blob is fine.
+func verifyBlob(ociDir string, desc ispec.Descriptor, diffID digest.Digest) (string, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Sprintf("bad digest: %s", err), nil
+	}
+
+	f, err := os.Open(layoutBlobPath(ociDir, desc.Digest))
+	if os.IsNotExist(err) {
+		return "missing", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	counter := &countingWriter{}
+	digester := desc.Digest.Algorithm().Digester()
+	content := io.TeeReader(f, io.MultiWriter(digester.Hash(), counter))
+
+	// Squashfs layers aren't compressed, their diff_id is their digest.
+	uncompressedDigest := digest.Digest("")
+	if diffID != "" && desc.MediaType != MediaTypeImageSquashfsLayer {
+		uncompressed, err := decompressor(desc.MediaType, content)
+		if err != nil {
+			return err.Error(), nil
+		}
+
+		uncompressedDigester := diffID.Algorithm().Digester()
+		_, err = io.Copy(uncompressedDigester.Hash(), uncompressed)
+		uncompressed.Close()
+		if err != nil {
+			return fmt.Sprintf("couldn't decompress: %s", err), nil
+		}
+		uncompressedDigest = uncompressedDigester.Digest()
+	}
+
+	// Whatever the decompressor didn't need still counts for the digest.
+	if _, err := io.Copy(ioutil.Discard, content); err != nil {
+		return "", err
+	}
+
+	if counter.n != desc.Size {
+		return fmt.Sprintf("size is %d, expected %d", counter.n, desc.Size), nil
+	}
+
+	if digester.Digest() != desc.Digest {
+		return fmt.Sprintf("content has digest %s", digester.Digest()), nil
+	}
+
+	if diffID == "" {
+		return "", nil
+	}
+
+	if desc.MediaType == MediaTypeImageSquashfsLayer {
+		uncompressedDigest = desc.Digest
+	}
+
+	if uncompressedDigest != diffID {
+		return fmt.Sprintf("uncompressed content has digest %s, but the config's diff_id is %s", uncompressedDigest, diffID), nil
+	}
+
+	return "", nil
+}
+
+// layoutVerifier verifies the images of a layout, checking each blob only
+// once however many images share it (per diff_id, for layers).
+type layoutVerifier struct {
+	ociDir   string
+	checked  map[string]string
+	problems []VerifyProblem
+}
+
+// check verifies desc, records a problem with it for tag, and returns true
+// if it is fine.
+func (v *layoutVerifier) check(tag string, what string, desc ispec.Descriptor, diffID digest.Digest) (bool, error) {
+	key := fmt.Sprintf("%s %s", desc.Digest, diffID)
+	problem, ok := v.checked[key]
+	if !ok {
+		var err error
+		problem, err = verifyBlob(v.ociDir, desc, diffID)
+		if err != nil {
+			return false, err
+		}
+		v.checked[key] = problem
+	}
+
+	if problem != "" {
+		v.problems = append(v.problems, VerifyProblem{Tag: tag, What: what, Digest: desc.Digest, Problem: problem})
+	}
+
+	return problem == "", nil
+}
+
+func (v *layoutVerifier) problem(tag string, what string, d digest.Digest, format string, args ...interface{}) {
+	v.problems = append(v.problems, VerifyProblem{Tag: tag, What: what, Digest: d, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (v *layoutVerifier) verifyManifest(tag string, desc ispec.Descriptor) error {
+	ok, err := v.check(tag, "manifest", desc, "")
+	if err != nil || !ok {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(layoutBlobPath(v.ociDir, desc.Digest))
+	if err != nil {
+		return err
+	}
+
+	mediaType, err := manifestMediaType(raw)
+	if err != nil {
+		v.problem(tag, "manifest", desc.Digest, "%s", err)
+		return nil
+	}
+
+	if isIndexMediaType(mediaType) {
+		index := ispec.Index{}
+		if err := json.Unmarshal(raw, &index); err != nil {
+			v.problem(tag, "index", desc.Digest, "bad index: %s", err)
+			return nil
+		}
+
+		for _, m := range index.Manifests {
+			if err := v.verifyManifest(tag, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		v.problem(tag, "manifest", desc.Digest, "bad manifest: %s", err)
+		return nil
+	}
+
+	ok, err = v.check(tag, "config", manifest.Config, "")
+	if err != nil || !ok {
+		return err
+	}
+
+	config := ispec.Image{}
+	rawConfig, err := ioutil.ReadFile(layoutBlobPath(v.ociDir, manifest.Config.Digest))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		v.problem(tag, "config", manifest.Config.Digest, "bad config: %s", err)
+		return nil
+	}
+
+	// Artifacts (signatures, SBOMs, ...) have an empty config, so there
+	// are no diff_ids to check their layers against.
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != 0 && len(diffIDs) != len(manifest.Layers) {
+		v.problem(tag, "config", manifest.Config.Digest, "%d diff_ids for %d layers", len(diffIDs), len(manifest.Layers))
+		diffIDs = nil
+	}
+
+	for i, layer := range manifest.Layers {
+		diffID := digest.Digest("")
+		if len(diffIDs) != 0 {
+			diffID = diffIDs[i]
+		}
+
+		if _, err := v.check(tag, fmt.Sprintf("layer %d", i), layer, diffID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyLayout checks the images tagged tags (or all of them, if there are
+// none) in the layout: that every blob they refer to exists, that the blobs'
+// sizes and digests match their content, and that the uncompressed digests of
+// their layers match the diff_ids in their configs. It returns the problems it
+// found; the error is for when it couldn't check at all.
+func VerifyLayout(ociDir string, oci *umoci.Layout, tags []string) ([]VerifyProblem, error) {
+	if len(tags) == 0 {
+		var err error
+		tags, err = oci.ListTags()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v := &layoutVerifier{ociDir: ociDir, checked: map[string]string{}}
+	for _, tag := range tags {
+		desc, err := oci.LookupManifestDescriptor(tag)
+		if err != nil {
+			v.problem(tag, "tag", "", "%s", err)
+			continue
+		}
+
+		if err := v.verifyManifest(tag, desc); err != nil {
+			return nil, err
+		}
+	}
+
+	return v.problems, nil
+}
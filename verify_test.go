@@ -0,0 +1,66 @@
+package stacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestVerifyBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("meshuggah rocks "), 1024)
+	diffID := digest.FromBytes(content)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+
+	desc, err := writeLayoutBlob(dir, ispec.MediaTypeImageLayerGzip, buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	check := func(desc ispec.Descriptor, diffID digest.Digest, expected string) {
+		problem, err := verifyBlob(dir, desc, diffID)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if !strings.Contains(problem, expected) || (expected == "") != (problem == "") {
+			t.Fatalf("expected %q, got %q", expected, problem)
+		}
+	}
+
+	check(desc, diffID, "")
+	check(desc, "", "")
+	check(desc, digest.FromString("foo"), "but the config's diff_id is")
+
+	bad := desc
+	bad.Size++
+	check(bad, diffID, "size is")
+
+	bad = desc
+	bad.Digest = digest.FromString("missing")
+	check(bad, diffID, "missing")
+
+	// Without a diff_id the content isn't decompressed, so only the
+	// digest catches a flipped byte.
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if err := ioutil.WriteFile(layoutBlobPath(dir, desc.Digest), corrupt, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	check(desc, "", "content has digest")
+}
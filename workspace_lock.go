@@ -0,0 +1,79 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+// WorkspaceLock is a set of advisory locks on the stacker dir, OCI layout and
+// roots dir of a StackerConfig, so that concurrent stacker invocations don't
+// trample on each other's cache and .working snapshot.
+type WorkspaceLock struct {
+	files []*os.File
+}
+
+// workspaceLockPath is the lock file for dir. It lives next to dir rather
+// than in it, since dir may not exist yet, and the roots dir may be a mount
+// point whose contents are the snapshots.
+func workspaceLockPath(dir string) string {
+	dir = filepath.Clean(dir)
+	return path.Join(path.Dir(dir), "."+path.Base(dir)+".lock")
+}
+
+// LockWorkspace takes exclusive locks on sc's directories. If wait is false
+// and another process holds one of them, it fails straight away; otherwise it
+// waits for the other process to finish.
+func LockWorkspace(sc StackerConfig, wait bool) (*WorkspaceLock, error) {
+	lock := &WorkspaceLock{}
+
+	seen := map[string]bool{}
+	for _, dir := range []string{sc.StackerDir, sc.OCIDir, sc.RootFSDir} {
+		p := workspaceLockPath(dir)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		lock.files = append(lock.files, f)
+
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == unix.EWOULDBLOCK && wait {
+			log.Infof("waiting for another stacker to finish with %s", dir)
+			err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		}
+		if err == unix.EWOULDBLOCK {
+			lock.Unlock()
+			return nil, WithKind(EnvironmentError, fmt.Errorf("%s is in use by another stacker", dir))
+		}
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+
+	return lock, nil
+}
+
+// Unlock releases the locks.
+func (l *WorkspaceLock) Unlock() {
+	for _, f := range l.files {
+		// Closing the file drops the lock.
+		f.Close()
+	}
+	l.files = nil
+}